@@ -0,0 +1,137 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// The access log follows the format of the 389 Directory Server access
+// log, with one line per event:
+//
+//	[18/Oct/2026:10:15:02.123456789 +0000] conn=12 connection from 10.0.0.5:51324 to 10.0.0.1:389
+//	[18/Oct/2026:10:15:02.124012345 +0000] conn=12 TLS1.3 TLS_AES_128_GCM_SHA256
+//	[18/Oct/2026:10:15:02.125208910 +0000] conn=12 op=0 BIND dn="cn=admin,dc=example,dc=com" method=128
+//	[18/Oct/2026:10:15:02.126004214 +0000] conn=12 op=0 RESULT err=0 tag=97 nentries=0 etime=0.000796 authzid="dn:cn=admin,dc=example,dc=com"
+//	[18/Oct/2026:10:15:02.127230018 +0000] conn=12 op=1 SRCH base="dc=example,dc=com" scope=2 filter="(uid=alice)" attrs="cn mail"
+//	[18/Oct/2026:10:15:02.129544380 +0000] conn=12 op=1 RESULT err=0 tag=101 nentries=1 etime=0.002314
+//	[18/Oct/2026:10:15:02.130101111 +0000] conn=12 op=2 UNBIND
+//	[18/Oct/2026:10:15:02.130422950 +0000] conn=12 closed
+
+const accessLogTimeFormat = "02/Jan/2006:15:04:05.000000000 -0700"
+
+// accessLogf writes a line to the access log of s, if any.
+func (s *Server) accessLogf(format string, args ...any) {
+	if s.AccessLog == nil {
+		return
+	}
+	line := "[" + time.Now().Format(accessLogTimeFormat) + "] " + fmt.Sprintf(format, args...) + "\n"
+	s.accessLogMutex.Lock()
+	s.AccessLog.Write([]byte(line))
+	s.accessLogMutex.Unlock()
+}
+
+func (c *client) accessLogOpened() {
+	if cred, ok := c.PeerCredentials(); ok {
+		c.srv.accessLogf("conn=%d connection from local uid=%d gid=%d pid=%d to %s", c.Numero, cred.UID, cred.GID, cred.PID, c.rwc.LocalAddr())
+		return
+	}
+	c.srv.accessLogf("conn=%d connection from %s to %s", c.Numero, c.rwc.RemoteAddr(), c.rwc.LocalAddr())
+}
+
+func (c *client) accessLogClosed() {
+	c.srv.accessLogf("conn=%d closed", c.Numero)
+}
+
+func (c *client) accessLogTLS(state tls.ConnectionState) {
+	line := fmt.Sprintf("conn=%d %s %s", c.Numero, tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		line += " client_dn=" + strconv.Quote(state.VerifiedChains[0][0].Subject.String())
+	}
+	c.srv.accessLogf("%s", line)
+}
+
+func tlsVersionName(version uint16) string {
+	return strings.ReplaceAll(tls.VersionName(version), " ", "")
+}
+
+// accessLogRequest writes the summary of the request message.
+func (c *client) accessLogRequest(message *ldap.LDAPMessage, op *operation) {
+	if c.srv.AccessLog == nil {
+		return
+	}
+	c.srv.accessLogf("conn=%d op=%d %s", c.Numero, op.number, describeRequest(message))
+}
+
+// accessLogResult writes the result of the operation op.
+func (c *client) accessLogResult(op *operation) {
+	if c.srv.AccessLog == nil {
+		return
+	}
+	code, ok := op.result()
+	if !ok {
+		return
+	}
+	op.mutex.Lock()
+	tag, entries := op.tag, op.entries
+	op.mutex.Unlock()
+	line := fmt.Sprintf("conn=%d op=%d RESULT err=%d tag=%d nentries=%d etime=%.6f",
+		c.Numero, op.number, code, 0x60|int(tag), entries, time.Since(op.start).Seconds())
+	if tag == ApplicationBindResponse && code == LDAPResultSuccess {
+		line += " authzid=" + strconv.Quote(c.AuthzID())
+	}
+	c.srv.accessLogf("%s", line)
+}
+
+// describeRequest returns the access log summary of a request.
+func describeRequest(message *ldap.LDAPMessage) string {
+	switch r := message.ProtocolOp().(type) {
+	case ldap.BindRequest:
+		if r.AuthenticationChoice() == "sasl" {
+			mechanism, _, _ := SASLCredentials(r)
+			return fmt.Sprintf("BIND dn=%s method=sasl mech=%s", strconv.Quote(string(r.Name())), mechanism)
+		}
+		return fmt.Sprintf("BIND dn=%s method=128", strconv.Quote(string(r.Name())))
+	case ldap.SearchRequest:
+		attrs := make([]string, 0, len(r.Attributes()))
+		for _, a := range r.Attributes() {
+			attrs = append(attrs, string(a))
+		}
+		attrList := "ALL"
+		if len(attrs) > 0 {
+			attrList = strconv.Quote(strings.Join(attrs, " "))
+		}
+		return fmt.Sprintf("SRCH base=%s scope=%d filter=%s attrs=%s",
+			strconv.Quote(string(r.BaseObject())), int(r.Scope()), strconv.Quote(r.FilterString()), attrList)
+	case ldap.AddRequest:
+		return "ADD dn=" + strconv.Quote(string(r.Entry()))
+	case ldap.DelRequest:
+		return "DEL dn=" + strconv.Quote(string(r))
+	case ldap.ModifyRequest:
+		return "MOD dn=" + strconv.Quote(string(r.Object()))
+	case ldap.ModifyDNRequest:
+		req, err := parseModifyDNRequest(r)
+		if err != nil {
+			return "MODRDN"
+		}
+		line := fmt.Sprintf("MODRDN dn=%s newrdn=%s deleteoldrdn=%t",
+			strconv.Quote(req.entry), strconv.Quote(req.newRDN), req.deleteOldRDN)
+		if req.hasNewSuperior {
+			line += " newsuperior=" + strconv.Quote(req.newSuperior)
+		}
+		return line
+	case ldap.CompareRequest:
+		return fmt.Sprintf("CMP dn=%s attr=%s", strconv.Quote(string(r.Entry())), strconv.Quote(string(r.Ava().AttributeDesc())))
+	case ldap.ExtendedRequest:
+		return "EXT oid=" + strconv.Quote(string(r.RequestName()))
+	case ldap.AbandonRequest:
+		return fmt.Sprintf("ABANDON targetmsgid=%d", int(r))
+	case ldap.UnbindRequest:
+		return "UNBIND"
+	}
+	return message.ProtocolOpName()
+}
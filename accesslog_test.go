@@ -0,0 +1,69 @@
+package ldapserver
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func TestE2E_AccessLog(t *testing.T) {
+	var out syncBuffer
+	addr, stop := startLoggingServer(t, func(s *Server) {
+		s.AccessLog = &out
+	})
+
+	conn := dialAndBind(t, addr)
+	_, err := conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(uid=alice)", []string{"cn", "mail"}, nil))
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if err := conn.Bind("cn=test", "wrong"); err == nil {
+		t.Fatal("expected bind failure")
+	}
+	conn.Unbind()
+	stop()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		`conn=(\d+) connection from 127\.0\.0\.1:\d+ to 127\.0\.0\.1:\d+`,
+		`conn=(\d+) op=0 BIND dn="cn=test" method=128`,
+		`conn=(\d+) op=0 RESULT err=0 tag=97 nentries=0 etime=\d+\.\d{6} authzid="dn:cn=test"`,
+		`conn=(\d+) op=1 SRCH base="dc=example" scope=2 filter="\(uid=alice\)" attrs="cn mail"`,
+		`conn=(\d+) op=1 RESULT err=0 tag=101 nentries=2 etime=\d+\.\d{6}`,
+		`conn=(\d+) op=2 BIND dn="cn=test" method=128`,
+		`conn=(\d+) op=2 RESULT err=49 tag=97 nentries=0 etime=\d+\.\d{6}`,
+		`conn=(\d+) op=3 UNBIND`,
+		`conn=(\d+) closed`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got:\n%s", len(want), out.String())
+	}
+	for i, pattern := range want {
+		re := regexp.MustCompile(`^\[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2}\.\d{9} [+-]\d{4}\] ` + pattern + `$`)
+		if !re.MatchString(lines[i]) {
+			t.Fatalf("line %d: expected %s, got %s", i, pattern, lines[i])
+		}
+	}
+}
+
+func TestE2E_AccessLogTLS(t *testing.T) {
+	var out syncBuffer
+	ca, serverCert, clientCert := testPKI(t)
+	addr := startTLSClientAuthServer(t, ca, serverCert, func(s *Server) {
+		s.AccessLog = &out
+	})
+
+	conn := dialTLSClientCert(t, addr, ca, clientCert)
+	defer conn.Close()
+	if _, err := conn.WhoAmI(nil); err != nil {
+		t.Fatalf("whoami: %v", err)
+	}
+
+	re := regexp.MustCompile(`conn=\d+ TLS1\.[23] \S+ client_dn="CN=alice,O=Example"\n`)
+	if !re.MatchString(out.String()) {
+		t.Fatalf("expected a TLS line, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,245 @@
+package ldapserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// AuditRecord is a write operation to which a handler answered success.
+type AuditRecord struct {
+	Time         time.Time
+	ConnectionID int
+	RemoteAddr   string
+	AuthzID      string // identity the client was bound as, empty when anonymous
+	Op           string // "add", "modify", "delete" or "modifydn"
+	DN           string // entry written
+	// LDIF is the change record of the operation (RFC 2849), preceded by
+	// comment lines with the other fields and followed by an empty line:
+	//
+	//	# time: 20261018101502Z
+	//	# conn: 12
+	//	# client: 10.0.0.5:51324
+	//	# authzid: dn:cn=admin,dc=example,dc=com
+	//	dn: uid=alice,ou=people,dc=example,dc=com
+	//	changetype: modify
+	//	replace: mail
+	//	mail: alice@example.com
+	//	-
+	LDIF string
+}
+
+// AuditSink receives the records of successful write operations. Set
+// Server.Audit to an AuditFile, an AuditChan, an AuditFunc or another
+// implementation.
+//
+// Audit is called from the goroutine of the handler, when it writes the
+// result, and may be called concurrently. The server logs the errors it
+// returns.
+type AuditSink interface {
+	Audit(rec AuditRecord) error
+}
+
+// AuditFunc is an AuditSink calling a function.
+type AuditFunc func(rec AuditRecord) error
+
+func (f AuditFunc) Audit(rec AuditRecord) error {
+	return f(rec)
+}
+
+// AuditChan is an AuditSink sending records to a channel. Sending blocks
+// the handler until the record is received, unless the channel is buffered.
+type AuditChan chan<- AuditRecord
+
+func (c AuditChan) Audit(rec AuditRecord) error {
+	c <- rec
+	return nil
+}
+
+// AuditFile is an AuditSink appending the LDIF of the records to a file,
+// created with mode 0600 if needed.
+type AuditFile struct {
+	Path string
+	// MaxSize, if positive, is the size in bytes above which the file is
+	// rotated: it is renamed to Path.1, Path.1 to Path.2, and so on.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept. Older ones are
+	// removed. At least one is kept.
+	MaxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func (f *AuditFile) Audit(rec AuditRecord) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file != nil && f.MaxSize > 0 && f.size > 0 && f.size+int64(len(rec.LDIF)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		f.file, f.size = file, info.Size()
+	}
+	n, err := f.file.WriteString(rec.LDIF)
+	f.size += int64(n)
+	return err
+}
+
+// rotate closes the file and renames it and its backups.
+func (f *AuditFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	backups := max(f.MaxBackups, 1)
+	os.Remove(f.Path + "." + strconv.Itoa(backups))
+	for i := backups - 1; i > 0; i-- {
+		os.Rename(f.Path+"."+strconv.Itoa(i), f.Path+"."+strconv.Itoa(i+1))
+	}
+	return os.Rename(f.Path, f.Path+".1")
+}
+
+// Close closes the file. The next record reopens it.
+func (f *AuditFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// audit sends the write operation of m to the audit sink of the server
+// once its handler answered success.
+func (c *client) audit(m *Message, op *operation) {
+	sink := c.srv.Audit
+	if sink == nil {
+		return
+	}
+	if code, ok := op.result(); !ok || code != LDAPResultSuccess {
+		return
+	}
+	rec := AuditRecord{
+		Time:         time.Now(),
+		ConnectionID: c.Numero,
+		AuthzID:      c.AuthzID(),
+		Op:           OperationName(m.ProtocolOp()),
+	}
+	if conn := c.conn(); conn != nil {
+		rec.RemoteAddr = conn.RemoteAddr().String()
+	}
+
+	var b strings.Builder
+	switch r := m.ProtocolOp().(type) {
+	case ldap.AddRequest:
+		rec.DN = string(r.Entry())
+		writeLDIF(&b, "dn", rec.DN)
+		b.WriteString("changetype: add\n")
+		for _, a := range r.Attributes() {
+			for _, v := range a.Vals() {
+				writeLDIF(&b, string(a.Type_()), string(v))
+			}
+		}
+	case ldap.ModifyRequest:
+		rec.DN = string(r.Object())
+		writeLDIF(&b, "dn", rec.DN)
+		b.WriteString("changetype: modify\n")
+		for _, change := range r.Changes() {
+			mod := change.Modification()
+			var operation string
+			switch int(change.Operation()) {
+			case ModifyRequestChangeOperationAdd:
+				operation = "add"
+			case ModifyRequestChangeOperationDelete:
+				operation = "delete"
+			case ModifyRequestChangeOperationReplace:
+				operation = "replace"
+			default:
+				operation = "increment"
+			}
+			writeLDIF(&b, operation, string(mod.Type_()))
+			for _, v := range mod.Vals() {
+				writeLDIF(&b, string(mod.Type_()), string(v))
+			}
+			b.WriteString("-\n")
+		}
+	case ldap.DelRequest:
+		rec.DN = string(r)
+		writeLDIF(&b, "dn", rec.DN)
+		b.WriteString("changetype: delete\n")
+	case ldap.ModifyDNRequest:
+		req, err := parseModifyDNRequest(r)
+		if err != nil {
+			return
+		}
+		rec.DN = req.entry
+		writeLDIF(&b, "dn", rec.DN)
+		b.WriteString("changetype: modrdn\n")
+		writeLDIF(&b, "newrdn", req.newRDN)
+		if req.deleteOldRDN {
+			b.WriteString("deleteoldrdn: 1\n")
+		} else {
+			b.WriteString("deleteoldrdn: 0\n")
+		}
+		if req.hasNewSuperior {
+			writeLDIF(&b, "newsuperior", req.newSuperior)
+		}
+	default:
+		return
+	}
+
+	var header strings.Builder
+	fmt.Fprintf(&header, "# time: %s\n# conn: %d\n# client: %s\n",
+		rec.Time.UTC().Format("20060102150405Z"), rec.ConnectionID, rec.RemoteAddr)
+	// The identity comes from the client, so it is encoded like the values.
+	writeLDIF(&header, "# authzid", rec.AuthzID)
+	rec.LDIF = header.String() + b.String() + "\n"
+	if err := sink.Audit(rec); err != nil {
+		c.log.Error("audit failed", "msgid", m.MessageID().Int(), "error", err)
+	}
+}
+
+// writeLDIF writes an LDIF attribute line, base64-encoding values that are
+// not safe strings (RFC 2849).
+func writeLDIF(b *strings.Builder, attr, value string) {
+	if ldifSafe(value) {
+		b.WriteString(attr + ": " + value + "\n")
+		return
+	}
+	b.WriteString(attr + ":: " + base64.StdEncoding.EncodeToString([]byte(value)) + "\n")
+}
+
+func ldifSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if value[0] == ' ' || value[0] == ':' || value[0] == '<' || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == 0 || c == '\n' || c == '\r' || c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package ldapserver
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func TestE2E_Audit(t *testing.T) {
+	records := make(chan AuditRecord, 10)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	server.Audit = AuditChan(records)
+	routes := NewRouteMux()
+	routes.Bind(handleBindTest)
+	routes.Add(handleAddTest)
+	routes.Modify(func(w ResponseWriter, m *Message) {
+		if r := m.GetModifyRequest(); r.Object() == "uid=readonly,dc=example" {
+			w.Write(NewModifyResponse(LDAPResultInsufficientAccessRights))
+			return
+		}
+		w.Write(NewModifyResponse(LDAPResultSuccess))
+	})
+	routes.Delete(handleDeleteTest)
+	routes.ModifyDN(func(w ResponseWriter, m *Message) {
+		w.Write(NewModifyDNResponse(LDAPResultSuccess))
+	})
+	server.Handle(routes)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	conn := dialAndBind(t, ln.Addr().String())
+	defer conn.Close()
+	add := goldap.NewAddRequest("uid=alice,dc=example", nil)
+	add.Attribute("objectClass", []string{"person"})
+	add.Attribute("description", []string{" starts with a space"})
+	if err := conn.Add(add); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	modify := goldap.NewModifyRequest("uid=readonly,dc=example", nil)
+	modify.Replace("mail", []string{"readonly@example.com"})
+	if err := conn.Modify(modify); err == nil {
+		t.Fatalf("modify of a read-only entry succeeded")
+	}
+	modify = goldap.NewModifyRequest("uid=alice,dc=example", nil)
+	modify.Replace("mail", []string{"alice@example.com"})
+	modify.Delete("description", nil)
+	if err := conn.Modify(modify); err != nil {
+		t.Fatalf("modify: %v", err)
+	}
+	if err := conn.ModifyDN(goldap.NewModifyDNRequest("uid=alice,dc=example", "uid=alicia", true, "ou=people,dc=example")); err != nil {
+		t.Fatalf("modify DN: %v", err)
+	}
+	if err := conn.Del(goldap.NewDelRequest("uid=alicia,ou=people,dc=example", nil)); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	want := []struct {
+		op, dn, ldif string
+	}{
+		{"add", "uid=alice,dc=example", "dn: uid=alice,dc=example\nchangetype: add\nobjectClass: person\ndescription:: IHN0YXJ0cyB3aXRoIGEgc3BhY2U=\n\n"},
+		{"modify", "uid=alice,dc=example", "dn: uid=alice,dc=example\nchangetype: modify\nreplace: mail\nmail: alice@example.com\n-\ndelete: description\n-\n\n"},
+		{"modifydn", "uid=alice,dc=example", "dn: uid=alice,dc=example\nchangetype: modrdn\nnewrdn: uid=alicia\ndeleteoldrdn: 1\nnewsuperior: ou=people,dc=example\n\n"},
+		{"delete", "uid=alicia,ou=people,dc=example", "dn: uid=alicia,ou=people,dc=example\nchangetype: delete\n\n"},
+	}
+	for _, w := range want {
+		rec := <-records
+		if rec.Op != w.op || rec.DN != w.dn || rec.AuthzID != "dn:cn=test" || rec.ConnectionID == 0 ||
+			!strings.HasPrefix(rec.RemoteAddr, "127.0.0.1:") || rec.Time.IsZero() {
+			t.Errorf("unexpected record %+v", rec)
+		}
+		if !strings.HasSuffix(rec.LDIF, w.ldif) || !strings.Contains(rec.LDIF, "# authzid: dn:cn=test\n") {
+			t.Errorf("unexpected LDIF for %s:\n%s", w.op, rec.LDIF)
+		}
+	}
+	select {
+	case rec := <-records:
+		t.Errorf("unexpected record %+v", rec)
+	default:
+	}
+}
+
+func TestE2E_AuditUnsafeAuthzID(t *testing.T) {
+	records := make(chan AuditRecord, 1)
+	routes := NewRouteMux()
+	routes.Bind(func(w ResponseWriter, m *Message) {
+		w.Write(NewBindResponse(LDAPResultSuccess))
+	})
+	routes.Delete(handleDeleteTest)
+	addr, _ := serveTest(t, nil, routes, func(s *Server) {
+		s.Audit = AuditChan(records)
+	})
+
+	conn, err := goldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	dn := "cn=x\ndn: uid=forged,dc=example\nchangetype: delete"
+	if err := conn.Bind(dn, "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if err := conn.Del(goldap.NewDelRequest("uid=alice,dc=example", nil)); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	rec := <-records
+	want := "# authzid:: " + base64.StdEncoding.EncodeToString([]byte("dn:"+dn)) + "\n"
+	if !strings.Contains(rec.LDIF, want) || strings.Contains(rec.LDIF, "forged") {
+		t.Fatalf("unexpected LDIF:\n%s", rec.LDIF)
+	}
+}
+
+func TestAuditFile_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ldif")
+	f := &AuditFile{Path: path, MaxSize: 100, MaxBackups: 2}
+	defer f.Close()
+	record := AuditRecord{LDIF: "dn: uid=alice,dc=example\nchangetype: delete\n\n"} // 46 bytes
+	for i := 0; i < 7; i++ {
+		if err := f.Audit(record); err != nil {
+			t.Fatalf("audit: %v", err)
+		}
+	}
+	for name, records := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2, path + ".3": 0} {
+		data, err := os.ReadFile(name)
+		if records == 0 {
+			if err == nil {
+				t.Errorf("%s should have been removed", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if n := strings.Count(string(data), "changetype:"); n != records {
+			t.Errorf("%s has %d records, want %d", name, n, records)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package ldapserver
+
+import (
+	"fmt"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// goldap decodes every LDAP protocol operation but only exposes setters for
+// some of their fields (there is no way to set the responseValue of an
+// ExtendedResponse for instance). The helpers below work around this by
+// encoding an operation, editing its BER representation with go-asn1-ber,
+// and decoding the result back with goldap.
+
+// encodeProtocolOp returns the BER representation of po.
+func encodeProtocolOp(po ldap.ProtocolOp) (*ber.Packet, error) {
+	data, err := ldap.NewLDAPMessageWithProtocolOp(po).Write()
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := ber.DecodePacketErr(data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Children) < 2 {
+		return nil, fmt.Errorf("malformed LDAP message")
+	}
+	return envelope.Children[1], nil
+}
+
+// decodeProtocolOp decodes the BER representation of a protocol operation.
+func decodeProtocolOp(p *ber.Packet) (ldap.ProtocolOp, error) {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "messageID"))
+	envelope.AppendChild(p)
+	m, err := decodeMessage(envelope.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return m.ProtocolOp(), nil
+}
+
+// withOctetString returns a copy of po with an OCTET STRING tagged
+// [CONTEXT tag] appended to it.
+func withOctetString(po ldap.ProtocolOp, tag ber.Tag, value []byte) (ldap.ProtocolOp, error) {
+	p, err := encodeProtocolOp(po)
+	if err != nil {
+		return nil, err
+	}
+	p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, tag, string(value), ""))
+	return decodeProtocolOp(p)
+}
+
+// responseResultCode returns the result code of a response carrying an
+// LDAPResult. ok is false for any other protocol operation.
+func responseResultCode(po ldap.ProtocolOp) (code int, ok bool) {
+	_, code, ok = responseResult(po)
+	return code, ok
+}
+
+// responseResult returns the application tag and the result code of a
+// response carrying an LDAPResult. ok is false for any other protocol
+// operation.
+func responseResult(po ldap.ProtocolOp) (tag ber.Tag, code int, ok bool) {
+	switch po.(type) {
+	case ldap.LDAPResult, ldap.BindResponse, ldap.SearchResultDone, ldap.ModifyResponse,
+		ldap.AddResponse, ldap.DelResponse, ldap.ModifyDNResponse, ldap.CompareResponse,
+		ldap.ExtendedResponse:
+	default:
+		return 0, 0, false
+	}
+	p, err := encodeProtocolOp(po)
+	if err != nil || len(p.Children) == 0 {
+		return 0, 0, false
+	}
+	v, isInt := p.Children[0].Value.(int64)
+	return p.Tag, int(v), isInt
+}
+
+// modifyDNRequest holds the fields of a ModifyDNRequest, for which goldap
+// has no accessors:
+//
+//	ModifyDNRequest ::= [APPLICATION 12] SEQUENCE {
+//	     entry           LDAPDN,
+//	     newrdn          RelativeLDAPDN,
+//	     deleteoldrdn    BOOLEAN,
+//	     newSuperior     [0] LDAPDN OPTIONAL }
+type modifyDNRequest struct {
+	entry          string
+	newRDN         string
+	deleteOldRDN   bool
+	newSuperior    string
+	hasNewSuperior bool
+}
+
+func parseModifyDNRequest(r ldap.ModifyDNRequest) (modifyDNRequest, error) {
+	p, err := encodeProtocolOp(r)
+	if err != nil {
+		return modifyDNRequest{}, err
+	}
+	if len(p.Children) < 3 {
+		return modifyDNRequest{}, fmt.Errorf("malformed ModifyDNRequest")
+	}
+	req := modifyDNRequest{
+		entry:  p.Children[0].Data.String(),
+		newRDN: p.Children[1].Data.String(),
+	}
+	req.deleteOldRDN, _ = p.Children[2].Value.(bool)
+	if len(p.Children) > 3 {
+		req.newSuperior = p.Children[3].Data.String()
+		req.hasNewSuperior = true
+	}
+	return req, nil
+}
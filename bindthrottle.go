@@ -0,0 +1,306 @@
+package ldapserver
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// bindThrottleSweep is how often idle throttle states are forgotten.
+const bindThrottleSweep = time.Minute
+
+// RateLimit is a token bucket: Burst requests at once, refilled at Rate
+// requests per second. The zero value does not limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// BindThrottle is a Handler wrapper protecting the Bind requests of a
+// Handler against brute-force attacks:
+//
+//	throttle := &ldap.BindThrottle{
+//		Handler:          routes,
+//		IPLimit:          ldap.RateLimit{Rate: 1, Burst: 10},
+//		DNLimit:          ldap.RateLimit{Rate: 0.2, Burst: 5},
+//		FailureDelay:     100 * time.Millisecond,
+//		LockoutThreshold: 10,
+//		LockoutDuration:  15 * time.Minute,
+//		Allow:            []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+//	}
+//	server.Handle(throttle)
+//
+// Bind requests are counted by client IP address and by bind DN, anonymous
+// binds by address only. Beyond IPLimit or DNLimit, binds fail with Busy
+// (51) without reaching the Handler.
+//
+// A bind answered with InvalidCredentials (49) by the Handler is a failure.
+// After n consecutive failures of an address or a DN, its next binds are
+// delayed by FailureDelay, doubled for each further failure, up to
+// MaxFailureDelay. After LockoutThreshold consecutive failures, its binds
+// fail with LockoutResultCode for LockoutDuration. A successful bind resets
+// the failures of its address and DN, and they are forgotten FailureWindow
+// after the last one, so that the throttle only keeps the state of recent
+// clients.
+//
+// Clients whose address is in Allow are not throttled. Requests other than
+// binds are passed to the Handler as is. Configure a BindThrottle before
+// serving requests.
+type BindThrottle struct {
+	Handler Handler
+
+	IPLimit RateLimit // binds by client address
+	DNLimit RateLimit // binds by DN
+
+	FailureDelay    time.Duration // zero for no delay
+	MaxFailureDelay time.Duration // 10s if zero
+
+	LockoutThreshold  int // zero for no lockout
+	LockoutDuration   time.Duration
+	LockoutResultCode int // InvalidCredentials (49) if zero, not to reveal the lockout
+
+	FailureWindow time.Duration // 15 minutes if zero
+
+	Allow []netip.Prefix
+
+	mutex sync.Mutex
+	ips   map[string]*throttleState
+	dns   map[string]*throttleState
+	swept time.Time
+}
+
+// throttleState is the state of a client address or a DN.
+type throttleState struct {
+	tokens      float64
+	refilled    time.Time
+	failures    int
+	failed      time.Time // time of the last failure
+	lockedUntil time.Time
+}
+
+func (t *BindThrottle) ServeLDAP(w ResponseWriter, m *Message) {
+	r, ok := m.ProtocolOp().(ldap.BindRequest)
+	if !ok {
+		t.Handler.ServeLDAP(w, m)
+		return
+	}
+	ip, ok := t.clientKey(m.Client.Addr())
+	if !ok {
+		t.Handler.ServeLDAP(w, m)
+		return
+	}
+	dn := strings.Join(normalizeRDNs(splitDN(string(r.Name()))), ",")
+
+	code, diagnostic, delay := t.admit(ip, dn, time.Now())
+	if code != LDAPResultSuccess {
+		m.Client.log.Info("bind throttled", "msgid", m.MessageID().Int(), "dn", r.Name(), "result", code)
+		res := NewBindResponse(code)
+		res.SetDiagnosticMessage(diagnostic)
+		w.Write(res)
+		return
+	}
+	if delay > 0 {
+		m.Client.log.Debug("bind delayed", "msgid", m.MessageID().Int(), "dn", r.Name(), "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-m.Done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+
+	tw := &throttleWriter{w: w}
+	t.Handler.ServeLDAP(tw, m)
+	if tw.responded {
+		t.record(m, ip, dn, tw.code, time.Now())
+	}
+}
+
+// clientKey returns the throttle key of a client address. ok is false for
+// allowed clients.
+func (t *BindThrottle) clientKey(addr net.Addr) (key string, ok bool) {
+	tcp, isTCP := addr.(*net.TCPAddr)
+	if !isTCP {
+		return addr.String(), true
+	}
+	ip, _ := netip.AddrFromSlice(tcp.IP)
+	ip = ip.Unmap()
+	for _, prefix := range t.Allow {
+		if prefix.Contains(ip) {
+			return "", false
+		}
+	}
+	return ip.String(), true
+}
+
+// admit returns the result code of a bind of dn by the client ip refused by
+// the throttle, or Success and the delay before serving it.
+func (t *BindThrottle) admit(ip, dn string, now time.Time) (code int, diagnostic string, delay time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sweep(now)
+
+	states := []*throttleState{t.state(&t.ips, ip, t.IPLimit, now)}
+	limits := []RateLimit{t.IPLimit}
+	if dn != "" {
+		states = append(states, t.state(&t.dns, dn, t.DNLimit, now))
+		limits = append(limits, t.DNLimit)
+	}
+	for _, s := range states {
+		if now.Before(s.lockedUntil) {
+			code = t.LockoutResultCode
+			if code == 0 {
+				code = LDAPResultInvalidCredentials
+			}
+			return code, "too many failed bind attempts", 0
+		}
+	}
+	for i, s := range states {
+		if !s.take(limits[i], now) {
+			return LDAPResultBusy, "too many bind attempts", 0
+		}
+	}
+	for _, s := range states {
+		delay = max(delay, t.failureDelay(s.failures))
+	}
+	return LDAPResultSuccess, "", delay
+}
+
+// record updates the failures of ip and dn with the result of their bind.
+func (t *BindThrottle) record(m *Message, ip, dn string, code int, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	states := []*throttleState{t.state(&t.ips, ip, t.IPLimit, now)}
+	if dn != "" {
+		states = append(states, t.state(&t.dns, dn, t.DNLimit, now))
+	}
+	for _, s := range states {
+		switch code {
+		case LDAPResultSuccess:
+			s.failures = 0
+		case LDAPResultInvalidCredentials:
+			s.failures++
+			s.failed = now
+			if t.LockoutThreshold > 0 && s.failures >= t.LockoutThreshold {
+				s.failures = 0
+				s.lockedUntil = now.Add(t.LockoutDuration)
+				m.Client.log.Warn("bind lockout", "client", ip, "dn", dn, "until", s.lockedUntil)
+			}
+		}
+	}
+}
+
+// failureDelay returns the delay of a bind after n consecutive failures.
+func (t *BindThrottle) failureDelay(n int) time.Duration {
+	if n == 0 || t.FailureDelay <= 0 {
+		return 0
+	}
+	maxDelay := t.MaxFailureDelay
+	if maxDelay <= 0 {
+		maxDelay = 10 * time.Second
+	}
+	delay := t.FailureDelay
+	for i := 1; i < n && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// failureWindow returns how long failures are remembered.
+func (t *BindThrottle) failureWindow() time.Duration {
+	if t.FailureWindow <= 0 {
+		return 15 * time.Minute
+	}
+	return t.FailureWindow
+}
+
+// state returns the state of key in states, created with a full bucket.
+func (t *BindThrottle) state(states *map[string]*throttleState, key string, limit RateLimit, now time.Time) *throttleState {
+	if *states == nil {
+		*states = make(map[string]*throttleState)
+	}
+	s, ok := (*states)[key]
+	if !ok {
+		s = &throttleState{tokens: float64(limit.Burst), refilled: now}
+		(*states)[key] = s
+	}
+	s.expire(t.failureWindow(), now)
+	return s
+}
+
+// sweep forgets the states back to their initial state, once their
+// failures expired, at most once per bindThrottleSweep.
+func (t *BindThrottle) sweep(now time.Time) {
+	if now.Sub(t.swept) < bindThrottleSweep {
+		return
+	}
+	t.swept = now
+	t.sweepStates(t.ips, t.IPLimit, now)
+	t.sweepStates(t.dns, t.DNLimit, now)
+}
+
+func (t *BindThrottle) sweepStates(states map[string]*throttleState, limit RateLimit, now time.Time) {
+	window := t.failureWindow()
+	for key, s := range states {
+		if limit.Rate > 0 {
+			s.refill(limit, now)
+		}
+		s.expire(window, now)
+		if s.failures == 0 && !now.Before(s.lockedUntil) && (limit.Rate <= 0 || s.tokens >= float64(limit.Burst)) {
+			delete(states, key)
+		}
+	}
+}
+
+// expire forgets the failures when the last one is older than window.
+func (s *throttleState) expire(window time.Duration, now time.Time) {
+	if s.failures > 0 && now.Sub(s.failed) >= window {
+		s.failures = 0
+	}
+}
+
+// take takes a token from the bucket, reporting false if it is empty.
+func (s *throttleState) take(limit RateLimit, now time.Time) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	s.refill(limit, now)
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+func (s *throttleState) refill(limit RateLimit, now time.Time) {
+	s.tokens = min(float64(limit.Burst), s.tokens+now.Sub(s.refilled).Seconds()*limit.Rate)
+	s.refilled = now
+}
+
+// throttleWriter records the result code of the response of a bind.
+type throttleWriter struct {
+	w         ResponseWriter
+	code      int
+	responded bool
+}
+
+func (tw *throttleWriter) Write(po ldap.ProtocolOp) {
+	tw.observe(po)
+	tw.w.Write(po)
+}
+
+func (tw *throttleWriter) WriteWithControls(po ldap.ProtocolOp, controls ldap.Controls) {
+	tw.observe(po)
+	WriteWithControls(tw.w, po, controls...)
+}
+
+func (tw *throttleWriter) observe(po ldap.ProtocolOp) {
+	if _, ok := po.(ldap.BindResponse); ok {
+		tw.code, tw.responded = responseResultCode(po)
+	}
+}
@@ -0,0 +1,160 @@
+package ldapserver
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// startThrottledServer serves binds with the password "secret" through
+// throttle, and returns a function binding on a new connection.
+func startThrottledServer(t *testing.T, throttle *BindThrottle) func(dn, password string) error {
+	t.Helper()
+	routes := NewRouteMux()
+	routes.Bind(func(w ResponseWriter, m *Message) {
+		r := m.GetBindRequest()
+		if string(r.AuthenticationSimple()) != "secret" {
+			w.Write(NewBindResponse(LDAPResultInvalidCredentials))
+			return
+		}
+		w.Write(NewBindResponse(LDAPResultSuccess))
+	})
+	throttle.Handler = routes
+	addr, _ := serveTest(t, nil, throttle)
+	return func(dn, password string) error {
+		conn, err := goldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		return conn.Bind(dn, password)
+	}
+}
+
+func TestE2E_BindThrottleRateLimit(t *testing.T) {
+	throttle := &BindThrottle{
+		IPLimit: RateLimit{Rate: 1, Burst: 4},
+		DNLimit: RateLimit{Rate: 1, Burst: 2},
+	}
+	bind := startThrottledServer(t, throttle)
+	for i, tt := range []struct {
+		dn   string
+		code uint16
+	}{
+		{"cn=alice,dc=example", LDAPResultSuccess},
+		{"CN=Alice, DC=example", LDAPResultSuccess},
+		{"cn=alice,dc=example", LDAPResultBusy},
+		{"cn=bob,dc=example", LDAPResultSuccess},
+		{"cn=carol,dc=example", LDAPResultBusy},
+	} {
+		err := bind(tt.dn, "secret")
+		if (tt.code == LDAPResultSuccess) != (err == nil) || err != nil && !goldap.IsErrorWithCode(err, tt.code) {
+			t.Errorf("bind %d of %s: %v, expected result %d", i, tt.dn, err, tt.code)
+		}
+	}
+	// A second later, a token was refilled.
+	if code, _, _ := throttle.admit("127.0.0.1", "cn=alice,dc=example", time.Now().Add(time.Second)); code != LDAPResultSuccess {
+		t.Errorf("bind after the refill: result %d", code)
+	}
+}
+
+func TestE2E_BindThrottleFailureDelay(t *testing.T) {
+	bind := startThrottledServer(t, &BindThrottle{
+		FailureDelay:    100 * time.Millisecond,
+		MaxFailureDelay: 200 * time.Millisecond,
+	})
+	for i, expected := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 200 * time.Millisecond} {
+		start := time.Now()
+		if err := bind("cn=alice,dc=example", "wrong"); !goldap.IsErrorWithCode(err, LDAPResultInvalidCredentials) {
+			t.Fatalf("bind %d: %v", i, err)
+		}
+		if elapsed := time.Since(start); elapsed < expected || elapsed > expected+150*time.Millisecond {
+			t.Errorf("failed bind %d answered after %v, expected %v", i, elapsed, expected)
+		}
+	}
+	if err := bind("cn=alice,dc=example", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	start := time.Now()
+	if err := bind("cn=alice,dc=example", "secret"); err != nil || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("bind after a successful bind: %v after %v", err, time.Since(start))
+	}
+}
+
+func TestE2E_BindThrottleLockout(t *testing.T) {
+	throttle := &BindThrottle{
+		LockoutThreshold:  3,
+		LockoutDuration:   time.Minute,
+		LockoutResultCode: LDAPResultUnwillingToPerform,
+	}
+	bind := startThrottledServer(t, throttle)
+	for i := range 3 {
+		if err := bind("cn=alice,dc=example", "wrong"); !goldap.IsErrorWithCode(err, LDAPResultInvalidCredentials) {
+			t.Fatalf("bind %d: %v", i, err)
+		}
+	}
+	if err := bind("cn=alice,dc=example", "secret"); !goldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) {
+		t.Errorf("bind of a locked DN: %v", err)
+	}
+	// The client address is locked out too.
+	if err := bind("cn=bob,dc=example", "secret"); !goldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) {
+		t.Errorf("bind from a locked address: %v", err)
+	}
+	if code, _, _ := throttle.admit("127.0.0.1", "cn=alice,dc=example", time.Now().Add(time.Minute)); code != LDAPResultSuccess {
+		t.Errorf("bind after the lockout: result %d", code)
+	}
+}
+
+func TestE2E_BindThrottleAllow(t *testing.T) {
+	bind := startThrottledServer(t, &BindThrottle{
+		IPLimit:          RateLimit{Rate: 0.1, Burst: 1},
+		LockoutThreshold: 1,
+		LockoutDuration:  time.Minute,
+		Allow:            []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	})
+	for i := range 3 {
+		if err := bind("cn=alice,dc=example", "wrong"); !goldap.IsErrorWithCode(err, LDAPResultInvalidCredentials) {
+			t.Fatalf("bind %d: %v", i, err)
+		}
+	}
+	if err := bind("cn=alice,dc=example", "secret"); err != nil {
+		t.Errorf("bind: %v", err)
+	}
+}
+
+func TestBindThrottleForgetsIdleStates(t *testing.T) {
+	throttle := &BindThrottle{
+		DNLimit:       RateLimit{Rate: 1, Burst: 2},
+		FailureDelay:  time.Second,
+		FailureWindow: 5 * time.Minute,
+	}
+	now := time.Now()
+	for i := range 100 {
+		dn := fmt.Sprintf("cn=user%d,dc=example", i)
+		if code, _, _ := throttle.admit("192.0.2.1", dn, now); code != LDAPResultSuccess {
+			t.Fatalf("bind %d: result %d", i, code)
+		}
+		throttle.record(nil, "192.0.2.1", dn, LDAPResultInvalidCredentials, now)
+	}
+	if len(throttle.dns) != 100 {
+		t.Fatalf("%d DN states, expected 100", len(throttle.dns))
+	}
+
+	// Failures are remembered within the window.
+	throttle.admit("192.0.2.2", "", now.Add(4*time.Minute))
+	if len(throttle.dns) != 100 {
+		t.Fatalf("%d DN states within the failure window, expected 100", len(throttle.dns))
+	}
+	_, _, delay := throttle.admit("192.0.2.1", "cn=user0,dc=example", now.Add(4*time.Minute))
+	if delay == 0 {
+		t.Error("expected a delay within the failure window")
+	}
+
+	throttle.admit("192.0.2.2", "", now.Add(10*time.Minute))
+	if len(throttle.dns) != 0 || len(throttle.ips) != 1 {
+		t.Errorf("%d DN and %d address states after the failure window, expected 0 and 1", len(throttle.dns), len(throttle.ips))
+	}
+}
@@ -0,0 +1,164 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// CertificateManager serves a certificate loaded from PEM files, reloaded
+// when the files change or the process receives SIGHUP, so certificates
+// can be rotated without restarting the server. A certificate that cannot
+// be loaded is logged and the previous one is kept.
+//
+//	certs, err := ldap.NewCertificateManager("/etc/ldap/tls.crt", "/etc/ldap/tls.key")
+//	stop := certs.Watch(time.Minute)
+//	defer stop()
+//	server.TLSConfig = certs.TLSConfig()
+//	routes.Extended(ldap.NewStartTLSHandler(nil)).RequestName(ldap.NoticeOfStartTLS)
+type CertificateManager struct {
+	CertFile, KeyFile string
+
+	// Log receives the reloads and their errors. When nil, logs go to the
+	// deprecated package Logger.
+	Log    *slog.Logger
+	legacy atomic.Pointer[slog.Logger] // package Logger, captured once
+
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time // of the files last loaded or tried
+}
+
+// NewCertificateManager returns a manager of the certificate and key in
+// the PEM files certFile and keyFile, or an error if they cannot be
+// loaded.
+func NewCertificateManager(certFile, keyFile string) (*CertificateManager, error) {
+	m := &CertificateManager{CertFile: certFile, KeyFile: keyFile}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Certificate returns the certificate being served.
+func (m *CertificateManager) Certificate() *tls.Certificate {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.cert
+}
+
+// GetCertificate returns the certificate being served, for
+// tls.Config.GetCertificate.
+func (m *CertificateManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := m.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return nil, errors.New("ldap: no certificate loaded")
+}
+
+// TLSConfig returns a TLS configuration serving the certificate of m.
+// Set GetCertificate on an existing configuration to keep its other
+// settings.
+func (m *CertificateManager) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: m.GetCertificate}
+}
+
+// Reload loads the certificate files. If they are invalid, the error is
+// logged and returned, and the previous certificate is kept.
+func (m *CertificateManager) Reload() error {
+	modTimes := m.fileModTimes()
+	cert, err := loadCertificate(m.CertFile, m.KeyFile)
+
+	m.mutex.Lock()
+	m.modTimes = modTimes
+	if err == nil {
+		m.cert = cert
+	}
+	m.mutex.Unlock()
+
+	if err != nil {
+		m.log().Error("certificate reload failed", "cert", m.CertFile, "key", m.KeyFile, "error", err)
+		return err
+	}
+	m.log().Info("certificate loaded", "cert", m.CertFile, "subject", cert.Leaf.Subject.String(),
+		"not_after", cert.Leaf.NotAfter)
+	return nil
+}
+
+// Watch reloads the certificate when its files change, checked every
+// interval, and when the process receives SIGHUP, until stop is called.
+func (m *CertificateManager) Watch(interval time.Duration) (stop func()) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if m.changed() {
+					m.Reload()
+				}
+			case <-hangup:
+				m.Reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(hangup)
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// changed reports whether the files were modified since they were last
+// loaded or tried.
+func (m *CertificateManager) changed() bool {
+	modTimes := m.fileModTimes()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return modTimes != m.modTimes
+}
+
+func (m *CertificateManager) fileModTimes() (modTimes [2]time.Time) {
+	for i, name := range []string{m.CertFile, m.KeyFile} {
+		if info, err := os.Stat(name); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (m *CertificateManager) log() *slog.Logger {
+	if m.Log != nil {
+		return m.Log
+	}
+	return legacyLog(&m.legacy)
+}
+
+// loadCertificate loads and validates a certificate and its key: they
+// must match, and the certificate must be valid now.
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate %s is valid from %s to %s", certFile,
+			cert.Leaf.NotBefore.Format(time.RFC3339), cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &cert, nil
+}
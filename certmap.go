@@ -0,0 +1,119 @@
+package ldapserver
+
+import (
+	"crypto/x509"
+	"regexp"
+)
+
+// CertificateField selects the values of a client certificate a
+// CertificateMapRule applies to.
+type CertificateField int
+
+const (
+	// CertificateSubject is the subject DN, in RFC 4514 form.
+	CertificateSubject CertificateField = iota
+	// CertificateEmail are the rfc822Name subject alternative names.
+	CertificateEmail
+	// CertificateURI are the uniformResourceIdentifier subject
+	// alternative names.
+	CertificateURI
+)
+
+// CertificateMapRule maps one field of a client certificate to an
+// authorization identity.
+type CertificateMapRule struct {
+	Field CertificateField
+	// Match, if non-nil, selects the values the rule applies to. When nil,
+	// the rule applies to any value.
+	Match *regexp.Regexp
+	// AuthzID is the authzId template, expanded with the submatches of
+	// Match as with regexp.Expand: "$0" is the whole value, "$1" or
+	// "${name}" a submatch. When empty, "dn:$0" is used for the subject
+	// and "u:$0" for alternative names.
+	AuthzID string
+}
+
+var anyCertificateValue = regexp.MustCompile(`(?s)^.*$`)
+
+func (r CertificateMapRule) apply(value string) (string, bool) {
+	re := r.Match
+	if re == nil {
+		re = anyCertificateValue
+	}
+	match := re.FindStringSubmatchIndex(value)
+	if match == nil {
+		return "", false
+	}
+	template := r.AuthzID
+	if template == "" {
+		template = "u:$0"
+		if r.Field == CertificateSubject {
+			template = "dn:$0"
+		}
+	}
+	return string(re.ExpandString(nil, template, value, match)), true
+}
+
+// CertificateMapper maps verified TLS client certificates to authorization
+// identities. Rules are tried in order and the first one matching a value
+// of the certificate gives the identity. A mapper without rules maps a
+// certificate to "dn:" followed by its subject.
+//
+//	mapper := &ldap.CertificateMapper{Rules: []ldap.CertificateMapRule{{
+//		Field:   ldap.CertificateEmail,
+//		Match:   regexp.MustCompile(`^([^@]+)@example\.com$`),
+//		AuthzID: "dn:uid=$1,ou=people,dc=example,dc=com",
+//	}}}
+type CertificateMapper struct {
+	Rules []CertificateMapRule
+}
+
+// Map returns the authorization identity of cert. ok is false when no rule
+// matches.
+func (cm *CertificateMapper) Map(cert *x509.Certificate) (authzID string, ok bool) {
+	if len(cm.Rules) == 0 {
+		return "dn:" + cert.Subject.String(), true
+	}
+	for _, rule := range cm.Rules {
+		var values []string
+		switch rule.Field {
+		case CertificateSubject:
+			values = []string{cert.Subject.String()}
+		case CertificateEmail:
+			values = cert.EmailAddresses
+		case CertificateURI:
+			for _, u := range cert.URIs {
+				values = append(values, u.String())
+			}
+		}
+		for _, v := range values {
+			if id, ok := rule.apply(v); ok {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Identify returns the authorization identity of the verified client
+// certificate of the connection m was received on. It can be used as
+// ExternalMechanism.Identify.
+func (cm *CertificateMapper) Identify(m *Message) (string, error) {
+	chains := m.Client.VerifiedChains()
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", NewResultError(LDAPResultInappropriateAuthentication, "no verified client certificate")
+	}
+	id, ok := cm.Map(chains[0][0])
+	if !ok {
+		return "", NewResultError(LDAPResultInvalidCredentials, "client certificate is not mapped to an identity")
+	}
+	return id, nil
+}
+
+// certificateMapper returns the CertificateMapper of s, or the default one.
+func (s *Server) certificateMapper() *CertificateMapper {
+	if s.CertificateMapper != nil {
+		return s.CertificateMapper
+	}
+	return &CertificateMapper{}
+}
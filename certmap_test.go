@@ -0,0 +1,206 @@
+package ldapserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// testCertificate creates a certificate from template, signed by parent
+// (self-signed when parent is nil).
+func testCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("serial: %v", err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerCert := any(key), template
+	if parent != nil {
+		signer, signerCert = parent.PrivateKey, parent.Leaf
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testPKI returns a CA, a server certificate for 127.0.0.1 and a client
+// certificate for alice, both signed by the CA.
+func testPKI(t *testing.T) (ca, server, client tls.Certificate) {
+	t.Helper()
+	ca = testCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server = testCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	uri, _ := url.Parse("spiffe://example.com/alice")
+	client = testCertificate(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice", Organization: []string{"Example"}},
+		EmailAddresses: []string{"alice@example.com"},
+		URIs:           []*url.URL{uri},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	return ca, server, client
+}
+
+func TestCertificateMapper_Map(t *testing.T) {
+	_, _, client := testPKI(t)
+
+	tests := []struct {
+		name   string
+		rules  []CertificateMapRule
+		want   string
+		wantOK bool
+	}{
+		{"default", nil, "dn:CN=alice,O=Example", true},
+		{"subject", []CertificateMapRule{{
+			Field:   CertificateSubject,
+			Match:   regexp.MustCompile(`^CN=([^,]+),O=Example$`),
+			AuthzID: "dn:uid=$1,ou=people,dc=example",
+		}}, "dn:uid=alice,ou=people,dc=example", true},
+		{"email", []CertificateMapRule{{
+			Field:   CertificateEmail,
+			Match:   regexp.MustCompile(`^(?P<user>[^@]+)@example\.com$`),
+			AuthzID: "dn:uid=${user},ou=people,dc=example",
+		}}, "dn:uid=alice,ou=people,dc=example", true},
+		{"uri default template", []CertificateMapRule{{
+			Field: CertificateURI,
+		}}, "u:spiffe://example.com/alice", true},
+		{"first matching rule", []CertificateMapRule{
+			{Field: CertificateEmail, Match: regexp.MustCompile(`@other\.com$`), AuthzID: "u:other"},
+			{Field: CertificateSubject, AuthzID: "u:subject"},
+		}, "u:subject", true},
+		{"no match", []CertificateMapRule{{
+			Field: CertificateEmail,
+			Match: regexp.MustCompile(`@other\.com$`),
+		}}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper := &CertificateMapper{Rules: tt.rules}
+			got, ok := mapper.Map(client.Leaf)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("expected %q %v, got %q %v", tt.want, tt.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+// startTLSClientAuthServer starts an LDAPS server requiring client
+// certificates signed by ca, and returns its address.
+func startTLSClientAuthServer(t *testing.T, ca, cert tls.Certificate, configure func(*Server)) string {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	routes := NewRouteMux()
+	routes.Bind(NewSASLServer(NewExternalMechanism()).ServeLDAP).AuthenticationChoice("sasl")
+	routes.Bind(handleBindTest)
+	addr, _ := serveTest(t, nil, routes, func(s *Server) {
+		s.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}
+	}, configure)
+	return addr
+}
+
+func dialTLSClientCert(t *testing.T, addr string, ca, client tls.Certificate) *goldap.Conn {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	conn, err := goldap.DialURL("ldaps://"+addr, goldap.DialWithTLSConfig(&tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{client},
+	}))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+func TestE2E_TLSImplicitAuthentication(t *testing.T) {
+	ca, serverCert, clientCert := testPKI(t)
+	addr := startTLSClientAuthServer(t, ca, serverCert, func(s *Server) {
+		s.ImplicitTLSAuth = true
+	})
+
+	conn := dialTLSClientCert(t, addr, ca, clientCert)
+	defer conn.Close()
+
+	res, err := conn.WhoAmI(nil)
+	if err != nil {
+		t.Fatalf("whoami: %v", err)
+	}
+	if res.AuthzID != "dn:CN=alice,O=Example" {
+		t.Fatalf("expected authzId dn:CN=alice,O=Example, got %q", res.AuthzID)
+	}
+
+	// A Bind request replaces the implicit identity.
+	if err := conn.Bind("cn=test", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if res, err = conn.WhoAmI(nil); err != nil || res.AuthzID != "dn:cn=test" {
+		t.Fatalf("expected authzId dn:cn=test, got %v %v", res, err)
+	}
+}
+
+func TestE2E_TLSExternalBindWithMapper(t *testing.T) {
+	ca, serverCert, clientCert := testPKI(t)
+	addr := startTLSClientAuthServer(t, ca, serverCert, func(s *Server) {
+		s.CertificateMapper = &CertificateMapper{Rules: []CertificateMapRule{{
+			Field:   CertificateEmail,
+			Match:   regexp.MustCompile(`^([^@]+)@example\.com$`),
+			AuthzID: "dn:uid=$1,ou=people,dc=example",
+		}}}
+	})
+
+	conn := dialTLSClientCert(t, addr, ca, clientCert)
+	defer conn.Close()
+
+	res, err := conn.WhoAmI(nil)
+	if err != nil {
+		t.Fatalf("whoami: %v", err)
+	}
+	if res.AuthzID != "" {
+		t.Fatalf("expected anonymous connection without ImplicitTLSAuth, got %q", res.AuthzID)
+	}
+
+	if err := conn.ExternalBind(); err != nil {
+		t.Fatalf("external bind: %v", err)
+	}
+	if res, err = conn.WhoAmI(nil); err != nil || res.AuthzID != "dn:uid=alice,ou=people,dc=example" {
+		t.Fatalf("expected authzId dn:uid=alice,ou=people,dc=example, got %v %v", res, err)
+	}
+}
@@ -2,11 +2,21 @@ package ldapserver
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ldap "github.com/vjeantet/goldap/message"
+
+	"github.com/vjeantet/ldapserver/internal/controls"
 )
 
 type client struct {
@@ -26,9 +36,42 @@ type client struct {
 	data          any
 	handler       Handler
 	hasOwnHandler bool
+	authzID       string
+	sasl          *saslExchange
+	tlsChecked    bool    // the TLS session of rwc was logged and authenticated
+	tlsMode       TLSMode // TLS policy of the listener
+	log           *slog.Logger
+	operations    int // number of requests received
+	closeHooks    []func()
+
+	disconnecting chan ldap.ExtendedResponse // Notice of Disconnection to send
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+	inProgress    int  // number of requests in progress
+	writeFailed   bool // a response could not be written
+
+	start         time.Time // time the connection was accepted
+	bytesReceived atomic.Int64
+	bytesSent     atomic.Int64
+}
+
+// onClose registers f to be called when the connection closes, once its
+// requests are done.
+func (c *client) onClose(f func()) {
+	c.mutex.Lock()
+	c.closeHooks = append(c.closeHooks, f)
+	c.mutex.Unlock()
 }
 
 func (c *client) GetConn() net.Conn {
+	return c.conn()
+}
+
+// conn returns the connection. It is safe to call from any goroutine while
+// StartTLS replaces the connection with SetConn.
+func (c *client) conn() net.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.rwc
 }
 
@@ -48,7 +91,108 @@ func (c *client) SetData(data any) {
 	c.data = data
 }
 
+// AuthzID returns the authorization identity of the connection, in the
+// RFC 4513 authzId form: "dn:<distinguished name>" or "u:<user name>".
+// It is empty while the connection is anonymous.
+//
+// A successful simple bind sets it to "dn:" followed by the bind name and
+// any other bind resets it to anonymous until a handler calls SetAuthzID.
+func (c *client) AuthzID() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.authzID
+}
+
+// SetAuthzID sets the authorization identity of the connection. Handlers
+// serving SASL binds, or any other kind of authentication, call it once
+// the client is authenticated.
+func (c *client) SetAuthzID(id string) {
+	c.mutex.Lock()
+	c.authzID = id
+	c.mutex.Unlock()
+}
+
+// BindDN returns the distinguished name the connection is bound as, or an
+// empty string when it is anonymous or its identity is not a DN.
+func (c *client) BindDN() string {
+	if id := c.AuthzID(); strings.HasPrefix(id, "dn:") {
+		return id[len("dn:"):]
+	}
+	return ""
+}
+
+// bindResponded updates the authorization identity of the connection once
+// a handler answers the BindRequest r with res.
+func (c *client) bindResponded(r ldap.BindRequest, res ldap.BindResponse) {
+	code, _ := responseResultCode(res)
+	if code == LDAPResultSuccess && r.AuthenticationChoice() == "simple" && len(r.Name()) > 0 {
+		c.SetAuthzID("dn:" + string(r.Name()))
+	}
+}
+
+// saslExchange returns the SASL exchange in progress on the connection.
+func (c *client) saslExchange() *saslExchange {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.sasl
+}
+
+func (c *client) setSASLExchange(ex *saslExchange) {
+	c.mutex.Lock()
+	c.sasl = ex
+	c.mutex.Unlock()
+}
+
+// TLSConnectionState returns the state of the TLS connection, once the
+// handshake is complete. ok is false for connections not using TLS.
+func (c *client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	conn, isTLS := c.conn().(*tls.Conn)
+	if !isTLS {
+		return tls.ConnectionState{}, false
+	}
+	state = conn.ConnectionState()
+	return state, state.HandshakeComplete
+}
+
+// VerifiedChains returns the certificate chains verified for the TLS
+// client certificate of the connection, the first element of each being
+// the client certificate. It is nil when the client did not present a
+// certificate or the connection does not use TLS.
+func (c *client) VerifiedChains() [][]*x509.Certificate {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.VerifiedChains
+}
+
+// tlsEstablished logs the TLS session of the connection and applies
+// implicit TLS authentication once the handshake is complete.
+func (c *client) tlsEstablished() {
+	if c.tlsChecked {
+		return
+	}
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return
+	}
+	c.tlsChecked = true
+	c.log.Info("tls established", "version", tls.VersionName(state.Version),
+		"cipher", tls.CipherSuiteName(state.CipherSuite))
+	c.accessLogTLS(state)
+
+	if !c.srv.ImplicitTLSAuth || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return
+	}
+	if id, ok := c.srv.certificateMapper().Map(state.VerifiedChains[0][0]); ok {
+		c.SetAuthzID(id)
+	}
+}
+
 func (c *client) SetConn(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tlsChecked = false
 	c.rwc = conn
 	c.br = bufio.NewReader(c.rwc)
 	c.bw = bufio.NewWriter(c.rwc)
@@ -65,7 +209,7 @@ func (c *client) GetMessageByID(messageID int) (*Message, bool) {
 }
 
 func (c *client) Addr() net.Addr {
-	return c.rwc.RemoteAddr()
+	return c.conn().RemoteAddr()
 }
 
 func (c *client) ReadPacket() (*messagePacket, error) {
@@ -76,6 +220,15 @@ func (c *client) ReadPacket() (*messagePacket, error) {
 }
 
 func (c *client) serve() {
+	if err := c.readProxyHeader(); err != nil {
+		c.log.Warn("invalid PROXY protocol header", "remote", proxiedConn(c.rwc).Conn.RemoteAddr().String(), "error", err)
+		c.rwc.Close()
+		c.srv.metrics().ConnectionClosed()
+		c.srv.wg.Done()
+		return
+	}
+	c.srv.addClient(c)
+	c.opened()
 	defer c.close()
 
 	c.closing = make(chan bool)
@@ -94,72 +247,80 @@ func (c *client) serve() {
 		close(c.writeDone)
 	}()
 
-	// Listen for server signal to shutdown
+	// Listen for server signal to shutdown, or for a disconnection
 	go func() {
 		defer close(c.shutdownDone)
-		for {
-			select {
-			case <-c.srv.chDone: // server signals shutdown process
-				r := NewExtendedResponse(LDAPResultUnwillingToPerform)
-				r.SetDiagnosticMessage("server is about to stop")
-				r.SetResponseName(NoticeOfDisconnection)
-
-				m := ldap.NewLDAPMessageWithProtocolOp(r)
-
-				c.chanOut <- m
-				c.rwc.SetReadDeadline(time.Now().Add(time.Millisecond))
-				return
-			case <-c.closing:
-				return
-			}
+		var notice ldap.ExtendedResponse
+		select {
+		case <-c.srv.chDone: // server signals shutdown process
+			notice = newNoticeOfDisconnection(LDAPResultUnwillingToPerform, "server is about to stop")
+		case notice = <-c.disconnecting:
+		case <-c.closing:
+			return
 		}
+		c.chanOut <- ldap.NewLDAPMessageWithProtocolOp(notice)
+		c.rwc.SetReadDeadline(time.Now().Add(time.Millisecond))
 	}()
 
 	if onc := c.srv.OnNewConnection; onc != nil {
 		if err := onc(c.rwc); err != nil {
-			Logger.Printf("Erreur OnNewConnection: %s", err)
+			c.log.Info("connection rejected", "error", err)
+			c.srv.metrics().ConnectionRejected()
+			code, diagnostic := resultFromError(err, LDAPResultOther, "connection rejected")
+			c.chanOut <- ldap.NewLDAPMessageWithProtocolOp(newNoticeOfDisconnection(code, diagnostic))
 			return
 		}
 	}
 
 	c.requestList = make(map[int]*Message)
+	c.startTimers()
 
 	for {
 
 		if c.srv.ReadTimeout != 0 {
 			c.rwc.SetReadDeadline(time.Now().Add(c.srv.ReadTimeout))
 		}
-		if c.srv.WriteTimeout != 0 {
-			c.rwc.SetWriteDeadline(time.Now().Add(c.srv.WriteTimeout))
-		}
 
 		//Read client input as a ASN1/BER binary message
 		messagePacket, err := c.ReadPacket()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				Logger.Printf("Sorry client %d, i can not wait anymore (reading timeout) ! %s", c.Numero, err)
-			} else {
-				Logger.Printf("Error readMessagePacket: %s", err)
+				c.log.Info("read timeout", "error", err)
+			} else if !errors.Is(err, io.EOF) {
+				c.log.Warn("read error", "error", err)
 			}
 			return
 		}
 
+		c.bytesReceived.Add(int64(len(messagePacket.bytes)))
+		c.srv.metrics().BytesReceived(len(messagePacket.bytes))
+		c.tlsEstablished()
+
 		//Convert ASN1 binaryMessage to a ldap Message
 		message, err := messagePacket.readMessage()
 
 		if err != nil {
-			Logger.Printf("Error reading Message : %s\n\t%x", err.Error(), messagePacket.bytes)
+			c.log.Warn("invalid message", "error", err)
+			c.log.Debug("invalid message PDU", "hex", hexDump(messagePacket.bytes))
 			continue
 		}
-		Logger.Printf("<<< %d - %s - hex=%x", c.Numero, message.ProtocolOpName(), messagePacket)
+		c.log.Debug("received", "msgid", message.MessageID().Int(), "op", message.ProtocolOpName(),
+			"hex", hexDump(messagePacket.bytes))
+		c.recordSession(SessionRequest, &message, messagePacket.bytes)
 
 		// TODO: Use a implementation to limit runnuning request by client
 		// solution 1 : when the buffered output channel is full, send a busy
 		// solution 2 : when 10 client requests (goroutines) are running, send a busy message
 		// And when the limit is reached THEN send a BusyLdapMessage
 
+		op := c.newOperation()
+
 		// When message is an UnbindRequest, stop serving
 		if _, ok := message.ProtocolOp().(ldap.UnbindRequest); ok {
+			c.srv.operations.initiated("unbind")
+			c.srv.operations.completed("unbind")
+			c.accessLogRequest(&message, op)
+			c.srv.metrics().OperationDone("unbind", -1, time.Since(op.start))
 			return
 		}
 
@@ -169,7 +330,7 @@ func (c *client) serve() {
 		if req, ok := message.ProtocolOp().(ldap.ExtendedRequest); ok {
 			if req.RequestName() == NoticeOfStartTLS {
 				c.wg.Add(1)
-				c.ProcessRequestMessage(&message)
+				c.processRequest(&message, op)
 				continue
 			}
 		}
@@ -177,11 +338,25 @@ func (c *client) serve() {
 		// TODO: go/non go routine choice should be done in the ProcessRequestMessage
 		// not in the client.serve func
 		c.wg.Add(1)
-		go c.ProcessRequestMessage(&message)
+		go c.processRequest(&message, op)
 	}
 
 }
 
+// opened logs the new connection, once the address of the client is known.
+func (c *client) opened() {
+	c.log = c.log.With("remote", c.rwc.RemoteAddr().String())
+	if cred, ok := c.PeerCredentials(); ok {
+		c.log = c.log.With("uid", cred.UID, "gid", cred.GID, "pid", cred.PID)
+	}
+	c.log.Info("connection accepted")
+	if header, ok := c.ProxyHeader(); ok && header.TLS != nil {
+		c.log.Info("TLS terminated by proxy", "tls_version", header.TLS.Version, "cipher", header.TLS.Cipher,
+			"client_cn", header.TLS.CommonName, "verified", header.TLS.Verified)
+	}
+	c.accessLogOpened()
+}
+
 // close closes client,
 // * stop reading from client
 // * signals to all currently running request processor to stop
@@ -189,39 +364,60 @@ func (c *client) serve() {
 // * close client connection
 // * signal to server that client shutdown is ok
 func (c *client) close() {
-	Logger.Printf("client %d close()", c.Numero)
+	c.log.Debug("closing connection")
 	close(c.closing)
 	<-c.shutdownDone // wait for shutdown-listener goroutine to finish
 
 	// stop reading from client
 	c.rwc.SetReadDeadline(time.Now().Add(time.Millisecond))
-	Logger.Printf("client %d close() - stop reading from client", c.Numero)
 
 	// signals to all currently running request processor to stop
 	c.mutex.Lock()
 	for messageID, request := range c.requestList {
-		Logger.Printf("Client %d close() - sent abandon signal to request[messageID = %d]", c.Numero, messageID)
+		c.log.Debug("abandoning request", "msgid", messageID)
 		go request.Abandon()
 	}
 	c.mutex.Unlock()
-	Logger.Printf("client %d close() - Abandon signal sent to processors", c.Numero)
 
-	c.wg.Wait()      // wait for all current running request processor to end
+	c.wg.Wait() // wait for all current running request processor to end
+	c.stopTimers()
+	c.mutex.Lock()
+	hooks := c.closeHooks
+	c.mutex.Unlock()
+	for _, f := range hooks {
+		f()
+	}
 	close(c.chanOut) // No more message will be sent to client, close chanOUT
-	Logger.Printf("client [%d] request processors ended", c.Numero)
 
 	<-c.writeDone // Wait for the last message sent to be written
 	c.rwc.Close() // close client connection
-	Logger.Printf("client [%d] connection closed", c.Numero)
+	c.log.Info("connection closed")
+	c.accessLogClosed()
+	c.srv.metrics().ConnectionClosed()
+	c.srv.removeClient(c)
 
 	c.srv.wg.Done() // signal to server that client shutdown is ok
 }
 
 func (c *client) writeMessage(m *ldap.LDAPMessage) {
 	data, _ := m.Write()
-	Logger.Printf(">>> %d - %s - hex=%x", c.Numero, m.ProtocolOpName(), data.Bytes())
+	c.bytesSent.Add(int64(len(data.Bytes())))
+	c.srv.metrics().BytesSent(len(data.Bytes()))
+	c.log.Debug("sent", "msgid", m.MessageID().Int(), "op", m.ProtocolOpName(), "hex", hexDump(data.Bytes()))
+	c.recordSession(SessionResponse, m, data.Bytes())
+	if c.writeFailed {
+		return
+	}
+	if c.srv.WriteTimeout != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(c.srv.WriteTimeout))
+	}
 	c.bw.Write(data.Bytes())
-	c.bw.Flush()
+	if err := c.bw.Flush(); err != nil {
+		// The client does not read its responses: stop serving it.
+		c.log.Warn("write failed", "error", err)
+		c.writeFailed = true
+		c.rwc.SetReadDeadline(time.Now())
+	}
 }
 
 // ResponseWriter interface is used by an LDAP handler to
@@ -234,60 +430,123 @@ type ResponseWriter interface {
 type responseWriterImpl struct {
 	chanOut   chan *ldap.LDAPMessage
 	messageID int
+	request   *Message
+	op        *operation
 }
 
 func (w responseWriterImpl) Write(po ldap.ProtocolOp) {
+	w.observe(po)
 	m := ldap.NewLDAPMessageWithProtocolOp(po)
 	m.SetMessageID(w.messageID)
 	w.chanOut <- m
 }
 
-func (w responseWriterImpl) writeWithControls(po ldap.ProtocolOp, controls ldap.Controls) {
+func (w responseWriterImpl) WriteWithControls(po ldap.ProtocolOp, controls ldap.Controls) {
+	w.observe(po)
 	m := ldap.NewLDAPMessageWithProtocolOp(po)
 	m.SetMessageID(w.messageID)
 	m.SetControls(controls.Pointer())
 	w.chanOut <- m
 }
 
-// controlsWriter is an optional interface for ResponseWriter implementations
-// that support attaching controls to an LDAP response message.
-type controlsWriter interface {
-	writeWithControls(po ldap.ProtocolOp, controls ldap.Controls)
+// observe lets the server keep track of the responses sent to the client.
+func (w responseWriterImpl) observe(po ldap.ProtocolOp) {
+	isResult := w.op.responded(po)
+	if res, ok := po.(ldap.BindResponse); ok {
+		if req, ok := w.request.ProtocolOp().(ldap.BindRequest); ok {
+			w.request.Client.bindResponded(req, res)
+		}
+	}
+	if isResult {
+		w.request.Client.accessLogResult(w.op)
+		w.request.Client.audit(w.request, w.op)
+	}
 }
 
+// controlsWriter is an optional interface for ResponseWriter implementations
+// that support attaching controls to an LDAP response message. It lives in an
+// internal package so that ldaptest.ResponseRecorder can implement it.
+type controlsWriter = controls.Writer
+
 // WriteWithControls writes an LDAP response with the given controls attached
 // to the LDAPMessage envelope. If the ResponseWriter does not support controls,
 // it falls back to w.Write(po).
 func WriteWithControls(w ResponseWriter, po ldap.ProtocolOp, controls ...ldap.Control) {
 	if cw, ok := w.(controlsWriter); ok {
-		cw.writeWithControls(po, ldap.Controls(controls))
+		cw.WriteWithControls(po, ldap.Controls(controls))
 		return
 	}
 	w.Write(po)
 }
 
 func (c *client) ProcessRequestMessage(message *ldap.LDAPMessage) {
+	c.processRequest(message, c.newOperation())
+}
+
+// processRequest serves the request message, tracked as op.
+func (c *client) processRequest(message *ldap.LDAPMessage, op *operation) {
 	defer c.wg.Done()
+	c.operationStarted()
+	defer c.operationEnded()
+	c.srv.operations.initiated(OperationName(message.ProtocolOp()))
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	var m Message
 	m = Message{
 		LDAPMessage: message,
 		Done:        make(chan bool, 2),
 		Client:      c,
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 
 	c.registerRequest(&m)
 	defer c.unregisterRequest(&m)
 
+	// A Bind request moves the connection to an anonymous state until
+	// it succeeds (RFC 4511 section 4.2.1).
+	// Any bind other than SASL also aborts a SASL exchange in progress.
+	if r, ok := message.ProtocolOp().(ldap.BindRequest); ok {
+		c.SetAuthzID("")
+		if r.AuthenticationChoice() != "sasl" {
+			c.setSASLExchange(nil)
+		}
+	}
+
 	var w responseWriterImpl
 	w.chanOut = c.chanOut
 	w.messageID = m.MessageID().Int()
+	w.request = &m
+	w.op = op
+	c.accessLogRequest(message, op)
+	switch r := message.ProtocolOp().(type) {
+	case ldap.AbandonRequest:
+		c.srv.metrics().AbandonRequested()
+	case ldap.ExtendedRequest:
+		if r.RequestName() == NoticeOfCancel {
+			c.srv.metrics().CancelRequested()
+		}
+	}
 
+	if code, diagnostic := c.checkSecurity(message); code != LDAPResultSuccess {
+		if res := newErrorResponse(message.ProtocolOp(), code, diagnostic); res != nil {
+			w.Write(res)
+		}
+		c.endOperation(&m, w.op)
+		return
+	}
+
+	span := c.srv.startTrace(&m)
 	if c.handler != nil {
 		c.handler.ServeLDAP(w, &m)
 	} else {
 		c.srv.Handler.ServeLDAP(w, &m)
 	}
+	if span != nil {
+		span.End(op.outcome())
+	}
+	c.endOperation(&m, w.op)
 }
 
 func (c *client) registerRequest(m *Message) {
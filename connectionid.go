@@ -0,0 +1,16 @@
+package ldapserver
+
+import "encoding/asn1"
+
+// handleGetConnectionID is the built-in handler for the Get Connection ID
+// Extended Operation (OID 1.3.6.1.4.1.26027.1.6.2). It responds with the
+// number the server gave to the connection, encoded as an INTEGER.
+func handleGetConnectionID(w ResponseWriter, r *Message) {
+	value, err := asn1.Marshal(r.Client.Numero)
+	if err != nil {
+		w.Write(NewExtendedResponse(LDAPResultOther))
+		return
+	}
+	res := NewExtendedResponseWithValue(LDAPResultSuccess, NoticeOfGetConnectionID, value)
+	w.Write(res)
+}
@@ -0,0 +1,101 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"time"
+)
+
+// ConnectionInfo is a snapshot of a client connection, returned by
+// Server.Connections.
+type ConnectionInfo struct {
+	ID         int // connection number, as in logs
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	Opened     time.Time
+
+	AuthzID string // authorization identity, empty while anonymous
+	BindDN  string // DN of the last successful simple bind
+
+	TLS         bool   // the connection is protected by TLS
+	TLSVersion  string // such as "TLS 1.3"
+	CipherSuite string
+
+	Operations    int // requests received
+	InProgress    int // requests in progress
+	BytesReceived int64
+	BytesSent     int64
+}
+
+// Connections returns a snapshot of the open connections of the server,
+// ordered by ID.
+func (s *Server) Connections() []ConnectionInfo {
+	s.clientsMutex.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.clientsMutex.Unlock()
+
+	infos := make([]ConnectionInfo, len(clients))
+	for i, c := range clients {
+		infos[i] = c.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Disconnect sends a Notice of Disconnection with the diagnostic message
+// reason to the client of the connection id, and closes the connection,
+// abandoning its requests in progress. It returns false if there is no such
+// connection.
+func (s *Server) Disconnect(id int, reason string) bool {
+	s.clientsMutex.Lock()
+	c, ok := s.clients[id]
+	s.clientsMutex.Unlock()
+	if !ok {
+		return false
+	}
+	c.log.Info("disconnecting", "reason", reason)
+	c.disconnect(LDAPResultUnavailable, reason)
+	return true
+}
+
+func (s *Server) addClient(c *client) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	if s.clients == nil {
+		s.clients = make(map[int]*client)
+	}
+	s.clients[c.Numero] = c
+}
+
+func (s *Server) removeClient(c *client) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	delete(s.clients, c.Numero)
+}
+
+// info returns a snapshot of the connection.
+func (c *client) info() ConnectionInfo {
+	info := ConnectionInfo{
+		ID:            c.Numero,
+		RemoteAddr:    c.Addr(),
+		LocalAddr:     c.conn().LocalAddr(),
+		Opened:        c.start,
+		AuthzID:       c.AuthzID(),
+		BindDN:        c.BindDN(),
+		BytesReceived: c.bytesReceived.Load(),
+		BytesSent:     c.bytesSent.Load(),
+	}
+	if state, ok := c.TLSConnectionState(); ok {
+		info.TLS = true
+		info.TLSVersion = tls.VersionName(state.Version)
+		info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+	c.mutex.Lock()
+	info.Operations, info.InProgress = c.operations, c.inProgress
+	c.mutex.Unlock()
+	return info
+}
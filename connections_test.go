@@ -0,0 +1,130 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func TestE2E_Connections(t *testing.T) {
+	routes := NewRouteMux()
+	routes.Bind(func(w ResponseWriter, m *Message) {
+		w.Write(NewBindResponse(LDAPResultSuccess))
+	})
+	routes.Search(func(w ResponseWriter, m *Message) {
+		w.Write(NewSearchResultEntry("cn=entry"))
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := NewServer()
+	server.Handle(routes)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	alice, err := goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer alice.Close()
+	if err := alice.Bind("cn=alice,dc=example", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if _, err := alice.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree,
+		goldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil)); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	anonymous, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer anonymous.Close()
+
+	var conns []ConnectionInfo
+	for range 100 {
+		if conns = server.Connections(); len(conns) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("connections = %+v", conns)
+	}
+	c := conns[0]
+	if c.ID != 1 || c.BindDN != "cn=alice,dc=example" || c.AuthzID != "dn:cn=alice,dc=example" ||
+		c.Operations != 2 || c.InProgress != 0 || c.TLS || c.BytesReceived == 0 || c.BytesSent == 0 ||
+		time.Since(c.Opened) > time.Minute {
+		t.Errorf("unexpected connection %+v", c)
+	}
+	if c.RemoteAddr.String() == anonymous.LocalAddr().String() || conns[1].RemoteAddr.String() != anonymous.LocalAddr().String() {
+		t.Errorf("unexpected addresses %v, %v", c.RemoteAddr, conns[1].RemoteAddr)
+	}
+	if conns[1].BindDN != "" || conns[1].Operations != 0 {
+		t.Errorf("unexpected anonymous connection %+v", conns[1])
+	}
+
+	if server.Disconnect(42, "maintenance") {
+		t.Error("disconnected an unknown connection")
+	}
+	if !server.Disconnect(conns[1].ID, "maintenance") {
+		t.Fatal("connection not found")
+	}
+	if diag := readNoticeOfDisconnection(t, anonymous); diag != "maintenance" {
+		t.Errorf("diagnostic = %q", diag)
+	}
+	for range 100 {
+		if conns = server.Connections(); len(conns) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(conns) != 1 || conns[0].ID != 1 {
+		t.Errorf("connections after disconnect = %+v", conns)
+	}
+}
+
+func TestE2E_ConnectionsDuringStartTLS(t *testing.T) {
+	ca, serverCert, _ := testPKI(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	routes := NewRouteMux()
+	routes.Extended(NewStartTLSHandler(&tls.Config{Certificates: []tls.Certificate{serverCert}})).RequestName(NoticeOfStartTLS)
+	var server *Server
+	addr, _ := serveTest(t, nil, routes, func(s *Server) { server = s })
+
+	// Connections reads the connection StartTLS replaces; the race
+	// detector reports unsynchronised accesses.
+	done := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.Connections()
+			}
+		}
+	}()
+	for range 5 {
+		conn, err := goldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		if err := conn.StartTLS(&tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}); err != nil {
+			t.Fatalf("StartTLS: %v", err)
+		}
+		conn.Close()
+	}
+	close(done)
+	<-polled
+
+	waitUntil(t, "the connections are closed", func() bool { return len(server.Connections()) == 0 })
+}
@@ -0,0 +1,312 @@
+package ldapserver
+
+import (
+	"context"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// Dispatcher is a Handler serving several naming contexts, each with its
+// own backend Handler:
+//
+//	dispatcher := ldap.NewDispatcher().
+//		Backend("ou=hr,dc=corp", hr).
+//		Backend("ou=eng,dc=corp", eng).
+//		Backend("dc=corp", corp)
+//	server.Handle(dispatcher)
+//
+// Requests about an entry go to the backend with the longest suffix
+// containing it. A Modify DN request moving an entry to another backend
+// fails with affectsMultipleDSAs (71).
+//
+// A search goes to the backend containing its base, and to every backend
+// whose suffix is within its scope, with the suffix as base. The backends
+// are searched concurrently and their entries and references are relayed
+// as they arrive, up to the size limit of the request for all of them:
+// once it is reached, the searches in progress are abandoned and the
+// result is sizeLimitExceeded (4). Otherwise the result is the first error
+// of a backend other than noSuchObject (32), starting with the backend
+// containing the base; success if a backend succeeded; noSuchObject
+// otherwise. The controls of the backend results are dropped.
+//
+// Abandon requests abandon the request they target. Requests outside of
+// every backend, such as Extended requests or a search of the root DSE, go
+// to Default, or fail with noSuchObject when it is nil.
+type Dispatcher struct {
+	Default Handler
+
+	backends []dispatchBackend
+}
+
+type dispatchBackend struct {
+	dn      string
+	suffix  []string // normalized RDNs of dn
+	handler Handler
+}
+
+// NewDispatcher returns a Dispatcher without backends.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{}
+}
+
+// Backend adds the handler of the entries under suffix.
+func (d *Dispatcher) Backend(suffix string, handler Handler) *Dispatcher {
+	d.backends = append(d.backends, dispatchBackend{dn: suffix, suffix: normalizeRDNs(splitDN(suffix)), handler: handler})
+	return d
+}
+
+func (d *Dispatcher) ServeLDAP(w ResponseWriter, m *Message) {
+	var dn string
+	switch r := m.ProtocolOp().(type) {
+	case ldap.AbandonRequest:
+		if requestToAbandon, ok := m.Client.GetMessageByID(int(r)); ok {
+			requestToAbandon.Abandon()
+		}
+		return
+	case ldap.SearchRequest:
+		d.search(w, m, r)
+		return
+	case ldap.BindRequest:
+		dn = string(r.Name())
+	case ldap.AddRequest:
+		dn = string(r.Entry())
+	case ldap.ModifyRequest:
+		dn = string(r.Object())
+	case ldap.DelRequest:
+		dn = string(r)
+	case ldap.CompareRequest:
+		dn = string(r.Entry())
+	case ldap.ModifyDNRequest:
+		req, err := parseModifyDNRequest(r)
+		if err != nil {
+			w.Write(NewModifyDNResponse(LDAPResultProtocolError))
+			return
+		}
+		dn = req.entry
+		if req.hasNewSuperior && d.backend(req.newSuperior) != d.backend(dn) {
+			w.Write(newErrorResponse(r, LDAPResultAffectsMultipleDSAs, "the new superior is in another naming context"))
+			return
+		}
+	}
+	if b := d.backend(dn); b != nil && dn != "" {
+		b.handler.ServeLDAP(w, m)
+		return
+	}
+	d.serveDefault(w, m)
+}
+
+// backend returns the backend with the longest suffix containing dn, or
+// nil.
+func (d *Dispatcher) backend(dn string) *dispatchBackend {
+	rdns := normalizeRDNs(splitDN(dn))
+	var found *dispatchBackend
+	for i, b := range d.backends {
+		if withinSuffix(rdns, b.suffix) && (found == nil || len(b.suffix) > len(found.suffix)) {
+			found = &d.backends[i]
+		}
+	}
+	return found
+}
+
+func (d *Dispatcher) serveDefault(w ResponseWriter, m *Message) {
+	if d.Default != nil {
+		d.Default.ServeLDAP(w, m)
+		return
+	}
+	if res := newErrorResponse(m.ProtocolOp(), LDAPResultNoSuchObject, "no backend for this entry"); res != nil {
+		w.Write(res)
+	}
+}
+
+// searchTarget is a backend to search, with the base and scope to use.
+type searchTarget struct {
+	handler Handler
+	base    string
+	scope   int
+}
+
+// search fans r out to the backends within its scope.
+func (d *Dispatcher) search(w ResponseWriter, m *Message, r ldap.SearchRequest) {
+	base := string(r.BaseObject())
+	scope := int(r.Scope())
+	rdns := normalizeRDNs(splitDN(base))
+
+	var targets []searchTarget
+	if b := d.backend(base); b != nil && base != "" {
+		targets = append(targets, searchTarget{handler: b.handler, base: base, scope: scope})
+	}
+	for _, b := range d.backends {
+		if len(b.suffix) <= len(rdns) || !withinSuffix(b.suffix, rdns) {
+			continue
+		}
+		switch {
+		case scope == SearchRequestSingleLevel && len(b.suffix) == len(rdns)+1:
+			targets = append(targets, searchTarget{handler: b.handler, base: b.dn, scope: SearchRequestScopeBaseObject})
+		case scope >= SearchRequestHomeSubtree:
+			targets = append(targets, searchTarget{handler: b.handler, base: b.dn, scope: SearchRequestHomeSubtree})
+		}
+	}
+
+	switch {
+	case len(targets) == 0:
+		d.serveDefault(w, m)
+		return
+	case len(targets) == 1 && targets[0].base == base:
+		targets[0].handler.ServeLDAP(w, m)
+		return
+	}
+
+	merger := &searchMerger{w: w, sizeLimit: int(r.SizeLimit()), results: make([]ldap.ProtocolOp, len(targets))}
+	messages := make([]*Message, len(targets))
+	for i, t := range targets {
+		msg, err := searchMessage(m, t.base, t.scope)
+		if err != nil {
+			w.Write(NewSearchResultDoneResponse(LDAPResultOther))
+			return
+		}
+		defer msg.cancel()
+		messages[i] = msg
+	}
+	merger.abandon = func() {
+		for _, msg := range messages {
+			msg.cancel()
+			select {
+			case msg.Done <- true:
+			default:
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	abandoned := make(chan struct{})
+	go func() {
+		select {
+		case <-m.Done:
+			close(abandoned)
+			merger.abandon()
+		case <-done:
+		}
+	}()
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.handler.ServeLDAP(mergeWriter{merger: merger, index: i}, messages[i])
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	select {
+	case <-abandoned:
+		return
+	default:
+	}
+	w.Write(merger.result())
+}
+
+// searchMessage returns a copy of m searching base with scope, with its
+// own Done channel and a context derived from that of m, which the caller
+// must cancel.
+func searchMessage(m *Message, base string, scope int) (*Message, error) {
+	p, err := encodeProtocolOp(m.ProtocolOp())
+	if err != nil {
+		return nil, err
+	}
+	setPacketString(p.Children[0], base)
+	p.Children[1] = ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, scope, "scope")
+	refreshPacket(p)
+	po, err := decodeProtocolOp(p)
+	if err != nil {
+		return nil, err
+	}
+	msg := ldap.NewLDAPMessageWithProtocolOp(po)
+	msg.SetMessageID(m.MessageID().Int())
+	msg.SetControls(m.Controls())
+	copied := *m
+	copied.LDAPMessage = msg
+	copied.Done = make(chan bool, 2)
+	copied.ctx, copied.cancel = context.WithCancel(m.Context())
+	return &copied, nil
+}
+
+// searchMerger merges the responses of the backends of a search.
+type searchMerger struct {
+	w         ResponseWriter
+	sizeLimit int
+	abandon   func()
+
+	mutex    sync.Mutex
+	entries  int
+	exceeded bool
+	results  []ldap.ProtocolOp // SearchResultDone of each backend
+}
+
+// mergeWriter is the ResponseWriter of the backend index of a search.
+type mergeWriter struct {
+	merger *searchMerger
+	index  int
+}
+
+func (mw mergeWriter) Write(po ldap.ProtocolOp) {
+	mw.WriteWithControls(po, nil)
+}
+
+func (mw mergeWriter) WriteWithControls(po ldap.ProtocolOp, controls ldap.Controls) {
+	s := mw.merger
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch po.(type) {
+	case ldap.SearchResultDone:
+		s.results[mw.index] = po
+		return
+	case ldap.SearchResultEntry:
+		if s.exceeded {
+			return
+		}
+		if s.sizeLimit > 0 && s.entries == s.sizeLimit {
+			s.exceeded = true
+			go s.abandon()
+			return
+		}
+		s.entries++
+	}
+	WriteWithControls(s.w, po, controls...)
+}
+
+// result returns the SearchResultDone combining those of the backends.
+func (s *searchMerger) result() ldap.ProtocolOp {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.exceeded {
+		return NewSearchResultDoneResponse(LDAPResultSizeLimitExceeded)
+	}
+	var success bool
+	for _, res := range s.results {
+		if res == nil {
+			other := NewSearchResultDoneResponse(LDAPResultOther)
+			other.SetDiagnosticMessage("a backend sent no result")
+			return other
+		}
+		switch code, _ := responseResultCode(res); code {
+		case LDAPResultSuccess:
+			success = true
+		case LDAPResultNoSuchObject:
+		default:
+			return res
+		}
+	}
+	if success {
+		return NewSearchResultDoneResponse(LDAPResultSuccess)
+	}
+	return NewSearchResultDoneResponse(LDAPResultNoSuchObject)
+}
+
+// withinSuffix reports whether the normalized RDNs of a DN are under or at
+// the normalized RDNs of suffix.
+func withinSuffix(rdns, suffix []string) bool {
+	return len(rdns) >= len(suffix) && equalRDNs(rdns[len(rdns)-len(suffix):], suffix)
+}
@@ -0,0 +1,161 @@
+package ldapserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// newDispatchBackend returns a backend holding the entries dns, answering
+// searches with resultCode, and recording the DN of write requests on
+// writes.
+func newDispatchBackend(dns []string, resultCode int, writes chan<- string) *RouteMux {
+	routes := NewRouteMux()
+	routes.Search(func(w ResponseWriter, m *Message) {
+		r := m.GetSearchRequest()
+		base := normalizeRDNs(splitDN(string(r.BaseObject())))
+		for _, dn := range dns {
+			rdns := normalizeRDNs(splitDN(dn))
+			if !withinSuffix(rdns, base) {
+				continue
+			}
+			switch {
+			case r.Scope() == SearchRequestScopeBaseObject && len(rdns) != len(base),
+				r.Scope() == SearchRequestSingleLevel && len(rdns) != len(base)+1:
+				continue
+			}
+			w.Write(NewSearchResultEntry(dn))
+		}
+		w.Write(NewSearchResultDoneResponse(resultCode))
+	})
+	routes.Add(func(w ResponseWriter, m *Message) {
+		r := m.GetAddRequest()
+		writes <- string(r.Entry())
+		w.Write(NewAddResponse(LDAPResultSuccess))
+	})
+	routes.ModifyDN(func(w ResponseWriter, m *Message) {
+		w.Write(NewModifyDNResponse(LDAPResultSuccess))
+	})
+	return routes
+}
+
+func TestE2E_Dispatcher(t *testing.T) {
+	writes := make(chan string, 1)
+	dispatcher := NewDispatcher().
+		Backend("dc=corp", newDispatchBackend([]string{"dc=corp"}, LDAPResultSuccess, writes)).
+		Backend("ou=hr,dc=corp", newDispatchBackend([]string{"ou=hr,dc=corp", "uid=ann,ou=hr,dc=corp"}, LDAPResultSuccess, writes)).
+		Backend("ou=eng,dc=corp", newDispatchBackend([]string{"ou=eng,dc=corp", "uid=bob,ou=eng,dc=corp"}, LDAPResultSuccess, writes)).
+		Backend("ou=ops,dc=corp", newDispatchBackend(nil, LDAPResultBusy, writes))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := NewServer()
+	server.Handle(dispatcher)
+	go server.Serve(ln)
+	defer server.Stop()
+	conn, err := goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	search := func(base string, scope, sizeLimit int) ([]string, error) {
+		res, err := conn.Search(goldap.NewSearchRequest(base, scope, goldap.NeverDerefAliases,
+			sizeLimit, 0, false, "(objectClass=*)", nil, nil))
+		var dns []string
+		if res != nil {
+			for _, e := range res.Entries {
+				dns = append(dns, e.DN)
+			}
+		}
+		sort.Strings(dns)
+		return dns, err
+	}
+
+	// The busy backend makes the result busy, after the entries of the
+	// others.
+	dns, err := search("dc=corp", goldap.ScopeWholeSubtree, 0)
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultBusy) {
+		t.Errorf("expected busy, got %v", err)
+	}
+	if want := "[dc=corp ou=eng,dc=corp ou=hr,dc=corp uid=ann,ou=hr,dc=corp uid=bob,ou=eng,dc=corp]"; fmt.Sprint(dns) != want {
+		t.Errorf("subtree entries = %v", dns)
+	}
+
+	dns, err = search("dc=corp", goldap.ScopeSingleLevel, 0)
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultBusy) || fmt.Sprint(dns) != "[ou=eng,dc=corp ou=hr,dc=corp]" {
+		t.Errorf("one level entries = %v, %v", dns, err)
+	}
+
+	dns, err = search("ou=HR,dc=corp", goldap.ScopeWholeSubtree, 0)
+	if err != nil || fmt.Sprint(dns) != "[ou=hr,dc=corp uid=ann,ou=hr,dc=corp]" {
+		t.Errorf("hr entries = %v, %v", dns, err)
+	}
+
+	dns, err = search("dc=corp", goldap.ScopeWholeSubtree, 3)
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) || len(dns) != 3 {
+		t.Errorf("size limited entries = %v, %v", dns, err)
+	}
+
+	if _, err := search("o=other", goldap.ScopeWholeSubtree, 0); !goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+		t.Errorf("expected noSuchObject, got %v", err)
+	}
+
+	add := goldap.NewAddRequest("uid=eve,ou=eng,dc=corp", nil)
+	add.Attribute("uid", []string{"eve"})
+	if err := conn.Add(add); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if dn := <-writes; dn != "uid=eve,ou=eng,dc=corp" {
+		t.Errorf("unexpected add %q", dn)
+	}
+
+	if err := conn.ModifyDN(goldap.NewModifyDNRequest("uid=eve,ou=eng,dc=corp", "uid=eve", true, "ou=eng,dc=corp")); err != nil {
+		t.Errorf("modify DN within a backend: %v", err)
+	}
+	err = conn.ModifyDN(goldap.NewModifyDNRequest("uid=eve,ou=eng,dc=corp", "uid=eve", true, "ou=hr,dc=corp"))
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultAffectsMultipleDSAs) {
+		t.Errorf("expected affectsMultipleDSAs, got %v", err)
+	}
+}
+
+func TestE2E_DispatcherCancelsBackendContexts(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	slow := NewRouteMux()
+	slow.Search(func(w ResponseWriter, m *Message) {
+		select {
+		case <-m.Context().Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+			cancelled <- false
+		}
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	dispatcher := NewDispatcher().
+		Backend("ou=hr,dc=corp", newDispatchBackend([]string{"ou=hr,dc=corp", "uid=ann,ou=hr,dc=corp"}, LDAPResultSuccess, nil)).
+		Backend("ou=eng,dc=corp", slow)
+	addr, _ := serveTest(t, nil, dispatcher)
+
+	conn, err := goldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// The size limit is reached by the first backend, which abandons the
+	// search of the second one through its context.
+	_, err = conn.Search(goldap.NewSearchRequest("dc=corp", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		1, 0, false, "(objectClass=*)", nil, nil))
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		t.Fatalf("expected sizeLimitExceeded, got %v", err)
+	}
+	if !<-cancelled {
+		t.Fatalf("the context of the second backend was not cancelled")
+	}
+}
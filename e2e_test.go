@@ -4,6 +4,7 @@ import (
 	"encoding/asn1"
 	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -55,6 +56,36 @@ func startTestServer(t *testing.T) (addr string, stop func()) {
 	return ln.Addr().String(), func() { server.Stop() }
 }
 
+// serveTest serves handler with a server configured by configure, on ln or
+// on a random loopback port when ln is nil, with implicit TLS when configure
+// sets TLSConfig. The server is stopped at the end of the test; stop stops
+// it earlier and may be called more than once.
+func serveTest(t *testing.T, ln net.Listener, handler Handler, configure ...func(*Server)) (addr string, stop func()) {
+	t.Helper()
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+	}
+
+	server := NewServer()
+	server.Handle(handler)
+	for _, f := range configure {
+		f(server)
+	}
+	if server.TLSConfig != nil {
+		go server.ServeTLS(ln)
+	} else {
+		go server.Serve(ln)
+	}
+
+	var once sync.Once
+	stop = func() { once.Do(server.Stop) }
+	t.Cleanup(stop)
+	return ln.Addr().String(), stop
+}
+
 // dialAndBind dials the server, binds with cn=test/secret, and returns the connection.
 func dialAndBind(t *testing.T, addr string) *goldap.Conn {
 	t.Helper()
@@ -70,6 +101,18 @@ func dialAndBind(t *testing.T, addr string) *goldap.Conn {
 	return conn
 }
 
+// waitUntil polls cond until it holds, failing the test after 5 seconds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
 // --- Handlers ---
 
 func handleNotFoundTest(w ResponseWriter, r *Message) {
@@ -0,0 +1,39 @@
+package ldapserver
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ResultError is an error carrying the LDAP result code and diagnostic
+// message to send back to the client. Application callbacks return it to
+// choose the result of the operation.
+type ResultError struct {
+	ResultCode int
+	Message    string
+}
+
+// NewResultError returns a ResultError with the given result code and
+// diagnostic message.
+func NewResultError(resultCode int, message string) *ResultError {
+	return &ResultError{ResultCode: resultCode, Message: message}
+}
+
+func (e *ResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("LDAP result code %d", e.ResultCode)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", e.ResultCode, e.Message)
+}
+
+// resultFromError returns the result code and diagnostic message to send
+// for err. Only a *ResultError is meant for the client: any other error may
+// carry backend details, so it is answered with code and the generic
+// diagnostic instead. Callers log err themselves.
+func resultFromError(err error, code int, diagnostic string) (int, string) {
+	var re *ResultError
+	if errors.As(err, &re) {
+		return re.ResultCode, re.Message
+	}
+	return code, diagnostic
+}
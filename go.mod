@@ -6,10 +6,12 @@ require (
 	github.com/go-asn1-ber/asn1-ber v1.5.8-0.20250403174932-29230038a667
 	github.com/go-ldap/ldap/v3 v3.4.12
 	github.com/vjeantet/goldap v0.0.0-20260218214109-3dcf54ec83d6
+	golang.org/x/crypto v0.48.0
 )
 
 require (
 	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	golang.org/x/crypto v0.48.0 // indirect
+	github.com/stretchr/testify v1.11.1 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 )
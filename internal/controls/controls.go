@@ -0,0 +1,12 @@
+// Package controls defines how ldapserver writes a response with controls
+// to a ResponseWriter. It is internal so that ldaptest can record controls
+// without making the interface part of the ldapserver API.
+package controls
+
+import ldap "github.com/vjeantet/goldap/message"
+
+// Writer is implemented by response writers that can attach controls to the
+// LDAPMessage envelope of a response.
+type Writer interface {
+	WriteWithControls(po ldap.ProtocolOp, controls ldap.Controls)
+}
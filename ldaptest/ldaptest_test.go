@@ -0,0 +1,105 @@
+package ldaptest
+
+import (
+	"testing"
+
+	ldap "github.com/vjeantet/goldap/message"
+
+	"github.com/vjeantet/ldapserver"
+)
+
+func handleSearch(w ldapserver.ResponseWriter, m *ldapserver.Message) {
+	r := m.GetSearchRequest()
+	e := ldapserver.NewSearchResultEntry("uid=alice," + string(r.BaseObject()))
+	e.AddAttribute("uid", "alice")
+	w.Write(e)
+	res := ldapserver.NewSearchResultDoneResponse(ldapserver.LDAPResultSuccess)
+	ldapserver.WriteWithControls(w, res, ldap.NewControl("1.2.3.4", false, nil))
+}
+
+func TestResponseRecorder(t *testing.T) {
+	w := NewRecorder()
+	if _, ok := w.ResultCode(); ok {
+		t.Fatalf("empty recorder has a result")
+	}
+	handleSearch(w, NewSearchRequest("dc=example", ldapserver.SearchRequestScopeBaseObject, "(uid=alice)", []string{"uid"}))
+
+	if responses := w.Responses(); len(responses) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(responses))
+	}
+	entries := w.Entries()
+	if len(entries) != 1 || entries[0].DN != "uid=alice,dc=example" || len(entries[0].Values("UID")) != 1 || entries[0].Values("UID")[0] != "alice" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	res, ok := w.Result()
+	if !ok {
+		t.Fatalf("no result")
+	}
+	if _, isDone := res.ProtocolOp.(ldap.SearchResultDone); !isDone {
+		t.Fatalf("unexpected result %T", res.ProtocolOp)
+	}
+	if len(res.Controls) != 1 || res.Controls[0].ControlType() != "1.2.3.4" {
+		t.Fatalf("unexpected controls %v", res.Controls)
+	}
+	if code, _ := w.ResultCode(); code != ldapserver.LDAPResultSuccess {
+		t.Fatalf("result code = %d", code)
+	}
+}
+
+func TestNewRequests(t *testing.T) {
+	bind := NewBindRequest("cn=admin", "secret")
+	if r := bind.GetBindRequest(); r.Name() != "cn=admin" || string(r.AuthenticationSimple()) != "secret" {
+		t.Errorf("unexpected bind request %#v", r)
+	}
+	if mechanism, credentials, _ := ldapserver.SASLCredentials(NewSASLBindRequest("PLAIN", []byte("\x00u\x00p")).GetBindRequest()); mechanism != "PLAIN" || string(credentials) != "\x00u\x00p" {
+		t.Errorf("unexpected SASL credentials %q %q", mechanism, credentials)
+	}
+
+	search := NewSearchRequest("dc=example", 2, "(&(objectClass=person)(uid=a*))", []string{"cn", "mail"},
+		ldap.NewControl("1.2.840.113556.1.4.319", true, nil))
+	if r := search.GetSearchRequest(); r.BaseObject() != "dc=example" || r.Scope() != 2 ||
+		r.FilterString() != "(&(objectClass=person)(uid=a*))" || len(r.Attributes()) != 2 {
+		t.Errorf("unexpected search request %s %d %s %v", r.BaseObject(), r.Scope(), r.FilterString(), r.Attributes())
+	}
+	if c := search.Controls(); c == nil || len(*c) != 1 || !(*c)[0].Criticality() {
+		t.Errorf("unexpected search controls %v", c)
+	}
+
+	add := NewAddRequest("uid=bob,dc=example", map[string][]string{"uid": {"bob"}, "objectClass": {"top", "person"}})
+	if r := add.GetAddRequest(); r.Entry() != "uid=bob,dc=example" || len(r.Attributes()) != 2 ||
+		r.Attributes()[0].Type_() != "objectClass" || len(r.Attributes()[0].Vals()) != 2 {
+		t.Errorf("unexpected add request %#v", r)
+	}
+	if r := NewDeleteRequest("uid=bob,dc=example").GetDeleteRequest(); r != "uid=bob,dc=example" {
+		t.Errorf("unexpected delete request %q", r)
+	}
+	modify := NewModifyRequest("uid=bob,dc=example", []Change{
+		{Operation: ldapserver.ModifyRequestChangeOperationReplace, Type: "mail", Values: []string{"bob@example.com"}},
+	})
+	if r := modify.GetModifyRequest(); r.Object() != "uid=bob,dc=example" || len(r.Changes()) != 1 ||
+		r.Changes()[0].Operation() != ldapserver.ModifyRequestChangeOperationReplace ||
+		r.Changes()[0].Modification().Type_() != "mail" {
+		t.Errorf("unexpected modify request %#v", r)
+	}
+	if _, ok := NewModifyDNRequest("uid=bob,dc=example", "uid=robert", true, "ou=people,dc=example").ProtocolOp().(ldap.ModifyDNRequest); !ok {
+		t.Errorf("expected a ModifyDNRequest")
+	}
+	if r := NewCompareRequest("uid=bob,dc=example", "uid", "bob").GetCompareRequest(); r.Entry() != "uid=bob,dc=example" ||
+		r.Ava().AttributeDesc() != "uid" || r.Ava().AssertionValue() != "bob" {
+		t.Errorf("unexpected compare request %#v", r)
+	}
+	if r := NewExtendedRequest(string(ldapserver.NoticeOfWhoAmI), nil).GetExtendedRequest(); r.RequestName() != ldapserver.NoticeOfWhoAmI || r.RequestValue() != nil {
+		t.Errorf("unexpected extended request %#v", r)
+	}
+	if r := NewAbandonRequest(7).GetAbandonRequest(); r != 7 {
+		t.Errorf("unexpected abandon request %d", r)
+	}
+
+	if bind.MessageID().Int() != MessageID || bind.Client.Addr() != RemoteAddr {
+		t.Errorf("unexpected message ID %d or address %v", bind.MessageID(), bind.Client.Addr())
+	}
+	bind.Client.SetAuthzID("dn:cn=admin")
+	if bind.Client.BindDN() != "cn=admin" {
+		t.Errorf("unexpected bind DN %q", bind.Client.BindDN())
+	}
+}
@@ -0,0 +1,227 @@
+package ldaptest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	ldap "github.com/vjeantet/goldap/message"
+
+	"github.com/vjeantet/ldapserver"
+)
+
+// RemoteAddr is the address of the client of the messages built by this
+// package.
+var RemoteAddr net.Addr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+// MessageID is the message ID of the messages built by this package. Use
+// m.SetMessageID to change it.
+const MessageID = 1
+
+// Change is a modification of a ModifyRequest.
+type Change struct {
+	Operation int // ldapserver.ModifyRequestChangeOperationAdd, ...Delete or ...Replace
+	Type      string
+	Values    []string
+}
+
+// NewMessage returns the Message of the request protocolOp, the BER
+// encoding of a protocol operation, followed by optional request controls.
+// It panics if they do not make a valid LDAP message.
+func NewMessage(protocolOp *ber.Packet, controls ...ldap.Control) *ldapserver.Message {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, MessageID, "messageID"))
+	envelope.AppendChild(protocolOp)
+	message, err := readMessage(envelope.Bytes())
+	if err != nil {
+		panic(fmt.Sprintf("ldaptest: invalid request: %v", err))
+	}
+	if len(controls) > 0 {
+		message.SetControls(ldap.Controls(controls).Pointer())
+	}
+	return ldapserver.NewMessage(&message, newConn())
+}
+
+func readMessage(data []byte) (message ldap.LDAPMessage, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	return ldap.ReadLDAPMessage(ldap.NewBytes(0, data))
+}
+
+func application(tag ber.Tag, description string) *ber.Packet {
+	return ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, description)
+}
+
+func newOctetString(value, description string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, description)
+}
+
+// octetString returns the value of the OCTET STRING p.
+func octetString(p *ber.Packet) string {
+	return string(p.Data.Bytes())
+}
+
+func sequence(description string) *ber.Packet {
+	return ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, description)
+}
+
+// attribute encodes an attribute type and its values.
+func attribute(typ string, values []string) *ber.Packet {
+	p := sequence("Attribute")
+	p.AppendChild(newOctetString(typ, "type"))
+	vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+	for _, v := range values {
+		vals.AppendChild(newOctetString(v, "value"))
+	}
+	p.AppendChild(vals)
+	return p
+}
+
+// NewBindRequest returns a simple BindRequest.
+func NewBindRequest(name, password string, controls ...ldap.Control) *ldapserver.Message {
+	p := application(ldap.TagBindRequest, "Bind Request")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "version"))
+	p.AppendChild(newOctetString(name, "name"))
+	p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "simple"))
+	return NewMessage(p, controls...)
+}
+
+// NewSASLBindRequest returns a SASL BindRequest. credentials are omitted
+// when nil.
+func NewSASLBindRequest(mechanism string, credentials []byte, controls ...ldap.Control) *ldapserver.Message {
+	p := application(ldap.TagBindRequest, "Bind Request")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "version"))
+	p.AppendChild(newOctetString("", "name"))
+	sasl := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "sasl")
+	sasl.AppendChild(newOctetString(mechanism, "mechanism"))
+	if credentials != nil {
+		sasl.AppendChild(newOctetString(string(credentials), "credentials"))
+	}
+	p.AppendChild(sasl)
+	return NewMessage(p, controls...)
+}
+
+// NewSearchRequest returns a SearchRequest without size and time limits
+// nor alias dereferencing. It panics if filter is not a valid filter.
+func NewSearchRequest(baseDN string, scope int, filter string, attributes []string, controls ...ldap.Control) *ldapserver.Message {
+	compiled, err := goldap.CompileFilter(filter)
+	if err != nil {
+		panic(fmt.Sprintf("ldaptest: invalid filter %q: %v", filter, err))
+	}
+	p := application(ldap.TagSearchRequest, "Search Request")
+	p.AppendChild(newOctetString(baseDN, "baseObject"))
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, scope, "scope"))
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "derefAliases"))
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "sizeLimit"))
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "timeLimit"))
+	p.AppendChild(ber.NewLDAPBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "typesOnly"))
+	p.AppendChild(compiled)
+	attrs := sequence("attributes")
+	for _, a := range attributes {
+		attrs.AppendChild(newOctetString(a, "attribute"))
+	}
+	p.AppendChild(attrs)
+	return NewMessage(p, controls...)
+}
+
+// NewAddRequest returns an AddRequest. Attributes are sorted by type.
+func NewAddRequest(dn string, attributes map[string][]string, controls ...ldap.Control) *ldapserver.Message {
+	types := make([]string, 0, len(attributes))
+	for typ := range attributes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	p := application(ldap.TagAddRequest, "Add Request")
+	p.AppendChild(newOctetString(dn, "entry"))
+	attrs := sequence("attributes")
+	for _, typ := range types {
+		attrs.AppendChild(attribute(typ, attributes[typ]))
+	}
+	p.AppendChild(attrs)
+	return NewMessage(p, controls...)
+}
+
+// NewDeleteRequest returns a DelRequest.
+func NewDeleteRequest(dn string, controls ...ldap.Control) *ldapserver.Message {
+	p := ber.NewString(ber.ClassApplication, ber.TypePrimitive, ldap.TagDelRequest, dn, "Del Request")
+	return NewMessage(p, controls...)
+}
+
+// NewModifyRequest returns a ModifyRequest.
+func NewModifyRequest(dn string, changes []Change, controls ...ldap.Control) *ldapserver.Message {
+	p := application(ldap.TagModifyRequest, "Modify Request")
+	p.AppendChild(newOctetString(dn, "object"))
+	seq := sequence("changes")
+	for _, c := range changes {
+		change := sequence("change")
+		change.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, c.Operation, "operation"))
+		change.AppendChild(attribute(c.Type, c.Values))
+		seq.AppendChild(change)
+	}
+	p.AppendChild(seq)
+	return NewMessage(p, controls...)
+}
+
+// NewModifyDNRequest returns a ModifyDNRequest. newSuperior is omitted
+// when empty.
+func NewModifyDNRequest(dn, newRDN string, deleteOldRDN bool, newSuperior string, controls ...ldap.Control) *ldapserver.Message {
+	p := application(ldap.TagModifyDNRequest, "Modify DN Request")
+	p.AppendChild(newOctetString(dn, "entry"))
+	p.AppendChild(newOctetString(newRDN, "newrdn"))
+	p.AppendChild(ber.NewLDAPBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, deleteOldRDN, "deleteoldrdn"))
+	if newSuperior != "" {
+		p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, newSuperior, "newSuperior"))
+	}
+	return NewMessage(p, controls...)
+}
+
+// NewCompareRequest returns a CompareRequest.
+func NewCompareRequest(dn, attribute, value string, controls ...ldap.Control) *ldapserver.Message {
+	p := application(ldap.TagCompareRequest, "Compare Request")
+	p.AppendChild(newOctetString(dn, "entry"))
+	ava := sequence("ava")
+	ava.AppendChild(newOctetString(attribute, "attributeDesc"))
+	ava.AppendChild(newOctetString(value, "assertionValue"))
+	p.AppendChild(ava)
+	return NewMessage(p, controls...)
+}
+
+// NewExtendedRequest returns an ExtendedRequest. value is omitted when nil.
+func NewExtendedRequest(oid string, value []byte, controls ...ldap.Control) *ldapserver.Message {
+	p := application(ldap.TagExtendedRequest, "Extended Request")
+	p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, oid, "requestName"))
+	if value != nil {
+		p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(value), "requestValue"))
+	}
+	return NewMessage(p, controls...)
+}
+
+// NewAbandonRequest returns an AbandonRequest for the request messageID.
+func NewAbandonRequest(messageID int, controls ...ldap.Control) *ldapserver.Message {
+	p := ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, ldap.TagAbandonRequest, messageID, "Abandon Request")
+	return NewMessage(p, controls...)
+}
+
+// conn is the connection of the client of built messages. It has no peer:
+// reads return io.EOF and writes are discarded.
+type conn struct{}
+
+func newConn() net.Conn { return conn{} }
+
+func (conn) Read([]byte) (int, error)         { return 0, io.EOF }
+func (conn) Write(b []byte) (int, error)      { return len(b), nil }
+func (conn) Close() error                     { return nil }
+func (conn) LocalAddr() net.Addr              { return localAddr }
+func (conn) RemoteAddr() net.Addr             { return RemoteAddr }
+func (conn) SetDeadline(time.Time) error      { return nil }
+func (conn) SetReadDeadline(time.Time) error  { return nil }
+func (conn) SetWriteDeadline(time.Time) error { return nil }
+
+var localAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 389}
@@ -0,0 +1,150 @@
+// Package ldaptest provides utilities for testing LDAP handlers, in the
+// spirit of net/http/httptest:
+//
+//   - ResponseRecorder records what a handler writes,
+//   - NewBindRequest, NewSearchRequest, ... build the Message of a request.
+package ldaptest
+
+import (
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+
+	"github.com/vjeantet/ldapserver"
+	"github.com/vjeantet/ldapserver/internal/controls"
+)
+
+// Response is a protocol operation written to a ResponseRecorder, with
+// its controls.
+type Response struct {
+	ProtocolOp ldap.ProtocolOp
+	Controls   ldap.Controls
+}
+
+// ResponseRecorder is an ldapserver.ResponseWriter recording the responses
+// of a handler, for use in tests:
+//
+//	w := ldaptest.NewRecorder()
+//	handleSearch(w, ldaptest.NewSearchRequest("dc=example,dc=com", 2, "(uid=alice)", nil))
+//	entries := w.Entries()
+//	code, _ := w.ResultCode()
+//
+// Responses written with ldapserver.WriteWithControls keep their controls.
+type ResponseRecorder struct {
+	mutex     sync.Mutex
+	responses []Response
+}
+
+var _ controls.Writer = (*ResponseRecorder)(nil)
+
+// NewRecorder returns an empty ResponseRecorder.
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{}
+}
+
+// Write implements ldapserver.ResponseWriter.
+func (r *ResponseRecorder) Write(po ldap.ProtocolOp) {
+	r.WriteWithControls(po, nil)
+}
+
+// WriteWithControls records po with its controls. ldapserver.WriteWithControls
+// calls it.
+func (r *ResponseRecorder) WriteWithControls(po ldap.ProtocolOp, controls ldap.Controls) {
+	r.mutex.Lock()
+	r.responses = append(r.responses, Response{ProtocolOp: po, Controls: controls})
+	r.mutex.Unlock()
+}
+
+// Responses returns the responses written so far, in order.
+func (r *ResponseRecorder) Responses() []Response {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Response(nil), r.responses...)
+}
+
+// Entry is a decoded SearchResultEntry.
+type Entry struct {
+	DN         string
+	Attributes []Attribute
+}
+
+// Attribute is an attribute of an Entry.
+type Attribute struct {
+	Type   string
+	Values []string
+}
+
+// Values returns the values of the attribute name of e, compared without
+// regard to case, or nil if e has no such attribute.
+func (e Entry) Values(name string) []string {
+	for _, a := range e.Attributes {
+		if strings.EqualFold(a.Type, name) {
+			return a.Values
+		}
+	}
+	return nil
+}
+
+// Entries returns the SearchResultEntry responses written so far.
+func (r *ResponseRecorder) Entries() []Entry {
+	var entries []Entry
+	for _, res := range r.Responses() {
+		if e, ok := res.ProtocolOp.(ldap.SearchResultEntry); ok {
+			entries = append(entries, decodeEntry(e))
+		}
+	}
+	return entries
+}
+
+// decodeEntry decodes e, for which goldap has no accessors:
+//
+//	SearchResultEntry ::= [APPLICATION 4] SEQUENCE {
+//	     objectName      LDAPDN,
+//	     attributes      PartialAttributeList }
+func decodeEntry(e ldap.SearchResultEntry) Entry {
+	data, err := ldap.NewLDAPMessageWithProtocolOp(e).Write()
+	if err != nil {
+		return Entry{}
+	}
+	envelope, err := ber.DecodePacketErr(data.Bytes())
+	if err != nil || len(envelope.Children) < 2 || len(envelope.Children[1].Children) < 2 {
+		return Entry{}
+	}
+	p := envelope.Children[1]
+	entry := Entry{DN: octetString(p.Children[0])}
+	for _, a := range p.Children[1].Children {
+		if len(a.Children) < 2 {
+			continue
+		}
+		attr := Attribute{Type: octetString(a.Children[0])}
+		for _, v := range a.Children[1].Children {
+			attr.Values = append(attr.Values, octetString(v))
+		}
+		entry.Attributes = append(entry.Attributes, attr)
+	}
+	return entry
+}
+
+// Result returns the last response carrying an LDAPResult, such as a
+// BindResponse or a SearchResultDone. ok is false if none was written.
+func (r *ResponseRecorder) Result() (res Response, ok bool) {
+	responses := r.Responses()
+	for i := len(responses) - 1; i >= 0; i-- {
+		if _, ok := ldapserver.ResultCode(responses[i].ProtocolOp); ok {
+			return responses[i], true
+		}
+	}
+	return Response{}, false
+}
+
+// ResultCode returns the result code of Result. ok is false if no result
+// was written.
+func (r *ResponseRecorder) ResultCode() (code int, ok bool) {
+	res, ok := r.Result()
+	if !ok {
+		return 0, false
+	}
+	return ldapserver.ResultCode(res.ProtocolOp)
+}
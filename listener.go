@@ -0,0 +1,196 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// TLSMode is the TLS policy of a listener.
+type TLSMode int
+
+const (
+	// TLSNone serves plain LDAP; clients may upgrade with StartTLS.
+	TLSNone TLSMode = iota
+	// TLSImplicit serves LDAPS: connections start with a TLS handshake.
+	TLSImplicit
+	// TLSStartTLSRequired serves plain LDAP, but answers requests other
+	// than StartTLS and Abandon with confidentialityRequired (13) until the
+	// connection is upgraded with StartTLS.
+	TLSStartTLSRequired
+)
+
+func (m TLSMode) String() string {
+	switch m {
+	case TLSImplicit:
+		return "implicit"
+	case TLSStartTLSRequired:
+		return "starttls-required"
+	}
+	return "none"
+}
+
+// ListenerConfig is a listener of ListenAndServeAll.
+type ListenerConfig struct {
+	// Network is "tcp" (the default) or "unix", for LDAPI.
+	Network string
+	// Addr is the address to listen on: ":389" for TCP, or the path of
+	// the socket file for Unix domain sockets.
+	Addr string
+	// Mode is the TLS policy of the listener.
+	Mode TLSMode
+	// TLSConfig is the TLS configuration of TLSImplicit listeners. When
+	// nil, Server.TLSConfig is used.
+	TLSConfig *tls.Config
+}
+
+// serverListener is a listener the server accepts connections on.
+type serverListener struct {
+	net.Listener
+	mode TLSMode
+}
+
+// ServeListener accepts incoming LDAP connections on ln with the TLS
+// policy mode; TLSImplicit wraps ln with TLS using s.TLSConfig.
+// ServeListener may be called concurrently for several listeners: they
+// share the connection numbering, metrics and logs of the server, and Stop
+// closes all of them.
+func (s *Server) ServeListener(ln net.Listener, mode TLSMode) error {
+	return s.serveListener(&serverListener{Listener: s.wrapListener(ln, mode), mode: mode})
+}
+
+// wrapListener wraps ln with the PROXY protocol decoding of s and, for
+// TLSImplicit, with TLS.
+func (s *Server) wrapListener(ln net.Listener, mode TLSMode) net.Listener {
+	ln = s.proxyProtocolListener(ln)
+	if mode == TLSImplicit {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+	return ln
+}
+
+// ListenAndServeAll listens on all the listeners, and then serves
+// incoming connections on each of them until Stop is called:
+//
+//	server.ListenAndServeAll(
+//		ldap.ListenerConfig{Addr: ":389", Mode: ldap.TLSStartTLSRequired},
+//		ldap.ListenerConfig{Addr: ":636", Mode: ldap.TLSImplicit},
+//		ldap.ListenerConfig{Network: "unix", Addr: "/run/ldapi"},
+//	)
+//
+// No connection is served if one of the listeners cannot be created. The
+// error returned is the first error of the listeners.
+func (s *Server) ListenAndServeAll(listeners ...ListenerConfig) error {
+	if len(listeners) == 0 {
+		return errors.New("ldap: no listener")
+	}
+	lns := make([]*serverListener, 0, len(listeners))
+	for _, config := range listeners {
+		ln, err := s.listen(config)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		s.log().Info("listening", "addr", config.Addr, "tls", config.Mode.String())
+		lns = append(lns, ln)
+	}
+
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() {
+			errs <- s.serveListener(ln)
+		}()
+	}
+	var first error
+	for range lns {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// listen creates the listener of config.
+func (s *Server) listen(config ListenerConfig) (*serverListener, error) {
+	var ln net.Listener
+	var err error
+	switch config.Network {
+	case "", "tcp":
+		ln, err = net.Listen("tcp", config.Addr)
+		if err == nil {
+			ln = s.proxyProtocolListener(ln)
+		}
+	case "unix":
+		ln, err = ListenUnix(config.Addr)
+	default:
+		err = errors.New("ldap: unsupported network " + config.Network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.Mode == TLSImplicit {
+		tlsConfig := config.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = s.TLSConfig
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return &serverListener{Listener: ln, mode: config.Mode}, nil
+}
+
+// addListener registers ln, to be closed by Stop. It returns false if the
+// server is already stopped.
+func (s *Server) addListener(ln *serverListener) bool {
+	s.listenersMutex.Lock()
+	defer s.listenersMutex.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	s.listeners = append(s.listeners, ln)
+	s.accepting.Add(1)
+	return true
+}
+
+// closeListeners closes the listeners of the server, and prevents new ones
+// from being served.
+func (s *Server) closeListeners() {
+	s.listenersMutex.Lock()
+	s.stopped = true
+	listeners := s.listeners
+	s.listenersMutex.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// requiresTLS reports whether the request message must be refused with
+// confidentialityRequired because the connection is not protected by TLS
+// yet, on a TLSStartTLSRequired listener. TLS terminated by a load balancer
+// sending a PROXY protocol header counts as TLS.
+func (c *client) requiresTLS(message *ldap.LDAPMessage) bool {
+	if c.tlsMode != TLSStartTLSRequired {
+		return false
+	}
+	if _, ok := c.TLSConnectionState(); ok {
+		return false
+	}
+	if header, ok := c.ProxyHeader(); ok && header.TLS != nil {
+		return false // TLS terminated by the load balancer
+	}
+	switch r := message.ProtocolOp().(type) {
+	case ldap.AbandonRequest:
+		return false
+	case ldap.ExtendedRequest:
+		return r.RequestName() != NoticeOfStartTLS
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func TestE2E_MultipleListeners(t *testing.T) {
+	ca, serverCert, _ := testPKI(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	clientTLS := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+
+	conns := make(chan int, 10)
+	routes := NewRouteMux()
+	routes.Extended(NewStartTLSHandler(nil)).RequestName(NoticeOfStartTLS)
+	routes.Bind(func(w ResponseWriter, m *Message) {
+		conns <- m.Client.Numero
+		w.Write(NewBindResponse(LDAPResultSuccess))
+	})
+	server := NewServer()
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.Handle(routes)
+
+	dir := t.TempDir()
+	plain, required := filepath.Join(dir, "plain"), filepath.Join(dir, "required")
+	served := make(chan error, 2)
+	go func() {
+		served <- server.ListenAndServeAll(
+			ListenerConfig{Network: "unix", Addr: plain},
+			ListenerConfig{Network: "unix", Addr: required, Mode: TLSStartTLSRequired},
+		)
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		served <- server.ServeListener(ln, TLSImplicit)
+	}()
+
+	dial := func(url string, options ...goldap.DialOpt) *goldap.Conn {
+		t.Helper()
+		var conn *goldap.Conn
+		var err error
+		for range 50 {
+			if conn, err = goldap.DialURL(url, options...); err == nil {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("dial %s: %v", url, err)
+		return nil
+	}
+
+	conn := dial("ldapi://" + plain)
+	defer conn.Close()
+	if err := conn.Bind("cn=test", "secret"); err != nil {
+		t.Errorf("bind on plain listener: %v", err)
+	}
+
+	conn = dial("ldaps://"+ln.Addr().String(), goldap.DialWithTLSConfig(clientTLS))
+	defer conn.Close()
+	if err := conn.Bind("cn=test", "secret"); err != nil {
+		t.Errorf("bind on LDAPS listener: %v", err)
+	}
+
+	conn = dial("ldapi://" + required)
+	defer conn.Close()
+	err = conn.Bind("cn=test", "secret")
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultConfidentialityRequired) {
+		t.Errorf("expected confidentialityRequired before StartTLS, got %v", err)
+	}
+	if err := conn.StartTLS(clientTLS); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	if err := conn.Bind("cn=test", "secret"); err != nil {
+		t.Errorf("bind after StartTLS: %v", err)
+	}
+
+	// Connections are numbered across listeners.
+	numbers := []int{<-conns, <-conns, <-conns}
+	sort.Ints(numbers)
+	if fmt.Sprint(numbers) != "[1 2 3]" {
+		t.Errorf("connection numbers = %v", numbers)
+	}
+
+	server.Stop()
+	for range 2 {
+		if err := <-served; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("LDAPS listener still open after Stop")
+	}
+	if _, err := net.Dial("unix", plain); err == nil {
+		t.Error("LDAPI listener still open after Stop")
+	}
+}
+
+func TestListenAndServeAll_Error(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	path := filepath.Join(t.TempDir(), "ldapi")
+
+	server := NewServer()
+	server.Handle(NewRouteMux())
+	err = server.ListenAndServeAll(
+		ListenerConfig{Network: "unix", Addr: path},
+		ListenerConfig{Addr: ln.Addr().String()}, // in use
+	)
+	if err == nil {
+		t.Fatal("expected an error for an address in use")
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Error("listener created before the error was not closed")
+	}
+}
@@ -1,11 +1,19 @@
 package ldapserver
 
 import (
+	"context"
+	"encoding/hex"
 	"io/ioutil"
 	"log"
-	"os"
+	"log/slog"
+	"strings"
+	"sync/atomic"
 )
 
+// Logger receives the server logs when Server.Log is nil. It discards
+// them by default. A Server reads it once, when it starts serving.
+//
+// Deprecated: set Server.Log to a *slog.Logger instead.
 var Logger logger
 
 // Logger represents log.Logger functions from the standard library
@@ -24,10 +32,79 @@ type logger interface {
 }
 
 func init() {
-	Logger = log.New(os.Stdout, "", log.LstdFlags)
+	Logger = DiscardingLogger
 }
 
 var (
 	// DiscardingLogger can be used to disable logging output
 	DiscardingLogger = log.New(ioutil.Discard, "", 0)
 )
+
+// newLegacyLogger returns a logger sending records at info level and above
+// to l, unless it is DiscardingLogger.
+func newLegacyLogger(l logger) *slog.Logger {
+	return slog.New(legacyLogHandler{
+		Handler: slog.NewTextHandler(legacyLogWriter{l}, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// Logger adds its own timestamp.
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+		enabled: l != nil && l != logger(DiscardingLogger),
+	})
+}
+
+// legacyLog returns the logger of the package Logger stored in p, storing
+// it on first use. Servers capture Logger once, so that changing it does
+// not race with servers running.
+func legacyLog(p *atomic.Pointer[slog.Logger]) *slog.Logger {
+	if l := p.Load(); l != nil {
+		return l
+	}
+	p.CompareAndSwap(nil, newLegacyLogger(Logger))
+	return p.Load()
+}
+
+type legacyLogHandler struct {
+	slog.Handler
+	enabled bool
+}
+
+func (h legacyLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.enabled && h.Handler.Enabled(ctx, level)
+}
+
+func (h legacyLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return legacyLogHandler{h.Handler.WithAttrs(attrs), h.enabled}
+}
+
+func (h legacyLogHandler) WithGroup(name string) slog.Handler {
+	return legacyLogHandler{h.Handler.WithGroup(name), h.enabled}
+}
+
+type legacyLogWriter struct {
+	l logger
+}
+
+func (w legacyLogWriter) Write(p []byte) (int, error) {
+	w.l.Print(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// log returns the logger of s.
+func (s *Server) log() *slog.Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return legacyLog(&s.legacy)
+}
+
+// hexDump formats a PDU for debug logs, only when they are enabled.
+type hexDump []byte
+
+func (h hexDump) LogValue() slog.Value {
+	return slog.StringValue(hex.EncodeToString(h))
+}
@@ -0,0 +1,122 @@
+package ldapserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// startLoggingServer starts a server routing Bind and Search requests, configured
+// by configure, and returns its address and a function stopping it.
+func startLoggingServer(t *testing.T, configure func(*Server)) (string, func()) {
+	t.Helper()
+	routes := NewRouteMux()
+	routes.Bind(handleBindTest).Label("bind")
+	routes.Search(handleSearchTest)
+	return serveTest(t, nil, routes, configure)
+}
+
+// logRecords decodes JSON log lines.
+func logRecords(t *testing.T, out string) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var r map[string]any
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestServerLog(t *testing.T) {
+	var out syncBuffer
+	addr, stop := startLoggingServer(t, func(s *Server) {
+		s.Log = slog.New(slog.NewJSONHandler(&out, nil))
+	})
+
+	conn := dialAndBind(t, addr)
+	conn.Close()
+	stop()
+
+	var operation map[string]any
+	for _, r := range logRecords(t, out.String()) {
+		if _, ok := r["hex"]; ok {
+			t.Fatalf("unexpected PDU dump at info level: %v", r)
+		}
+		if r["msg"] == "operation" {
+			operation = r
+		}
+	}
+	if operation == nil {
+		t.Fatalf("no operation logged in %s", out.String())
+	}
+	if operation["conn"] == nil || operation["remote"] == nil || operation["duration"] == nil {
+		t.Fatalf("missing connection attributes: %v", operation)
+	}
+	if operation["op"] != "BindRequest" || operation["msgid"] != float64(1) || operation["result"] != float64(LDAPResultSuccess) {
+		t.Fatalf("unexpected operation attributes: %v", operation)
+	}
+}
+
+func TestServerLog_DebugPDU(t *testing.T) {
+	var out syncBuffer
+	addr, stop := startLoggingServer(t, func(s *Server) {
+		s.Log = slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	})
+
+	conn := dialAndBind(t, addr)
+	conn.Close()
+	stop()
+
+	seen := map[string]bool{}
+	for _, r := range logRecords(t, out.String()) {
+		if hex, ok := r["hex"].(string); ok && hex != "" {
+			seen[r["msg"].(string)] = true
+		}
+		if r["msg"] == "route matched" && r["route"] != "bind" {
+			t.Fatalf("unexpected route label: %v", r)
+		}
+	}
+	if !seen["received"] || !seen["sent"] {
+		t.Fatalf("expected PDU dumps of received and sent messages, got %s", out.String())
+	}
+}
+
+func TestServerLog_LegacyLogger(t *testing.T) {
+	var out syncBuffer
+	Logger = log.New(&out, "", 0)
+	defer func() { Logger = DiscardingLogger }()
+
+	addr, stop := startLoggingServer(t, func(s *Server) {})
+	conn := dialAndBind(t, addr)
+	conn.Close()
+	stop()
+
+	if !strings.Contains(out.String(), "msg=operation") || strings.Contains(out.String(), "hex=") {
+		t.Fatalf("unexpected legacy log output: %s", out.String())
+	}
+}
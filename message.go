@@ -1,7 +1,9 @@
 package ldapserver
 
 import (
+	"context"
 	"fmt"
+	"net"
 
 	ldap "github.com/vjeantet/goldap/message"
 )
@@ -10,6 +12,41 @@ type Message struct {
 	*ldap.LDAPMessage
 	Client *client
 	Done   chan bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Context returns the context of the request. It is cancelled when the
+// request is abandoned or cancelled, when the connection closes and once
+// the handler returns. It carries the span started by the Tracer of the
+// server, if any.
+func (m *Message) Context() context.Context {
+	if m.ctx != nil {
+		return m.ctx
+	}
+	return context.Background()
+}
+
+// NewMessage returns a Message for the request message, as received on
+// conn by a client of a server that is not running. It lets handlers be
+// called outside of a server; see the ldaptest package.
+func NewMessage(message *ldap.LDAPMessage, conn net.Conn) *Message {
+	srv := NewServer()
+	c := &client{
+		srv:         srv,
+		rwc:         conn,
+		requestList: make(map[int]*Message),
+		log:         srv.log(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Message{
+		LDAPMessage: message,
+		Done:        make(chan bool, 2),
+		Client:      c,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
 }
 
 func (m *Message) String() string {
@@ -17,8 +54,11 @@ func (m *Message) String() string {
 }
 
 // Abandon close the Done channel, to notify handler's user function to stop any
-// running process
+// running process, and cancels the context of the request.
 func (m *Message) Abandon() {
+	if m.cancel != nil {
+		m.cancel()
+	}
 	m.Done <- true
 }
 
@@ -46,6 +86,10 @@ func (m *Message) GetModifyRequest() ldap.ModifyRequest {
 	return m.ProtocolOp().(ldap.ModifyRequest)
 }
 
+func (m *Message) GetModifyDNRequest() ldap.ModifyDNRequest {
+	return m.ProtocolOp().(ldap.ModifyDNRequest)
+}
+
 func (m *Message) GetCompareRequest() ldap.CompareRequest {
 	return m.ProtocolOp().(ldap.CompareRequest)
 }
@@ -0,0 +1,280 @@
+package ldapserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// MetricsCollector receives the events of a Server. Set Server.Metrics to
+// an implementation, such as the one returned by NewMetrics or an adapter
+// to a metrics library.
+//
+// Methods are called concurrently from the goroutines serving connections
+// and must not block.
+type MetricsCollector interface {
+	// ConnectionOpened is called when a connection is accepted.
+	ConnectionOpened()
+	// ConnectionRejected is called when OnNewConnection refuses a
+	// connection, before ConnectionClosed.
+	ConnectionRejected()
+	// ConnectionClosed is called once a connection is closed.
+	ConnectionClosed()
+	// OperationDone is called when a request has been processed. op is the
+	// operation name (see OperationName) and resultCode is -1 when no
+	// result was sent, as for Abandon and Unbind requests.
+	OperationDone(op string, resultCode int, duration time.Duration)
+	// SearchEntries is called with the number of entries returned by a
+	// search.
+	SearchEntries(n int)
+	// BytesReceived and BytesSent are called for each LDAP message read
+	// from or written to a connection.
+	BytesReceived(n int)
+	BytesSent(n int)
+	// AbandonRequested and CancelRequested are called for each Abandon
+	// request and Cancel extended request received.
+	AbandonRequested()
+	CancelRequested()
+}
+
+// OperationName returns the short name of the operation of a request:
+// "bind", "unbind", "search", "modify", "add", "delete", "modifydn",
+// "compare", "abandon" or "extended".
+func OperationName(po ldap.ProtocolOp) string {
+	switch po.(type) {
+	case ldap.BindRequest:
+		return "bind"
+	case ldap.UnbindRequest:
+		return "unbind"
+	case ldap.SearchRequest:
+		return "search"
+	case ldap.ModifyRequest:
+		return "modify"
+	case ldap.AddRequest:
+		return "add"
+	case ldap.DelRequest:
+		return "delete"
+	case ldap.ModifyDNRequest:
+		return "modifydn"
+	case ldap.CompareRequest:
+		return "compare"
+	case ldap.AbandonRequest:
+		return "abandon"
+	case ldap.ExtendedRequest:
+		return "extended"
+	}
+	return "unknown"
+}
+
+// metrics returns the collector of s.
+func (s *Server) metrics() MetricsCollector {
+	if s.Metrics != nil {
+		return s.Metrics
+	}
+	return nopMetrics{}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ConnectionOpened()                        {}
+func (nopMetrics) ConnectionRejected()                      {}
+func (nopMetrics) ConnectionClosed()                        {}
+func (nopMetrics) OperationDone(string, int, time.Duration) {}
+func (nopMetrics) SearchEntries(int)                        {}
+func (nopMetrics) BytesReceived(int)                        {}
+func (nopMetrics) BytesSent(int)                            {}
+func (nopMetrics) AbandonRequested()                        {}
+func (nopMetrics) CancelRequested()                         {}
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the operation
+// latency histogram buckets used by NewMetrics.
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics is a MetricsCollector keeping the metrics in memory. It is an
+// http.Handler serving them in the Prometheus text exposition format:
+//
+//	metrics := ldap.NewMetrics()
+//	server.Metrics = metrics
+//	http.Handle("/metrics", metrics)
+type Metrics struct {
+	mutex           sync.Mutex
+	buckets         []float64
+	active          int64
+	accepted        uint64
+	rejected        uint64
+	operations      map[operationKey]uint64
+	latencies       map[string]*histogram
+	searchEntries   uint64
+	bytesReceived   uint64
+	bytesSent       uint64
+	abandonRequests uint64
+	cancelRequests  uint64
+}
+
+type operationKey struct {
+	op     string
+	result int
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics returns an empty Metrics using DefaultLatencyBuckets.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		buckets:    DefaultLatencyBuckets,
+		operations: make(map[operationKey]uint64),
+		latencies:  make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) ConnectionOpened() {
+	m.mutex.Lock()
+	m.active++
+	m.accepted++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) ConnectionRejected() {
+	m.mutex.Lock()
+	m.rejected++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) ConnectionClosed() {
+	m.mutex.Lock()
+	m.active--
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) OperationDone(op string, resultCode int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.operations[operationKey{op, resultCode}]++
+	h, ok := m.latencies[op]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latencies[op] = h
+	}
+	seconds := duration.Seconds()
+	if i := sort.SearchFloat64s(m.buckets, seconds); i < len(m.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *Metrics) SearchEntries(n int) {
+	m.mutex.Lock()
+	m.searchEntries += uint64(n)
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) BytesReceived(n int) {
+	m.mutex.Lock()
+	m.bytesReceived += uint64(n)
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) BytesSent(n int) {
+	m.mutex.Lock()
+	m.bytesSent += uint64(n)
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) AbandonRequested() {
+	m.mutex.Lock()
+	m.abandonRequests++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) CancelRequested() {
+	m.mutex.Lock()
+	m.cancelRequests++
+	m.mutex.Unlock()
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var b strings.Builder
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("ldap_connections_active", "gauge", "Number of open connections.")
+	fmt.Fprintf(&b, "ldap_connections_active %d\n", m.active)
+	metric("ldap_connections_accepted_total", "counter", "Number of accepted connections.")
+	fmt.Fprintf(&b, "ldap_connections_accepted_total %d\n", m.accepted)
+	metric("ldap_connections_rejected_total", "counter", "Number of connections refused by OnNewConnection.")
+	fmt.Fprintf(&b, "ldap_connections_rejected_total %d\n", m.rejected)
+
+	metric("ldap_operations_total", "counter", "Number of processed requests by operation and result code.")
+	keys := make([]operationKey, 0, len(m.operations))
+	for k := range m.operations {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].result < keys[j].result
+	})
+	for _, k := range keys {
+		result := "none"
+		if k.result >= 0 {
+			result = strconv.Itoa(k.result)
+		}
+		fmt.Fprintf(&b, "ldap_operations_total{op=%q,result=%q} %d\n", k.op, result, m.operations[k])
+	}
+
+	metric("ldap_operation_duration_seconds", "histogram", "Time taken to process requests by operation.")
+	ops := make([]string, 0, len(m.latencies))
+	for op := range m.latencies {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		h := m.latencies[op]
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "ldap_operation_duration_seconds_bucket{op=%q,le=%q} %d\n", op, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "ldap_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(&b, "ldap_operation_duration_seconds_sum{op=%q} %s\n", op, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "ldap_operation_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+
+	metric("ldap_search_entries_total", "counter", "Number of entries returned by searches.")
+	fmt.Fprintf(&b, "ldap_search_entries_total %d\n", m.searchEntries)
+	metric("ldap_received_bytes_total", "counter", "Number of bytes of LDAP messages received.")
+	fmt.Fprintf(&b, "ldap_received_bytes_total %d\n", m.bytesReceived)
+	metric("ldap_sent_bytes_total", "counter", "Number of bytes of LDAP messages sent.")
+	fmt.Fprintf(&b, "ldap_sent_bytes_total %d\n", m.bytesSent)
+	metric("ldap_abandon_requests_total", "counter", "Number of Abandon requests received.")
+	fmt.Fprintf(&b, "ldap_abandon_requests_total %d\n", m.abandonRequests)
+	metric("ldap_cancel_requests_total", "counter", "Number of Cancel extended requests received.")
+	fmt.Fprintf(&b, "ldap_cancel_requests_total %d\n", m.cancelRequests)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,118 @@
+package ldapserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := NewMetrics()
+	m.ConnectionOpened()
+	m.ConnectionOpened()
+	m.ConnectionClosed()
+	m.ConnectionRejected()
+	m.OperationDone("bind", 0, 2*time.Millisecond)
+	m.OperationDone("bind", 49, 20*time.Millisecond)
+	m.OperationDone("abandon", -1, 0)
+	m.SearchEntries(3)
+	m.BytesReceived(10)
+	m.BytesSent(20)
+	m.CancelRequested()
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE ldap_connections_active gauge\nldap_connections_active 1\n",
+		"ldap_connections_accepted_total 2\n",
+		"ldap_connections_rejected_total 1\n",
+		`ldap_operations_total{op="abandon",result="none"} 1` + "\n",
+		`ldap_operations_total{op="bind",result="0"} 1` + "\n",
+		`ldap_operations_total{op="bind",result="49"} 1` + "\n",
+		"# TYPE ldap_operation_duration_seconds histogram\n",
+		`ldap_operation_duration_seconds_bucket{op="bind",le="0.001"} 0` + "\n",
+		`ldap_operation_duration_seconds_bucket{op="bind",le="0.0025"} 1` + "\n",
+		`ldap_operation_duration_seconds_bucket{op="bind",le="0.025"} 2` + "\n",
+		`ldap_operation_duration_seconds_bucket{op="bind",le="+Inf"} 2` + "\n",
+		`ldap_operation_duration_seconds_sum{op="bind"} 0.022` + "\n",
+		`ldap_operation_duration_seconds_count{op="bind"} 2` + "\n",
+		"ldap_search_entries_total 3\n",
+		"ldap_received_bytes_total 10\n",
+		"ldap_sent_bytes_total 20\n",
+		"ldap_abandon_requests_total 0\n",
+		"ldap_cancel_requests_total 1\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestE2E_Metrics(t *testing.T) {
+	metrics := NewMetrics()
+	var rejectNext atomic.Bool
+	addr, stop := startLoggingServer(t, func(s *Server) {
+		s.Metrics = metrics
+		s.OnNewConnection = func(c net.Conn) error {
+			if rejectNext.Load() {
+				return errors.New("backend down")
+			}
+			return nil
+		}
+	})
+
+	conn := dialAndBind(t, addr)
+	if _, err := conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, nil)); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	conn.Extended(goldap.NewExtendedRequest(string(NoticeOfCancel), buildCancelValue(9999)))
+	conn.Close()
+
+	rejectNext.Store(true)
+	if rejected, err := net.Dial("tcp", addr); err == nil {
+		// Wait for the server to close the connection.
+		notice, _ := io.ReadAll(rejected)
+		rejected.Close()
+		// Only a *ResultError is sent to the client.
+		if !bytes.Contains(notice, []byte("connection rejected")) || bytes.Contains(notice, []byte("backend down")) {
+			t.Errorf("unexpected notice %q", notice)
+		}
+	}
+	stop()
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"ldap_connections_active 0\n",
+		"ldap_connections_accepted_total 2\n",
+		"ldap_connections_rejected_total 1\n",
+		`ldap_operations_total{op="bind",result="0"} 1` + "\n",
+		`ldap_operations_total{op="extended",result="119"} 1` + "\n",
+		`ldap_operations_total{op="search",result="0"} 1` + "\n",
+		`ldap_operation_duration_seconds_count{op="search"} 1` + "\n",
+		"ldap_search_entries_total 2\n",
+		"ldap_cancel_requests_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "ldap_received_bytes_total 0\n") || strings.Contains(body, "ldap_sent_bytes_total 0\n") {
+		t.Errorf("expected bytes to be counted:\n%s", body)
+	}
+}
@@ -0,0 +1,455 @@
+package ldapserver
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// Monitor is a read-only Handler publishing the state of a server as a
+// cn=Monitor subtree, in the style of the OpenLDAP monitor backend:
+//
+//	cn=Monitor                          version of the server
+//	cn=Version,cn=Monitor               versions of ldapserver and Go
+//	cn=Start|Current|Uptime,cn=Time,cn=Monitor
+//	cn=Goroutines,cn=Monitor            number of goroutines
+//	cn=Total|Current,cn=Connections,cn=Monitor
+//	cn=Connection <id>,cn=Connections,cn=Monitor
+//	cn=<Operation>,cn=Operations,cn=Monitor
+//	cn=Listener <n>,cn=Listeners,cn=Monitor
+//	cn=Route <n>,cn=Routes,cn=Monitor   hits of the routes of a RouteMux
+//
+// Mount it on the searches under cn=Monitor, restricted to administrators:
+//
+//	monitor := ldap.NewMonitor(server).RouteMux(routes)
+//	monitor.Authorize = func(m *ldap.Message) bool {
+//		return m.Client.AuthzID() == "dn:cn=admin,dc=example,dc=com"
+//	}
+//	routes.Search(monitor.ServeLDAP).Suffix("cn=Monitor")
+//
+// The entries are computed for each search. Requests other than searches
+// fail with unwillingToPerform (53).
+type Monitor struct {
+	server *Server
+	routes *RouteMux
+
+	// Authorize reports whether the client of m may read the monitor, which
+	// shows the address and identity of every client. When nil, every
+	// client is refused. Refused requests fail with
+	// insufficientAccessRights (50).
+	Authorize func(m *Message) bool
+}
+
+// NewMonitor returns a Monitor of server.
+func NewMonitor(server *Server) *Monitor {
+	return &Monitor{server: server}
+}
+
+// RouteMux adds the hits of the routes of mux to the monitor.
+func (mon *Monitor) RouteMux(mux *RouteMux) *Monitor {
+	mon.routes = mux
+	return mon
+}
+
+// ServeLDAP answers the searches of the monitor entries.
+func (mon *Monitor) ServeLDAP(w ResponseWriter, m *Message) {
+	if !mon.authorized(m) {
+		if res := newErrorResponse(m.ProtocolOp(), LDAPResultInsufficientAccessRights, "access to the monitor denied"); res != nil {
+			w.Write(res)
+		}
+		return
+	}
+	r, ok := m.ProtocolOp().(ldap.SearchRequest)
+	if !ok {
+		if res := newErrorResponse(m.ProtocolOp(), LDAPResultUnwillingToPerform, "the monitor is read-only"); res != nil {
+			w.Write(res)
+		}
+		return
+	}
+
+	base := normalizeRDNs(splitDN(string(r.BaseObject())))
+	entries := mon.entries()
+	found := false
+	sent := 0
+	for _, e := range entries {
+		rdns := normalizeRDNs(splitDN(e.dn))
+		if equalRDNs(rdns, base) {
+			found = true
+		}
+		if !withinSuffix(rdns, base) {
+			continue
+		}
+		switch {
+		case r.Scope() == SearchRequestScopeBaseObject && len(rdns) != len(base),
+			r.Scope() == SearchRequestSingleLevel && len(rdns) != len(base)+1:
+			continue
+		}
+		if !e.match(r.Filter()) {
+			continue
+		}
+		select {
+		case <-m.Done:
+			return
+		default:
+		}
+		if limit := int(r.SizeLimit()); limit > 0 && sent == limit {
+			w.Write(NewSearchResultDoneResponse(LDAPResultSizeLimitExceeded))
+			return
+		}
+		w.Write(e.searchResultEntry(r.Attributes()))
+		sent++
+	}
+	if !found {
+		w.Write(NewSearchResultDoneResponse(LDAPResultNoSuchObject))
+		return
+	}
+	w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+}
+
+func (mon *Monitor) authorized(m *Message) bool {
+	return mon.Authorize != nil && mon.Authorize(m)
+}
+
+// monitorEntry is an entry of the monitor.
+type monitorEntry struct {
+	dn    string
+	attrs []monitorAttribute
+}
+
+type monitorAttribute struct {
+	name   string
+	values []string
+}
+
+func newMonitorEntry(dn string, objectClass string) *monitorEntry {
+	rdn := splitDN(dn)[0]
+	return &monitorEntry{dn: dn, attrs: []monitorAttribute{
+		{name: "objectClass", values: []string{"top", objectClass}},
+		{name: "cn", values: []string{rdn[strings.Index(rdn, "=")+1:]}},
+	}}
+}
+
+func (e *monitorEntry) add(name string, values ...string) *monitorEntry {
+	e.attrs = append(e.attrs, monitorAttribute{name: name, values: values})
+	return e
+}
+
+func (e *monitorEntry) counter(name string, n int64) *monitorEntry {
+	return e.add(name, strconv.FormatInt(n, 10))
+}
+
+// entries returns the entries of the monitor, parents first.
+func (mon *Monitor) entries() []*monitorEntry {
+	s := mon.server
+	now := time.Now()
+	version := ldapserverVersion()
+	entries := []*monitorEntry{
+		newMonitorEntry("cn=Monitor", "monitorServer").add("monitoredInfo", "ldapserver "+version),
+		newMonitorEntry("cn=Version,cn=Monitor", "monitoredObject").
+			add("monitoredInfo", "ldapserver "+version, runtime.Version()),
+		newMonitorEntry("cn=Time,cn=Monitor", "monitorContainer"),
+	}
+
+	s.listenersMutex.Lock()
+	started := s.started
+	listeners := append([]*serverListener(nil), s.listeners...)
+	s.listenersMutex.Unlock()
+	if !started.IsZero() {
+		entries = append(entries,
+			newMonitorEntry("cn=Start,cn=Time,cn=Monitor", "monitoredObject").add("monitorTimestamp", generalizedTime(started)))
+	}
+	entries = append(entries,
+		newMonitorEntry("cn=Current,cn=Time,cn=Monitor", "monitoredObject").add("monitorTimestamp", generalizedTime(now)))
+	if !started.IsZero() {
+		entries = append(entries,
+			newMonitorEntry("cn=Uptime,cn=Time,cn=Monitor", "monitoredObject").
+				add("monitoredInfo", strconv.Itoa(int(now.Sub(started).Seconds()))))
+	}
+	entries = append(entries,
+		newMonitorEntry("cn=Goroutines,cn=Monitor", "monitorCounterObject").
+			counter("monitorCounter", int64(runtime.NumGoroutine())))
+
+	conns := s.Connections()
+	entries = append(entries,
+		newMonitorEntry("cn=Connections,cn=Monitor", "monitorContainer"),
+		newMonitorEntry("cn=Total,cn=Connections,cn=Monitor", "monitorCounterObject").
+			counter("monitorCounter", s.connections.Load()),
+		newMonitorEntry("cn=Current,cn=Connections,cn=Monitor", "monitorCounterObject").
+			counter("monitorCounter", int64(len(conns))),
+	)
+	for _, c := range conns {
+		e := newMonitorEntry(fmt.Sprintf("cn=Connection %d,cn=Connections,cn=Monitor", c.ID), "monitorConnection").
+			counter("monitorConnectionNumber", int64(c.ID)).
+			add("monitorConnectionPeerAddress", c.RemoteAddr.String()).
+			add("monitorConnectionLocalAddress", c.LocalAddr.String()).
+			add("monitorConnectionStartTime", generalizedTime(c.Opened)).
+			counter("monitorConnectionOpsReceived", int64(c.Operations)).
+			counter("monitorConnectionOpsPending", int64(c.InProgress)).
+			counter("monitorConnectionBytesReceived", c.BytesReceived).
+			counter("monitorConnectionBytesSent", c.BytesSent)
+		if c.AuthzID != "" {
+			e.add("monitorConnectionAuthzDN", c.AuthzID)
+		}
+		if c.TLS {
+			e.add("monitorConnectionTLS", c.TLSVersion+" "+c.CipherSuite)
+		}
+		entries = append(entries, e)
+	}
+
+	initiated, completed := s.operations.snapshot()
+	var totalInitiated, totalCompleted int64
+	for _, n := range initiated {
+		totalInitiated += n
+	}
+	for _, n := range completed {
+		totalCompleted += n
+	}
+	entries = append(entries, newMonitorEntry("cn=Operations,cn=Monitor", "monitorOperation").
+		counter("monitorOpInitiated", totalInitiated).
+		counter("monitorOpCompleted", totalCompleted))
+	for _, op := range monitorOperations {
+		entries = append(entries,
+			newMonitorEntry("cn="+op.rdn+",cn=Operations,cn=Monitor", "monitorOperation").
+				counter("monitorOpInitiated", initiated[op.name]).
+				counter("monitorOpCompleted", completed[op.name]))
+	}
+
+	entries = append(entries, newMonitorEntry("cn=Listeners,cn=Monitor", "monitorContainer"))
+	for i, ln := range listeners {
+		entries = append(entries,
+			newMonitorEntry(fmt.Sprintf("cn=Listener %d,cn=Listeners,cn=Monitor", i), "monitoredObject").
+				add("labeledURI", listenerURL(ln)).
+				add("description", "tls="+ln.mode.String()))
+	}
+
+	if mon.routes != nil {
+		entries = append(entries, newMonitorEntry("cn=Routes,cn=Monitor", "monitorContainer"))
+		for i, r := range mon.routes.Stats() {
+			e := newMonitorEntry(fmt.Sprintf("cn=Route %d,cn=Routes,cn=Monitor", i), "monitorCounterObject").
+				add("monitoredInfo", r.Operation).
+				counter("monitorCounter", r.Hits)
+			if r.Label != "" {
+				e.add("description", r.Label)
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// monitorOperations are the entries of cn=Operations,cn=Monitor, named as
+// in OpenLDAP, for each OperationName.
+var monitorOperations = []struct{ rdn, name string }{
+	{"Bind", "bind"},
+	{"Unbind", "unbind"},
+	{"Search", "search"},
+	{"Compare", "compare"},
+	{"Modify", "modify"},
+	{"Modrdn", "modifydn"},
+	{"Add", "add"},
+	{"Delete", "delete"},
+	{"Abandon", "abandon"},
+	{"Extended", "extended"},
+}
+
+// listenerURL returns the LDAP URL of ln.
+func listenerURL(ln *serverListener) string {
+	addr := ln.Addr()
+	switch {
+	case addr.Network() == "unix":
+		return "ldapi://" + url.PathEscape(addr.String())
+	case ln.mode == TLSImplicit:
+		return "ldaps://" + addr.String()
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		return "ldap://:" + strconv.Itoa(tcp.Port)
+	}
+	return "ldap://" + addr.String()
+}
+
+func generalizedTime(t time.Time) string {
+	return t.UTC().Format("20060102150405Z")
+}
+
+// ldapserverVersion returns the version of this module in the binary.
+func ldapserverVersion() string {
+	const path = "github.com/vjeantet/ldapserver"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+	if info.Main.Path == path {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			return dep.Version
+		}
+	}
+	return "(unknown)"
+}
+
+// searchResultEntry returns the entry with the attributes selected by
+// attributes.
+func (e *monitorEntry) searchResultEntry(attributes ldap.AttributeSelection) ldap.SearchResultEntry {
+	all := len(attributes) == 0
+	selected := make(map[string]bool, len(attributes))
+	for _, a := range attributes {
+		if a == "*" || a == "+" {
+			all = true
+		}
+		selected[strings.ToLower(string(a))] = true
+	}
+	res := NewSearchResultEntry(e.dn)
+	for _, a := range e.attrs {
+		if !all && !selected[strings.ToLower(a.name)] {
+			continue
+		}
+		values := make([]ldap.AttributeValue, len(a.values))
+		for i, v := range a.values {
+			values[i] = ldap.AttributeValue(v)
+		}
+		res.AddAttribute(ldap.AttributeDescription(a.name), values...)
+	}
+	return res
+}
+
+// values returns the values of the attribute name of the entry.
+func (e *monitorEntry) values(name ldap.AttributeDescription) []string {
+	for _, a := range e.attrs {
+		if strings.EqualFold(a.name, string(name)) {
+			return a.values
+		}
+	}
+	return nil
+}
+
+// match reports whether the entry matches the filter f. Values are
+// compared ignoring case, and as integers for ordering when possible.
+func (e *monitorEntry) match(f ldap.Filter) bool {
+	switch f := f.(type) {
+	case ldap.FilterAnd:
+		for _, sub := range f {
+			if !e.match(sub) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, sub := range f {
+			if e.match(sub) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !e.match(f.Filter)
+	case ldap.FilterPresent:
+		return e.values(ldap.AttributeDescription(f)) != nil
+	case ldap.FilterEqualityMatch:
+		return e.compare(f.AttributeDesc(), string(f.AssertionValue()), func(c int) bool { return c == 0 })
+	case ldap.FilterApproxMatch:
+		return e.compare(f.AttributeDesc(), string(f.AssertionValue()), func(c int) bool { return c == 0 })
+	case ldap.FilterGreaterOrEqual:
+		return e.compare(f.AttributeDesc(), string(f.AssertionValue()), func(c int) bool { return c >= 0 })
+	case ldap.FilterLessOrEqual:
+		return e.compare(f.AttributeDesc(), string(f.AssertionValue()), func(c int) bool { return c <= 0 })
+	case ldap.FilterSubstrings:
+		for _, v := range e.values(f.Type_()) {
+			if matchSubstrings(strings.ToLower(v), f.Substrings()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compare reports whether a value of the attribute name compares to
+// assertion as accepted by ok.
+func (e *monitorEntry) compare(name ldap.AttributeDescription, assertion string, ok func(int) bool) bool {
+	for _, v := range e.values(name) {
+		a, errA := strconv.ParseInt(v, 10, 64)
+		b, errB := strconv.ParseInt(assertion, 10, 64)
+		c := strings.Compare(strings.ToLower(v), strings.ToLower(assertion))
+		if errA == nil && errB == nil {
+			c = cmp.Compare(a, b)
+		}
+		if ok(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSubstrings(v string, substrings []ldap.Substring) bool {
+	for _, s := range substrings {
+		switch s := s.(type) {
+		case ldap.SubstringInitial:
+			prefix := strings.ToLower(string(s))
+			if !strings.HasPrefix(v, prefix) {
+				return false
+			}
+			v = v[len(prefix):]
+		case ldap.SubstringAny:
+			sub := strings.ToLower(string(s))
+			i := strings.Index(v, sub)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(sub):]
+		case ldap.SubstringFinal:
+			if !strings.HasSuffix(v, strings.ToLower(string(s))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// operationCounters counts the requests initiated and completed by
+// operation name.
+type operationCounters struct {
+	mutex           sync.Mutex
+	initiatedCounts map[string]int64
+	completedCounts map[string]int64
+}
+
+func (o *operationCounters) initiated(name string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.initiatedCounts == nil {
+		o.initiatedCounts = make(map[string]int64)
+	}
+	o.initiatedCounts[name]++
+}
+
+func (o *operationCounters) completed(name string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.completedCounts == nil {
+		o.completedCounts = make(map[string]int64)
+	}
+	o.completedCounts[name]++
+}
+
+func (o *operationCounters) snapshot() (initiated, completed map[string]int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	initiated, completed = make(map[string]int64), make(map[string]int64)
+	for name, n := range o.initiatedCounts {
+		initiated[name] = n
+	}
+	for name, n := range o.completedCounts {
+		completed[name] = n
+	}
+	return initiated, completed
+}
@@ -0,0 +1,190 @@
+package ldapserver
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+func TestE2E_Monitor(t *testing.T) {
+	server := NewServer()
+	routes := NewRouteMux()
+	routes.Bind(func(w ResponseWriter, m *Message) {
+		w.Write(NewBindResponse(LDAPResultSuccess))
+	}).Label("bind")
+	monitor := NewMonitor(server).RouteMux(routes)
+	monitor.Authorize = func(m *Message) bool {
+		return m.Client.AuthzID() == "dn:cn=alice,dc=example"
+	}
+	routes.Search(monitor.ServeLDAP).Suffix("cn=monitor").Label("monitor")
+	routes.Compare(monitor.ServeLDAP).Label("monitor compare")
+	routes.Search(func(w ResponseWriter, m *Message) {
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	}).Label("search")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server.Handle(routes)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	conn, err := goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("cn=alice,dc=example", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if _, err := conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree,
+		goldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil)); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+
+	search := func(base string, scope int, filter string, attributes ...string) map[string]*goldap.Entry {
+		t.Helper()
+		res, err := conn.Search(goldap.NewSearchRequest(base, scope, goldap.NeverDerefAliases,
+			0, 0, false, filter, attributes, nil))
+		if err != nil {
+			t.Fatalf("search %s %s: %v", base, filter, err)
+		}
+		entries := make(map[string]*goldap.Entry)
+		for _, e := range res.Entries {
+			entries[e.DN] = e
+		}
+		return entries
+	}
+
+	entries := search("cn=Monitor", goldap.ScopeWholeSubtree, "(objectClass=*)")
+	for _, dn := range []string{
+		"cn=Monitor",
+		"cn=Version,cn=Monitor",
+		"cn=Start,cn=Time,cn=Monitor",
+		"cn=Uptime,cn=Time,cn=Monitor",
+		"cn=Goroutines,cn=Monitor",
+		"cn=Connection 1,cn=Connections,cn=Monitor",
+		"cn=Listener 0,cn=Listeners,cn=Monitor",
+		"cn=Route 0,cn=Routes,cn=Monitor",
+	} {
+		if entries[dn] == nil {
+			t.Errorf("missing entry %s", dn)
+		}
+	}
+	if v := entries["cn=Total,cn=Connections,cn=Monitor"].GetAttributeValue("monitorCounter"); v != "1" {
+		t.Errorf("total connections = %q", v)
+	}
+	c := entries["cn=Connection 1,cn=Connections,cn=Monitor"]
+	if c.GetAttributeValue("monitorConnectionAuthzDN") != "dn:cn=alice,dc=example" ||
+		c.GetAttributeValue("monitorConnectionPeerAddress") != server.Connections()[0].RemoteAddr.String() {
+		t.Errorf("unexpected connection entry %v", c.Attributes)
+	}
+	bind := entries["cn=Bind,cn=Operations,cn=Monitor"]
+	if bind.GetAttributeValue("monitorOpInitiated") != "1" || bind.GetAttributeValue("monitorOpCompleted") != "1" {
+		t.Errorf("unexpected bind counters %v", bind.Attributes)
+	}
+	// The search in progress is initiated but not completed.
+	searches := entries["cn=Search,cn=Operations,cn=Monitor"]
+	if searches.GetAttributeValue("monitorOpInitiated") != "2" || searches.GetAttributeValue("monitorOpCompleted") != "1" {
+		t.Errorf("unexpected search counters %v", searches.Attributes)
+	}
+	listener := entries["cn=Listener 0,cn=Listeners,cn=Monitor"]
+	if v := listener.GetAttributeValue("labeledURI"); v != "ldap://"+ln.Addr().String() {
+		t.Errorf("listener URI = %q", v)
+	}
+	route := entries["cn=Route 0,cn=Routes,cn=Monitor"]
+	if route.GetAttributeValue("description") != "bind" || route.GetAttributeValue("monitorCounter") != "1" {
+		t.Errorf("unexpected route entry %v", route.Attributes)
+	}
+
+	// Scopes, filters and attribute selection.
+	entries = search("cn=operations,cn=monitor", goldap.ScopeSingleLevel, "(&(monitorOpInitiated>=1)(objectClass=monitorOp*))", "cn")
+	if len(entries) != 2 || entries["cn=Bind,cn=Operations,cn=Monitor"] == nil || entries["cn=Search,cn=Operations,cn=Monitor"] == nil {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	for _, e := range entries {
+		if len(e.Attributes) != 1 || e.Attributes[0].Name != "cn" {
+			t.Errorf("unexpected attributes %v", e.Attributes)
+		}
+	}
+	entries = search("cn=Monitor", goldap.ScopeBaseObject, "(objectClass=monitorServer)")
+	if len(entries) != 1 || entries["cn=Monitor"] == nil {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	// KELVIN SIGN is longer than the "k" it lowercases to.
+	entries = search("cn=Connections,cn=Monitor", goldap.ScopeSingleLevel, "(monitorConnectionAuthzDN=*\u212a*)")
+	if len(entries) != 0 {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	entries = search("cn=Goroutines,cn=Monitor", goldap.ScopeBaseObject, "(!(monitorCounter<=0))")
+	if n, _ := strconv.Atoi(entries["cn=Goroutines,cn=Monitor"].GetAttributeValue("monitorCounter")); n < 1 {
+		t.Errorf("goroutines = %d", n)
+	}
+
+	_, err = conn.Search(goldap.NewSearchRequest("cn=Missing,cn=Monitor", goldap.ScopeBaseObject,
+		goldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+	if !goldap.IsErrorWithCode(err, LDAPResultNoSuchObject) {
+		t.Errorf("search of a missing entry: %v", err)
+	}
+	_, err = conn.Compare("cn=Monitor", "cn", "Monitor")
+	var ldapErr *goldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.ResultCode != LDAPResultUnwillingToPerform {
+		t.Errorf("compare: %v", err)
+	}
+
+	stats := routes.Stats()
+	if len(stats) != 4 || stats[1].Label != "monitor" || stats[1].Operation != "SearchRequest" || stats[1].Hits != 6 ||
+		stats[3].Hits != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	for _, dn := range []string{"", "cn=bob,dc=example"} {
+		other, err := goldap.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer other.Close()
+		if dn != "" {
+			if err := other.Bind(dn, "secret"); err != nil {
+				t.Fatalf("bind: %v", err)
+			}
+		}
+		_, err = other.Search(goldap.NewSearchRequest("cn=Monitor", goldap.ScopeBaseObject,
+			goldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if !goldap.IsErrorWithCode(err, LDAPResultInsufficientAccessRights) {
+			t.Errorf("search as %q: %v", dn, err)
+		}
+	}
+}
+
+func TestMonitor_RefusesByDefault(t *testing.T) {
+	m := NewMessage(ldap.NewLDAPMessage(), nil)
+	m.Client.SetAuthzID("dn:cn=admin,dc=example")
+	if NewMonitor(NewServer()).authorized(m) {
+		t.Error("a monitor without Authorize allowed a bound client")
+	}
+}
+
+func TestMatchSubstrings(t *testing.T) {
+	tests := []struct {
+		value      string
+		substrings []ldap.Substring
+		want       bool
+	}{
+		{"cn=alice", []ldap.Substring{ldap.SubstringInitial("CN="), ldap.SubstringAny("LI"), ldap.SubstringFinal("e")}, true},
+		{"cn=alice", []ldap.Substring{ldap.SubstringAny("li"), ldap.SubstringAny("al")}, false},
+		// KELVIN SIGN is three bytes long and lowercases to the one byte "k".
+		{"dn:cn=kelvin,dc=uk", []ldap.Substring{ldap.SubstringAny("\u212a"), ldap.SubstringAny("\u212a")}, true},
+		{"k", []ldap.Substring{ldap.SubstringAny("\u212a"), ldap.SubstringFinal("")}, true},
+		{"uk", []ldap.Substring{ldap.SubstringAny("\u212a"), ldap.SubstringAny("x")}, false},
+	}
+	for _, tt := range tests {
+		if got := matchSubstrings(tt.value, tt.substrings); got != tt.want {
+			t.Errorf("matchSubstrings(%q, %v) = %v, want %v", tt.value, tt.substrings, got, tt.want)
+		}
+	}
+}
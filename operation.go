@@ -0,0 +1,87 @@
+package ldapserver
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// operation keeps track of a request while it is processed, from the
+// responses written by its handler.
+type operation struct {
+	number int // sequence number of the request on its connection
+	start  time.Time
+
+	mutex      sync.Mutex
+	tag        ber.Tag // application tag of the response carrying the result
+	resultCode int
+	hasResult  bool
+	entries    int
+}
+
+// newOperation starts tracking the next request received by c.
+func (c *client) newOperation() *operation {
+	c.mutex.Lock()
+	number := c.operations
+	c.operations++
+	c.mutex.Unlock()
+	return &operation{number: number, start: time.Now()}
+}
+
+// responded records the response po and reports whether it carries the
+// result of the operation.
+func (o *operation) responded(po ldap.ProtocolOp) bool {
+	if _, ok := po.(ldap.SearchResultEntry); ok {
+		o.mutex.Lock()
+		o.entries++
+		o.mutex.Unlock()
+		return false
+	}
+	tag, code, ok := responseResult(po)
+	if ok {
+		o.mutex.Lock()
+		o.tag, o.resultCode, o.hasResult = tag, code, true
+		o.mutex.Unlock()
+	}
+	return ok
+}
+
+// result returns the result code of the operation. ok is false when the
+// handler did not send a result.
+func (o *operation) result() (code int, ok bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.resultCode, o.hasResult
+}
+
+// endOperation is called once the handler of m returns.
+func (c *client) endOperation(m *Message, op *operation) {
+	duration := time.Since(op.start)
+	op.mutex.Lock()
+	code, hasResult, entries := op.resultCode, op.hasResult, op.entries
+	op.mutex.Unlock()
+
+	attrs := []slog.Attr{
+		slog.Int("msgid", m.MessageID().Int()),
+		slog.String("op", m.ProtocolOpName()),
+	}
+	if hasResult {
+		attrs = append(attrs, slog.Int("result", code))
+	}
+	attrs = append(attrs, slog.Duration("duration", duration))
+	c.log.LogAttrs(context.Background(), slog.LevelInfo, "operation", attrs...)
+
+	c.srv.operations.completed(OperationName(m.ProtocolOp()))
+	metrics := c.srv.metrics()
+	if !hasResult {
+		code = -1
+	}
+	metrics.OperationDone(OperationName(m.ProtocolOp()), code, duration)
+	if _, ok := m.ProtocolOp().(ldap.SearchRequest); ok {
+		metrics.SearchEntries(entries)
+	}
+}
@@ -0,0 +1,99 @@
+// Package otelldap traces the requests of an ldapserver.Server with
+// OpenTelemetry:
+//
+//	server.Tracer = otelldap.NewTracer(otel.GetTracerProvider())
+//
+// Each request is a span of kind server named after its operation, such as
+// "LDAP search", with the attributes ldap.operation, ldap.message_id,
+// ldap.connection_id, ldap.base_dn, ldap.scope and ldap.filter. When the
+// handler returns, the span records ldap.result_code and, for searches,
+// ldap.entries. Its status is Error for result codes other than success,
+// compareFalse, compareTrue, referral and saslBindInProgress.
+//
+// Handlers get the span from the context of the request:
+//
+//	span := trace.SpanFromContext(m.Context())
+package otelldap
+
+import (
+	"context"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// ScopeName is the instrumentation scope of the tracer.
+const ScopeName = "github.com/vjeantet/ldapserver/otelldap"
+
+// Attribute keys of the spans.
+const (
+	OperationKey    = attribute.Key("ldap.operation")
+	MessageIDKey    = attribute.Key("ldap.message_id")
+	ConnectionIDKey = attribute.Key("ldap.connection_id")
+	BaseDNKey       = attribute.Key("ldap.base_dn")
+	ScopeKey        = attribute.Key("ldap.scope")
+	FilterKey       = attribute.Key("ldap.filter")
+	ResultCodeKey   = attribute.Key("ldap.result_code")
+	EntriesKey      = attribute.Key("ldap.entries")
+)
+
+// Tracer is an ldapserver.Tracer starting OpenTelemetry spans.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns a Tracer creating spans with a tracer of provider.
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: provider.Tracer(ScopeName)}
+}
+
+// StartOperation implements ldapserver.Tracer.
+func (t *Tracer) StartOperation(ctx context.Context, info ldap.OperationInfo) (context.Context, ldap.OperationSpan) {
+	attrs := []attribute.KeyValue{
+		OperationKey.String(info.Op),
+		MessageIDKey.Int(info.MessageID),
+		ConnectionIDKey.Int(info.ConnectionID),
+	}
+	if info.BaseDN != "" || info.Op == "search" {
+		attrs = append(attrs, BaseDNKey.String(info.BaseDN))
+	}
+	if info.Scope >= 0 {
+		attrs = append(attrs, ScopeKey.Int(info.Scope), FilterKey.String(info.Filter))
+	}
+	ctx, span := t.tracer.Start(ctx, "LDAP "+info.Op,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+	return ctx, operationSpan{span: span, search: info.Op == "search"}
+}
+
+type operationSpan struct {
+	span   trace.Span
+	search bool
+}
+
+func (s operationSpan) End(result ldap.OperationResult) {
+	if result.HasResult {
+		s.span.SetAttributes(ResultCodeKey.Int(result.ResultCode))
+		if !successful(result.ResultCode) {
+			s.span.SetStatus(codes.Error, "LDAP result "+strconv.Itoa(result.ResultCode))
+		}
+	}
+	if s.search {
+		s.span.SetAttributes(EntriesKey.Int(result.Entries))
+	}
+	s.span.End()
+}
+
+// successful reports whether code is not an error.
+func successful(code int) bool {
+	switch code {
+	case ldap.LDAPResultSuccess, ldap.LDAPResultCompareFalse, ldap.LDAPResultCompareTrue,
+		ldap.LDAPResultReferral, ldap.LDAPResultSaslBindInProgress:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package otelldap
+
+import (
+	"net"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := ldap.NewServer()
+	server.Tracer = NewTracer(provider)
+	var handlerSpan trace.SpanContext
+	routes := ldap.NewRouteMux()
+	routes.Bind(func(w ldap.ResponseWriter, m *ldap.Message) {
+		w.Write(ldap.NewBindResponse(ldap.LDAPResultInvalidCredentials))
+	})
+	routes.Search(func(w ldap.ResponseWriter, m *ldap.Message) {
+		handlerSpan = trace.SpanContextFromContext(m.Context())
+		w.Write(ldap.NewSearchResultEntry("cn=alice,dc=example"))
+		w.Write(ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess))
+	})
+	server.Handle(routes)
+	go server.Serve(ln)
+
+	conn, err := goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := conn.Bind("cn=alice,dc=example", "wrong"); err == nil {
+		t.Fatalf("bind succeeded")
+	}
+	if _, err := conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(cn=alice)", nil, nil)); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	conn.Close()
+	server.Stop()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	bind, search := spans[0], spans[1]
+
+	if bind.Name != "LDAP bind" || bind.SpanKind != trace.SpanKindServer {
+		t.Errorf("unexpected bind span %q of kind %v", bind.Name, bind.SpanKind)
+	}
+	if bind.Status.Code != codes.Error {
+		t.Errorf("bind span status = %v, want Error", bind.Status)
+	}
+	checkAttributes(t, bind.Attributes, map[attribute.Key]attribute.Value{
+		OperationKey:  attribute.StringValue("bind"),
+		MessageIDKey:  attribute.IntValue(1),
+		BaseDNKey:     attribute.StringValue("cn=alice,dc=example"),
+		ResultCodeKey: attribute.IntValue(ldap.LDAPResultInvalidCredentials),
+	})
+
+	if search.Name != "LDAP search" || search.Status.Code == codes.Error {
+		t.Errorf("unexpected search span %q with status %v", search.Name, search.Status)
+	}
+	if search.SpanContext.SpanID() != handlerSpan.SpanID() {
+		t.Errorf("handler context carries span %v, want %v", handlerSpan.SpanID(), search.SpanContext.SpanID())
+	}
+	checkAttributes(t, search.Attributes, map[attribute.Key]attribute.Value{
+		OperationKey:  attribute.StringValue("search"),
+		MessageIDKey:  attribute.IntValue(2),
+		BaseDNKey:     attribute.StringValue("dc=example"),
+		ScopeKey:      attribute.IntValue(2),
+		FilterKey:     attribute.StringValue("(cn=alice)"),
+		ResultCodeKey: attribute.IntValue(ldap.LDAPResultSuccess),
+		EntriesKey:    attribute.IntValue(1),
+	})
+	if !hasAttribute(search.Attributes, ConnectionIDKey) {
+		t.Errorf("missing %s in %v", ConnectionIDKey, search.Attributes)
+	}
+}
+
+func checkAttributes(t *testing.T, attrs []attribute.KeyValue, want map[attribute.Key]attribute.Value) {
+	t.Helper()
+	got := map[attribute.Key]attribute.Value{}
+	for _, kv := range attrs {
+		got[kv.Key] = kv.Value
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k].Emit(), v.Emit())
+		}
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, key attribute.Key) bool {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package ldapserver
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// PasswordScheme hashes and verifies userPassword values stored with a
+// "{SCHEME}" prefix, as used by OpenLDAP and 389-DS.
+type PasswordScheme interface {
+	// Hash returns the encoded form of password, without the {SCHEME} prefix.
+	Hash(password []byte) (string, error)
+	// Verify reports whether password matches encoded, which is the stored
+	// value without its {SCHEME} prefix.
+	Verify(password []byte, encoded string) (bool, error)
+}
+
+// ErrUnknownPasswordScheme is returned when a stored value uses a scheme
+// which has not been registered.
+var ErrUnknownPasswordScheme = errors.New("unknown password scheme")
+
+var passwordSchemes = struct {
+	sync.RWMutex
+	m map[string]PasswordScheme
+}{m: make(map[string]PasswordScheme)}
+
+func init() {
+	RegisterPasswordScheme("CLEARTEXT", cleartextScheme{})
+	RegisterPasswordScheme("SHA", saltedDigestScheme{newHash: sha1.New})
+	RegisterPasswordScheme("SSHA", saltedDigestScheme{newHash: sha1.New, saltLen: 8})
+	RegisterPasswordScheme("SHA256", saltedDigestScheme{newHash: sha256.New})
+	RegisterPasswordScheme("SSHA256", saltedDigestScheme{newHash: sha256.New, saltLen: 8})
+	RegisterPasswordScheme("SHA512", saltedDigestScheme{newHash: sha512.New})
+	RegisterPasswordScheme("SSHA512", saltedDigestScheme{newHash: sha512.New, saltLen: 8})
+	RegisterPasswordScheme("CRYPT", cryptScheme{})
+	RegisterPasswordScheme("PBKDF2", pbkdf2Scheme{newHash: sha1.New})
+	RegisterPasswordScheme("PBKDF2-SHA1", pbkdf2Scheme{newHash: sha1.New})
+	RegisterPasswordScheme("PBKDF2-SHA256", pbkdf2Scheme{newHash: sha256.New})
+	RegisterPasswordScheme("PBKDF2-SHA512", pbkdf2Scheme{newHash: sha512.New})
+	RegisterPasswordScheme("ARGON2", argon2Scheme{})
+	RegisterPasswordScheme("SCRAM-SHA-1", scramScheme{newHash: sha1.New})
+	RegisterPasswordScheme("SCRAM-SHA-256", scramScheme{newHash: sha256.New})
+}
+
+// RegisterPasswordScheme makes a password scheme available under name,
+// replacing any scheme previously registered with the same name.
+// Scheme names are case insensitive and given without braces.
+func RegisterPasswordScheme(name string, scheme PasswordScheme) {
+	passwordSchemes.Lock()
+	passwordSchemes.m[strings.ToUpper(name)] = scheme
+	passwordSchemes.Unlock()
+}
+
+// LookupPasswordScheme returns the scheme registered under name.
+func LookupPasswordScheme(name string) (PasswordScheme, bool) {
+	passwordSchemes.RLock()
+	scheme, ok := passwordSchemes.m[strings.ToUpper(name)]
+	passwordSchemes.RUnlock()
+	return scheme, ok
+}
+
+// HashPassword returns a userPassword value for password using the named
+// scheme, e.g. HashPassword("SSHA512", pw) returns "{SSHA512}...".
+func HashPassword(scheme string, password []byte) (string, error) {
+	s, ok := LookupPasswordScheme(scheme)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownPasswordScheme, scheme)
+	}
+	encoded, err := s.Hash(password)
+	if err != nil {
+		return "", err
+	}
+	return "{" + strings.ToUpper(scheme) + "}" + encoded, nil
+}
+
+// VerifyPassword reports whether password matches the stored userPassword
+// value. A value without a {SCHEME} prefix is compared as cleartext.
+func VerifyPassword(password []byte, stored string) (bool, error) {
+	scheme, encoded, ok := splitPasswordScheme(stored)
+	if !ok {
+		return subtle.ConstantTimeCompare(password, []byte(stored)) == 1, nil
+	}
+	s, found := LookupPasswordScheme(scheme)
+	if !found {
+		return false, fmt.Errorf("%w: %s", ErrUnknownPasswordScheme, scheme)
+	}
+	return s.Verify(password, encoded)
+}
+
+// splitPasswordScheme splits "{SCHEME}encoded" into its parts.
+func splitPasswordScheme(stored string) (scheme, encoded string, ok bool) {
+	if !strings.HasPrefix(stored, "{") {
+		return "", "", false
+	}
+	end := strings.IndexByte(stored, '}')
+	if end < 2 {
+		return "", "", false
+	}
+	return stored[1:end], stored[end+1:], true
+}
+
+// CheckBindPassword checks the password of a simple BindRequest against the
+// stored userPassword values of the entry named in the request. It returns
+// the result code to send in the BindResponse:
+//   - LDAPResultSuccess when one of the values matches,
+//   - LDAPResultAuthMethodNotSupported when the request is not a simple bind,
+//   - LDAPResultUnwillingToPerform for an unauthenticated bind (a name with
+//     an empty password, RFC 4513 section 5.1.2),
+//   - LDAPResultInvalidCredentials otherwise, including anonymous binds.
+//
+// Every stored value is checked, so the time taken does not reveal which
+// of them matched.
+func CheckBindPassword(r ldap.BindRequest, userPasswords ...string) int {
+	if r.AuthenticationChoice() != "simple" {
+		return LDAPResultAuthMethodNotSupported
+	}
+	password := []byte(r.AuthenticationSimple())
+	if len(password) == 0 {
+		if len(r.Name()) > 0 {
+			return LDAPResultUnwillingToPerform
+		}
+		return LDAPResultInvalidCredentials
+	}
+	if verifyAnyPassword(password, userPasswords) {
+		return LDAPResultSuccess
+	}
+	return LDAPResultInvalidCredentials
+}
+
+// verifyAnyPassword reports whether password matches one of the stored
+// values. Every value is checked so that the time taken does not tell
+// which one matched.
+func verifyAnyPassword(password []byte, stored []string) bool {
+	matched := false
+	for _, v := range stored {
+		if ok, err := VerifyPassword(password, v); err == nil && ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// randomSalt returns n random bytes.
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// cleartextScheme implements {CLEARTEXT}.
+type cleartextScheme struct{}
+
+func (cleartextScheme) Hash(password []byte) (string, error) {
+	return string(password), nil
+}
+
+func (cleartextScheme) Verify(password []byte, encoded string) (bool, error) {
+	return subtle.ConstantTimeCompare(password, []byte(encoded)) == 1, nil
+}
+
+// saltedDigestScheme implements {SHA}, {SSHA} and their SHA-2 variants:
+// base64(H(password + salt) + salt). An unsalted scheme has saltLen 0.
+type saltedDigestScheme struct {
+	newHash func() hash.Hash
+	saltLen int
+}
+
+func (s saltedDigestScheme) Hash(password []byte) (string, error) {
+	salt, err := randomSalt(s.saltLen)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(append(s.digest(password, salt), salt...)), nil
+}
+
+func (s saltedDigestScheme) Verify(password []byte, encoded string) (bool, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false, fmt.Errorf("invalid digest encoding: %w", err)
+	}
+	size := s.newHash().Size()
+	if len(raw) < size || (s.saltLen == 0 && len(raw) != size) {
+		return false, errors.New("invalid digest length")
+	}
+	sum, salt := raw[:size], raw[size:]
+	return subtle.ConstantTimeCompare(sum, s.digest(password, salt)) == 1, nil
+}
+
+func (s saltedDigestScheme) digest(password, salt []byte) []byte {
+	h := s.newHash()
+	h.Write(password)
+	h.Write(salt)
+	return h.Sum(nil)
+}
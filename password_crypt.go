@@ -0,0 +1,391 @@
+package ldapserver
+
+import (
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cryptAlphabet is the base64 alphabet used by crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Upper bounds on the cost parameters accepted from stored hashes. A bind
+// against a value above them is refused rather than computed, so a single
+// crafted userPassword cannot tie up the server.
+const (
+	maxCryptRounds      = 1000000
+	maxBcryptCost       = 16
+	maxPBKDF2Iterations = 5000000
+	maxArgon2Memory     = 256 * 1024 // KiB
+	maxArgon2Time       = 16
+	maxArgon2Threads    = 16
+)
+
+// cryptScheme implements {CRYPT} for the MD5 ($1$), SHA-256 ($5$),
+// SHA-512 ($6$) and bcrypt ($2a$, $2b$, $2y$) crypt(3) formats.
+// New hashes use SHA-512.
+type cryptScheme struct{}
+
+func (cryptScheme) Hash(password []byte) (string, error) {
+	salt, err := randomSalt(12)
+	if err != nil {
+		return "", err
+	}
+	return shaCrypt(sha512.New, "$6$", password, cryptEncode(salt), 5000, false), nil
+}
+
+func (cryptScheme) Verify(password []byte, encoded string) (bool, error) {
+	var computed string
+	switch {
+	case strings.HasPrefix(encoded, "$1$"):
+		computed = md5Crypt(password, cryptSalt(encoded[3:], 8))
+	case strings.HasPrefix(encoded, "$5$"), strings.HasPrefix(encoded, "$6$"):
+		newHash := sha256.New
+		if encoded[1] == '6' {
+			newHash = sha512.New
+		}
+		rest := encoded[3:]
+		rounds, custom := 5000, false
+		if strings.HasPrefix(rest, "rounds=") {
+			end := strings.IndexByte(rest, '$')
+			if end < 0 {
+				return false, errors.New("invalid crypt rounds")
+			}
+			n, err := strconv.Atoi(rest[len("rounds="):end])
+			if err != nil {
+				return false, fmt.Errorf("invalid crypt rounds: %w", err)
+			}
+			if n > maxCryptRounds {
+				return false, fmt.Errorf("crypt rounds %d exceed the limit of %d", n, maxCryptRounds)
+			}
+			rounds, custom, rest = n, true, rest[end+1:]
+		}
+		computed = shaCrypt(newHash, encoded[:3], password, cryptSalt(rest, 16), rounds, custom)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if cost, err := bcrypt.Cost([]byte(encoded)); err != nil {
+			return false, err
+		} else if cost > maxBcryptCost {
+			return false, fmt.Errorf("bcrypt cost %d exceeds the limit of %d", cost, maxBcryptCost)
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), password)
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, errors.New("unsupported crypt algorithm")
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(encoded)) == 1, nil
+}
+
+// cryptSalt returns the salt part of s, which ends at the next '$',
+// truncated to limit characters.
+func cryptSalt(s string, limit int) string {
+	if i := strings.IndexByte(s, '$'); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) > limit {
+		s = s[:limit]
+	}
+	return s
+}
+
+// cryptEncode encodes b with the crypt(3) alphabet; it is used to turn
+// random bytes into a salt string.
+func cryptEncode(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		sb.WriteByte(cryptAlphabet[c&0x3f])
+	}
+	return sb.String()
+}
+
+// cryptB64From24 appends n characters encoding the 24 bit group b2 b1 b0,
+// least significant bits first, as crypt(3) does.
+func cryptB64From24(sb *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		sb.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// md5Crypt implements the FreeBSD MD5 based crypt ($1$).
+func md5Crypt(password []byte, salt string) string {
+	const magic = "$1$"
+
+	alt := md5.New()
+	alt.Write(password)
+	alt.Write([]byte(salt))
+	alt.Write(password)
+	final := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(password)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for n := len(password); n > 0; n -= 16 {
+		ctx.Write(final[:min(n, 16)])
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(password[:1])
+		}
+	}
+	final = ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(password)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(password)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(password)
+		}
+		final = c.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(magic + salt + "$")
+	cryptB64From24(&sb, final[0], final[6], final[12], 4)
+	cryptB64From24(&sb, final[1], final[7], final[13], 4)
+	cryptB64From24(&sb, final[2], final[8], final[14], 4)
+	cryptB64From24(&sb, final[3], final[9], final[15], 4)
+	cryptB64From24(&sb, final[4], final[10], final[5], 4)
+	cryptB64From24(&sb, 0, 0, final[11], 2)
+	return sb.String()
+}
+
+// Byte orders used to encode the final SHA-crypt digests.
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// shaCrypt implements the SHA-256 ($5$) and SHA-512 ($6$) crypt algorithms
+// as specified by Ulrich Drepper. custom reports whether rounds must appear
+// in the output.
+func shaCrypt(newHash func() hash.Hash, magic string, password []byte, salt string, rounds int, custom bool) string {
+	rounds = max(1000, min(rounds, maxCryptRounds))
+	s := []byte(salt)
+
+	b := newHash()
+	b.Write(password)
+	b.Write(s)
+	b.Write(password)
+	sumB := b.Sum(nil)
+	size := len(sumB)
+
+	a := newHash()
+	a.Write(password)
+	a.Write(s)
+	n := len(password)
+	for ; n > size; n -= size {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:n])
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(password)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := newHash()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeatBytes(dp.Sum(nil), len(password))
+
+	ds := newHash()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatBytes(ds.Sum(nil), len(s))
+
+	for i := 0; i < rounds; i++ {
+		c := newHash()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sumA)
+		}
+		if i%3 != 0 {
+			c.Write(sSeq)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sumA)
+		} else {
+			c.Write(p)
+		}
+		sumA = c.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(magic)
+	if custom {
+		sb.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	sb.WriteString(salt + "$")
+	if size == sha256.Size {
+		for _, o := range sha256CryptOrder {
+			cryptB64From24(&sb, sumA[o[0]], sumA[o[1]], sumA[o[2]], 4)
+		}
+		cryptB64From24(&sb, 0, sumA[31], sumA[30], 3)
+	} else {
+		for _, o := range sha512CryptOrder {
+			cryptB64From24(&sb, sumA[o[0]], sumA[o[1]], sumA[o[2]], 4)
+		}
+		cryptB64From24(&sb, 0, 0, sumA[63], 2)
+	}
+	return sb.String()
+}
+
+// repeatBytes returns the first n bytes of b repeated.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+// ab64 is the "adapted base64" encoding used by OpenLDAP's pw-pbkdf2
+// module: standard base64 with '.' in place of '+' and no padding.
+var ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// pbkdf2Scheme implements OpenLDAP's {PBKDF2} schemes, stored as
+// "<iterations>$<ab64 salt>$<ab64 derived key>".
+type pbkdf2Scheme struct {
+	newHash func() hash.Hash
+}
+
+func (s pbkdf2Scheme) Hash(password []byte) (string, error) {
+	const iterations = 10000
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	dk, err := pbkdf2.Key(s.newHash, string(password), salt, iterations, s.newHash().Size())
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(iterations) + "$" + ab64.EncodeToString(salt) + "$" + ab64.EncodeToString(dk), nil
+}
+
+func (s pbkdf2Scheme) Verify(password []byte, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 {
+		return false, errors.New("invalid pbkdf2 value")
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations < 1 {
+		return false, errors.New("invalid pbkdf2 iteration count")
+	}
+	if iterations > maxPBKDF2Iterations {
+		return false, fmt.Errorf("pbkdf2 iteration count %d exceeds the limit of %d", iterations, maxPBKDF2Iterations)
+	}
+	salt, err := ab64.DecodeString(parts[1])
+	if err != nil {
+		return false, fmt.Errorf("invalid pbkdf2 salt: %w", err)
+	}
+	want, err := ab64.DecodeString(parts[2])
+	if err != nil || len(want) == 0 {
+		return false, errors.New("invalid pbkdf2 derived key")
+	}
+	dk, err := pbkdf2.Key(s.newHash, string(password), salt, iterations, len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(dk, want) == 1, nil
+}
+
+// argon2Scheme implements OpenLDAP's {ARGON2} scheme, stored as a PHC
+// string: "$argon2id$v=19$m=65536,t=2,p=1$<b64 salt>$<b64 hash>".
+// Both argon2i and argon2id are accepted; new hashes use argon2id.
+type argon2Scheme struct{}
+
+func (argon2Scheme) Hash(password []byte) (string, error) {
+	const memory, time, threads = 64 * 1024, 2, 1
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, time, memory, threads, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (argon2Scheme) Verify(password []byte, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return false, errors.New("invalid argon2 value")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2 version")
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time < 1 || threads < 1 {
+		return false, errors.New("invalid argon2 parameters")
+	}
+	if memory > maxArgon2Memory || time > maxArgon2Time || threads > maxArgon2Threads {
+		return false, errors.New("argon2 parameters exceed the limits")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, errors.New("invalid argon2 hash")
+	}
+	var key []byte
+	switch parts[1] {
+	case "argon2id":
+		key = argon2.IDKey(password, salt, time, memory, threads, uint32(len(want)))
+	case "argon2i":
+		key = argon2.Key(password, salt, time, memory, threads, uint32(len(want)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant %q", parts[1])
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1, nil
+}
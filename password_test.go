@@ -0,0 +1,146 @@
+package ldapserver
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// simpleBindRequest decodes a simple BindRequest for name and password.
+func simpleBindRequest(t *testing.T, name, password string) ldap.BindRequest {
+	t.Helper()
+	env := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	env.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "messageID"))
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationBindRequest, nil, "BindRequest")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "name"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "simple"))
+	env.AppendChild(req)
+
+	m, err := decodeMessage(env.Bytes())
+	if err != nil {
+		t.Fatalf("decode bind request: %v", err)
+	}
+	return m.ProtocolOp().(ldap.BindRequest)
+}
+
+func TestVerifyPassword_KnownValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		stored   string
+	}{
+		{"cleartext", "secret", "secret"},
+		{"CLEARTEXT", "secret", "{CLEARTEXT}secret"},
+		{"SSHA", "secret", "{SSHA}gVK8WC9YyFT1gMsQHTGCgT3sSv5zYWx0"},
+		{"lowercase scheme", "secret", "{ssha}gVK8WC9YyFT1gMsQHTGCgT3sSv5zYWx0"},
+		{"CRYPT md5", "password", "{CRYPT}$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/"},
+		{"CRYPT sha256", "Hello world!", "{CRYPT}$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"CRYPT sha512", "Hello world!", "{CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"CRYPT sha512 rounds", "Hello world!", "{CRYPT}$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"PBKDF2", "secret", "{PBKDF2}10000$MDEyMzQ1Njc4OWFiY2RlZg$QVljdW66hKXEevyu3tfWz0W/tzo"},
+		{"PBKDF2-SHA256", "secret", "{PBKDF2-SHA256}10000$MDEyMzQ1Njc4OWFiY2RlZg$6umsHhz0yhb.YIJ/FUgCrsOB.tK.gGdB.tvI2KPIHns"},
+		// From OpenLDAP's contrib/slapd-modules/passwd/pbkdf2 README.
+		{"PBKDF2 openldap", "secret", "{PBKDF2}60000$Y6ZHtTTbeUgpIbIW0QDmDA$j/aU7jFKUSbH4UobNQDm9OEIwuw"},
+		{"PBKDF2-SHA512 openldap", "secret", "{PBKDF2-SHA512}10000$/oQ4xZi382mk7kvCd3ZdkA$2wqjpuyV2l0U/a1QwoQPOtlQL.UcJGNACj1O24balruqQb/NgPW6OCvvrrJP8.SzA3/5iYvLnwWPzeX8IK/bEQ"},
+		// From the Argon2 reference implementation's test vectors.
+		{"ARGON2 argon2i", "password", "{ARGON2}$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$wWKIMhR9lyDFvRz9YTZweHKfbftvj+qf+YFY4NeBbtA"},
+		{"ARGON2 argon2id", "password", "{ARGON2}$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyPassword([]byte(tt.password), tt.stored)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !ok {
+				t.Fatalf("expected %q to match %q", tt.password, tt.stored)
+			}
+			ok, err = VerifyPassword([]byte(tt.password+"x"), tt.stored)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok {
+				t.Fatalf("expected wrong password not to match %q", tt.stored)
+			}
+		})
+	}
+}
+
+func TestVerifyPassword_CostLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+	}{
+		{"crypt rounds", "{CRYPT}$6$rounds=999999999$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"bcrypt cost", "{CRYPT}$2b$31$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui"},
+		{"pbkdf2 iterations", "{PBKDF2}2000000000$MDEyMzQ1Njc4OWFiY2RlZg$QVljdW66hKXEevyu3tfWz0W/tzo"},
+		{"argon2 memory", "{ARGON2}$argon2id$v=19$m=4194304,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{"argon2 time", "{ARGON2}$argon2id$v=19$m=65536,t=100000,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{"argon2 threads", "{ARGON2}$argon2id$v=19$m=65536,t=2,p=255$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyPassword([]byte("secret"), tt.stored)
+			if err == nil || ok {
+				t.Fatalf("expected %q to be rejected, got ok=%v err=%v", tt.stored, ok, err)
+			}
+		})
+	}
+}
+
+func TestHashPassword_RoundTrip(t *testing.T) {
+	schemes := []string{"CLEARTEXT", "SHA", "SSHA", "SSHA256", "SSHA512", "CRYPT", "PBKDF2", "PBKDF2-SHA256", "PBKDF2-SHA512", "ARGON2"}
+
+	for _, scheme := range schemes {
+		t.Run(scheme, func(t *testing.T) {
+			stored, err := HashPassword(scheme, []byte("s3cr3t"))
+			if err != nil {
+				t.Fatalf("hash: %v", err)
+			}
+			if ok, err := VerifyPassword([]byte("s3cr3t"), stored); err != nil || !ok {
+				t.Fatalf("expected %q to verify, got ok=%v err=%v", stored, ok, err)
+			}
+			if ok, _ := VerifyPassword([]byte("other"), stored); ok {
+				t.Fatalf("expected wrong password not to verify against %q", stored)
+			}
+		})
+	}
+}
+
+func TestVerifyPassword_UnknownScheme(t *testing.T) {
+	ok, err := VerifyPassword([]byte("secret"), "{NOPE}secret")
+	if ok || err == nil {
+		t.Fatalf("expected error for unknown scheme, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestCheckBindPassword(t *testing.T) {
+	stored, err := HashPassword("SSHA512", []byte("secret"))
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		dn       string
+		password string
+		want     int
+	}{
+		{"match", "cn=test", "secret", LDAPResultSuccess},
+		{"mismatch", "cn=test", "wrong", LDAPResultInvalidCredentials},
+		{"unauthenticated", "cn=test", "", LDAPResultUnwillingToPerform},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := simpleBindRequest(t, tt.dn, tt.password)
+			if got := CheckBindPassword(r, "{CRYPT}$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/", stored); got != tt.want {
+				t.Fatalf("expected result code %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package ldapserver
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// passwdModifyRequestValue represents the ASN.1 value of a Password Modify
+// Extended Request per RFC 3062:
+//
+//	PasswdModifyRequestValue ::= SEQUENCE {
+//	  userIdentity    [0]  OCTET STRING OPTIONAL
+//	  oldPasswd       [1]  OCTET STRING OPTIONAL
+//	  newPasswd       [2]  OCTET STRING OPTIONAL }
+type passwdModifyRequestValue struct {
+	UserIdentity []byte `asn1:"optional,tag:0"`
+	OldPasswd    []byte `asn1:"optional,tag:1"`
+	NewPasswd    []byte `asn1:"optional,tag:2"`
+}
+
+// passwdModifyResponseValue represents the ASN.1 value of a Password Modify
+// Extended Response per RFC 3062:
+//
+//	PasswdModifyResponseValue ::= SEQUENCE {
+//	  genPasswd       [0]     OCTET STRING OPTIONAL }
+type passwdModifyResponseValue struct {
+	GenPasswd []byte `asn1:"optional,tag:0"`
+}
+
+// PasswordModifyRequest is a decoded Password Modify Extended Request
+// (RFC 3062, OID 1.3.6.1.4.1.4203.1.11.1).
+type PasswordModifyRequest struct {
+	// UserIdentity names the user whose password is changed. It is empty
+	// when the client changes the password of the user it is bound as,
+	// see m.Client.AuthzID().
+	UserIdentity string
+	// OldPassword is the current password, nil when not provided.
+	OldPassword []byte
+	// NewPassword is the requested password, nil when the client asks the
+	// server to generate one.
+	NewPassword []byte
+	// Generated reports whether NewPassword was generated by the server.
+	Generated bool
+}
+
+// ParsePasswordModifyRequest decodes the BER-encoded requestValue of a
+// Password Modify Extended Request. An absent requestValue is treated as
+// a request with no field set.
+func ParsePasswordModifyRequest(raw *ldap.OCTETSTRING) (PasswordModifyRequest, error) {
+	var req PasswordModifyRequest
+	if raw == nil {
+		return req, nil
+	}
+
+	var val passwdModifyRequestValue
+	rest, err := asn1.Unmarshal([]byte(*raw), &val)
+	if err != nil {
+		return req, fmt.Errorf("password modify request: failed to decode requestValue: %w", err)
+	}
+	if len(rest) > 0 {
+		return req, fmt.Errorf("password modify request: trailing data after requestValue")
+	}
+	req.UserIdentity = string(val.UserIdentity)
+	req.OldPassword = val.OldPasswd
+	req.NewPassword = val.NewPasswd
+	return req, nil
+}
+
+// NewPasswordModifyResponse creates the ExtendedResponse of a Password
+// Modify operation. genPasswd is sent back to the client when not nil.
+func NewPasswordModifyResponse(resultCode int, genPasswd []byte) ldap.ExtendedResponse {
+	if genPasswd == nil {
+		return NewExtendedResponse(resultCode)
+	}
+	value, err := asn1.Marshal(passwdModifyResponseValue{GenPasswd: genPasswd})
+	if err != nil {
+		return NewExtendedResponse(LDAPResultOther)
+	}
+	return NewExtendedResponseWithValue(resultCode, "", value)
+}
+
+// GeneratePassword returns a random password of length characters drawn
+// from letters and digits.
+func GeneratePassword(length int) ([]byte, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return nil, err
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return password, nil
+}
+
+// PasswordModifyFunc changes the password of a user. It returns a
+// *ResultError to choose the result code sent to the client, such as
+// LDAPResultInsufficientAccessRights or LDAPResultUnwillingToPerform;
+// any other error is logged and reported as LDAPResultOther with a generic
+// diagnostic message.
+type PasswordModifyFunc func(m *Message, req PasswordModifyRequest) error
+
+// PasswordModifyHandler serves Password Modify Extended Requests. It
+// decodes the request, generates a new password when the client did not
+// provide one, calls Modify and encodes the response.
+type PasswordModifyHandler struct {
+	Modify PasswordModifyFunc
+	// Generate returns a new password when the request does not carry
+	// one. If nil, GeneratePassword(16) is used.
+	Generate func() ([]byte, error)
+}
+
+// ServeLDAP implements Handler.
+func (h *PasswordModifyHandler) ServeLDAP(w ResponseWriter, m *Message) {
+	r := m.GetExtendedRequest()
+	req, err := ParsePasswordModifyRequest(r.RequestValue())
+	if err != nil {
+		res := NewExtendedResponse(LDAPResultProtocolError)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+
+	if req.NewPassword == nil {
+		generate := h.Generate
+		if generate == nil {
+			generate = func() ([]byte, error) { return GeneratePassword(16) }
+		}
+		if req.NewPassword, err = generate(); err != nil {
+			res := NewExtendedResponse(LDAPResultOther)
+			res.SetDiagnosticMessage("unable to generate a password")
+			w.Write(res)
+			return
+		}
+		req.Generated = true
+	}
+
+	if err := h.Modify(m, req); err != nil {
+		m.Client.log.Info("password modify failed", "msgid", m.MessageID().Int(), "error", err)
+		code, msg := resultFromError(err, LDAPResultOther, "unable to modify the password")
+		res := NewExtendedResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+		return
+	}
+
+	var genPasswd []byte
+	if req.Generated {
+		genPasswd = req.NewPassword
+	}
+	w.Write(NewPasswordModifyResponse(LDAPResultSuccess, genPasswd))
+}
@@ -0,0 +1,139 @@
+package ldapserver
+
+import (
+	"encoding/asn1"
+	"errors"
+	"strings"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+func TestParsePasswordModifyRequest(t *testing.T) {
+	data, err := asn1.Marshal(passwdModifyRequestValue{
+		UserIdentity: []byte("uid=alice,dc=example"),
+		OldPasswd:    []byte("old"),
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal test data: %v", err)
+	}
+	raw := ldap.OCTETSTRING(data)
+
+	req, err := ParsePasswordModifyRequest(&raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.UserIdentity != "uid=alice,dc=example" {
+		t.Fatalf("expected userIdentity uid=alice,dc=example, got %q", req.UserIdentity)
+	}
+	if string(req.OldPassword) != "old" {
+		t.Fatalf("expected oldPasswd old, got %q", req.OldPassword)
+	}
+	if req.NewPassword != nil {
+		t.Fatalf("expected absent newPasswd, got %q", req.NewPassword)
+	}
+}
+
+func TestParsePasswordModifyRequest_Nil(t *testing.T) {
+	req, err := ParsePasswordModifyRequest(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.UserIdentity != "" || req.OldPassword != nil || req.NewPassword != nil {
+		t.Fatalf("expected empty request, got %+v", req)
+	}
+}
+
+func TestParsePasswordModifyRequest_InvalidData(t *testing.T) {
+	raw := ldap.OCTETSTRING([]byte{0xff, 0xff})
+	if _, err := ParsePasswordModifyRequest(&raw); err == nil {
+		t.Fatal("expected error for invalid ASN.1 data, got nil")
+	}
+}
+
+// startPasswordModifyServer starts a server routing Password Modify
+// requests to fn and returns its address.
+func startPasswordModifyServer(t *testing.T, fn PasswordModifyFunc) string {
+	t.Helper()
+	routes := NewRouteMux()
+	routes.Bind(handleBindTest)
+	routes.PasswordModify(fn)
+	addr, _ := serveTest(t, nil, routes)
+	return addr
+}
+
+func TestE2E_PasswordModify(t *testing.T) {
+	var got PasswordModifyRequest
+	addr := startPasswordModifyServer(t, func(m *Message, req PasswordModifyRequest) error {
+		got = req
+		return nil
+	})
+
+	conn := dialAndBind(t, addr)
+	defer conn.Close()
+
+	res, err := conn.PasswordModify(goldap.NewPasswordModifyRequest("uid=alice,dc=example", "old", "new"))
+	if err != nil {
+		t.Fatalf("password modify: %v", err)
+	}
+	if res.GeneratedPassword != "" {
+		t.Fatalf("expected no generated password, got %q", res.GeneratedPassword)
+	}
+	if got.UserIdentity != "uid=alice,dc=example" || string(got.OldPassword) != "old" || string(got.NewPassword) != "new" || got.Generated {
+		t.Fatalf("unexpected request passed to handler: %+v", got)
+	}
+}
+
+func TestE2E_PasswordModifyGenerated(t *testing.T) {
+	var got PasswordModifyRequest
+	addr := startPasswordModifyServer(t, func(m *Message, req PasswordModifyRequest) error {
+		got = req
+		return nil
+	})
+
+	conn := dialAndBind(t, addr)
+	defer conn.Close()
+
+	res, err := conn.PasswordModify(goldap.NewPasswordModifyRequest("", "old", ""))
+	if err != nil {
+		t.Fatalf("password modify: %v", err)
+	}
+	if len(res.GeneratedPassword) != 16 {
+		t.Fatalf("expected a 16 character generated password, got %q", res.GeneratedPassword)
+	}
+	if !got.Generated || string(got.NewPassword) != res.GeneratedPassword {
+		t.Fatalf("expected handler to receive the generated password, got %+v", got)
+	}
+}
+
+func TestE2E_PasswordModifyError(t *testing.T) {
+	addr := startPasswordModifyServer(t, func(m *Message, req PasswordModifyRequest) error {
+		return NewResultError(LDAPResultInsufficientAccessRights, "not allowed")
+	})
+
+	conn := dialAndBind(t, addr)
+	defer conn.Close()
+
+	_, err := conn.PasswordModify(goldap.NewPasswordModifyRequest("uid=bob,dc=example", "", "new"))
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultInsufficientAccessRights) {
+		t.Fatalf("expected InsufficientAccessRights, got: %v", err)
+	}
+}
+
+func TestE2E_PasswordModifyBackendError(t *testing.T) {
+	addr := startPasswordModifyServer(t, func(m *Message, req PasswordModifyRequest) error {
+		return errors.New("db01.internal: connection refused")
+	})
+
+	conn := dialAndBind(t, addr)
+	defer conn.Close()
+
+	_, err := conn.PasswordModify(goldap.NewPasswordModifyRequest("uid=bob,dc=example", "", "new"))
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultOther) {
+		t.Fatalf("expected Other, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "db01") {
+		t.Fatalf("backend error leaked to the client: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package ldapserver
+
+import (
+	"net"
+	"syscall"
+)
+
+// unixPeerCredentials returns the credentials of the process at the other
+// end of a Unix domain socket, as reported by SO_PEERCRED.
+func unixPeerCredentials(conn *net.UnixConn) (uid, gid, pid int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, 0, credErr
+	}
+	return int(cred.Uid), int(cred.Gid), int(cred.Pid), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ldapserver
+
+import (
+	"errors"
+	"net"
+)
+
+// unixPeerCredentials is only implemented on Linux.
+func unixPeerCredentials(conn *net.UnixConn) (uid, gid, pid int, err error) {
+	return 0, 0, 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,181 @@
+// Package policy decides which connections an ldapserver.Server accepts:
+//
+//	p := &policy.Policy{
+//		Deny:                []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")},
+//		Allow:               []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+//		RequireTLS:          []netip.Prefix{netip.MustParsePrefix("10.2.0.0/16")},
+//		MaxConnectionsPerIP: 20,
+//		Server:              server,
+//	}
+//	server.OnNewConnection = p.OnNewConnection
+//
+// A rejected client gets a Notice of Disconnection carrying the reason of
+// the rejection, and its connection is closed.
+//
+// The rules are checked against the IP address of the client, which is the
+// address sent by a trusted load balancer when the server decodes the PROXY
+// protocol. Connections without an IP address, such as LDAPI connections,
+// are accepted.
+package policy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// DefaultReverseDNSTimeout is the time allowed to the reverse DNS check
+// when Policy.ReverseDNSTimeout is zero.
+const DefaultReverseDNSTimeout = 5 * time.Second
+
+// Resolver resolves the names of the clients. *net.Resolver implements it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Policy is an admission policy of the connections of a server. The rules
+// are checked in the order of the fields. Configure a Policy before
+// serving connections.
+type Policy struct {
+	// Deny rejects the clients in these networks.
+	Deny []netip.Prefix
+	// Allow, if not empty, rejects the clients outside of these networks.
+	Allow []netip.Prefix
+
+	// RequireTLS rejects the clients in these networks connecting without
+	// implicit TLS (LDAPS), unless a trusted load balancer terminated TLS
+	// and said so in its PROXY protocol header. Serve them on a listener in
+	// the TLSStartTLSRequired mode to let them use StartTLS instead.
+	RequireTLS []netip.Prefix
+
+	// MaxConnectionsPerIP, if positive, rejects the connections of a
+	// client beyond this number of open connections. It requires Server.
+	MaxConnectionsPerIP int
+	// Server is the server whose connections are counted.
+	Server *ldap.Server
+
+	// ReverseDNS rejects the clients whose address has no name resolving
+	// back to it. When ReverseDNSDomains is not empty, the name must also
+	// be in one of these domains.
+	ReverseDNS        bool
+	ReverseDNSDomains []string
+	ReverseDNSTimeout time.Duration // DefaultReverseDNSTimeout if zero
+	Resolver          Resolver      // net.DefaultResolver if nil
+}
+
+// OnNewConnection checks a new connection against the policy. It returns
+// an *ldap.ResultError carrying the result code and the reason sent in the
+// Notice of Disconnection of a rejected client.
+func (p *Policy) OnNewConnection(conn net.Conn) error {
+	tcp, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	ip, _ := netip.AddrFromSlice(tcp.IP)
+	ip = ip.Unmap()
+
+	if contains(p.Deny, ip) {
+		return ldap.NewResultError(ldap.LDAPResultUnavailable, "connections from "+ip.String()+" are denied")
+	}
+	if len(p.Allow) > 0 && !contains(p.Allow, ip) {
+		return ldap.NewResultError(ldap.LDAPResultUnavailable, "connections from "+ip.String()+" are not allowed")
+	}
+	if !isTLS(conn) && contains(p.RequireTLS, ip) {
+		return ldap.NewResultError(ldap.LDAPResultStrongAuthRequired, "TLS is required: use LDAPS")
+	}
+	if p.MaxConnectionsPerIP > 0 && p.connections(ip) > p.MaxConnectionsPerIP {
+		return ldap.NewResultError(ldap.LDAPResultUnavailable,
+			fmt.Sprintf("too many connections from %s", ip))
+	}
+	if p.ReverseDNS {
+		if err := p.checkReverseDNS(ip); err != nil {
+			return ldap.NewResultError(ldap.LDAPResultUnavailable, err.Error())
+		}
+	}
+	return nil
+}
+
+// isTLS reports whether conn is a TLS connection, or a connection whose
+// TLS session was terminated by a load balancer.
+func isTLS(conn net.Conn) bool {
+	if _, ok := conn.(*tls.Conn); ok {
+		return true
+	}
+	header, ok := ldap.ConnProxyHeader(conn)
+	return ok && header.TLS != nil
+}
+
+// connections returns the number of open connections of ip, including the
+// new one.
+func (p *Policy) connections(ip netip.Addr) int {
+	n := 0
+	for _, c := range p.Server.Connections() {
+		if tcp, ok := c.RemoteAddr.(*net.TCPAddr); ok {
+			if addr, _ := netip.AddrFromSlice(tcp.IP); addr.Unmap() == ip {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// checkReverseDNS checks that a name of ip resolves back to it, and is in
+// one of the ReverseDNSDomains if any.
+func (p *Policy) checkReverseDNS(ip netip.Addr) error {
+	timeout := p.ReverseDNSTimeout
+	if timeout == 0 {
+		timeout = DefaultReverseDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var resolver Resolver = net.DefaultResolver
+	if p.Resolver != nil {
+		resolver = p.Resolver
+	}
+
+	names, _ := resolver.LookupAddr(ctx, ip.String())
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !inDomains(name, p.ReverseDNSDomains) {
+			continue
+		}
+		addrs, _ := resolver.LookupIPAddr(ctx, name)
+		for _, a := range addrs {
+			if addr, _ := netip.AddrFromSlice(a.IP); addr.Unmap() == ip {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no verified host name for %s", ip)
+}
+
+func contains(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDomains reports whether name is one of domains or below one of them.
+// Every name is in an empty list of domains.
+func inDomains(name string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
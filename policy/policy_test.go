@@ -0,0 +1,228 @@
+package policy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// testConn is a connection from a remote address.
+type testConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c testConn) RemoteAddr() net.Addr { return c.remote }
+
+func tcpConn(ip string) net.Conn {
+	return testConn{remote: net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(ip), 50000))}
+}
+
+// testResolver resolves from static tables.
+type testResolver struct {
+	names map[string][]string
+	addrs map[string][]string
+}
+
+func (r testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.names[addr]; ok {
+		return names, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, a := range r.addrs[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	return addrs, nil
+}
+
+func TestPolicy_OnNewConnection(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		var p []netip.Prefix
+		for _, prefix := range s {
+			p = append(p, netip.MustParsePrefix(prefix))
+		}
+		return p
+	}
+	resolver := testResolver{
+		names: map[string][]string{
+			"192.0.2.1": {"ldap1.example.com."},
+			"192.0.2.2": {"spoofed.example.com."},
+			"192.0.2.3": {"host.example.org."},
+		},
+		addrs: map[string][]string{
+			"ldap1.example.com":   {"192.0.2.1"},
+			"spoofed.example.com": {"198.51.100.7"},
+			"host.example.org":    {"192.0.2.3"},
+		},
+	}
+	tests := []struct {
+		name   string
+		policy Policy
+		conn   net.Conn
+		code   int // 0 when accepted
+	}{
+		{"empty policy", Policy{}, tcpConn("192.0.2.1"), 0},
+		{"denied", Policy{Deny: prefixes("192.0.2.0/24")}, tcpConn("192.0.2.1"), ldap.LDAPResultUnavailable},
+		{"deny before allow", Policy{Deny: prefixes("192.0.2.1/32"), Allow: prefixes("192.0.2.0/24")}, tcpConn("192.0.2.1"), ldap.LDAPResultUnavailable},
+		{"allowed", Policy{Deny: prefixes("192.0.2.1/32"), Allow: prefixes("192.0.2.0/24")}, tcpConn("192.0.2.2"), 0},
+		{"not allowed", Policy{Allow: prefixes("10.0.0.0/8")}, tcpConn("192.0.2.1"), ldap.LDAPResultUnavailable},
+		{"IPv4-mapped IPv6", Policy{Deny: prefixes("192.0.2.0/24")}, tcpConn("::ffff:192.0.2.1"), ldap.LDAPResultUnavailable},
+		{"IPv6", Policy{Allow: prefixes("2001:db8::/32")}, tcpConn("2001:db8::1"), 0},
+		{"TLS required", Policy{RequireTLS: prefixes("192.0.2.0/24")}, tcpConn("192.0.2.1"), ldap.LDAPResultStrongAuthRequired},
+		{"TLS required elsewhere", Policy{RequireTLS: prefixes("10.0.0.0/8")}, tcpConn("192.0.2.1"), 0},
+		{"TLS", Policy{RequireTLS: prefixes("192.0.2.0/24")}, tls.Server(tcpConn("192.0.2.1"), &tls.Config{}), 0},
+		{"unix socket", Policy{Allow: prefixes("10.0.0.0/8")}, testConn{remote: &net.UnixAddr{Name: "@", Net: "unix"}}, 0},
+		{"reverse DNS", Policy{ReverseDNS: true, Resolver: resolver}, tcpConn("192.0.2.1"), 0},
+		{"reverse DNS not confirmed", Policy{ReverseDNS: true, Resolver: resolver}, tcpConn("192.0.2.2"), ldap.LDAPResultUnavailable},
+		{"no reverse DNS", Policy{ReverseDNS: true, Resolver: resolver}, tcpConn("192.0.2.9"), ldap.LDAPResultUnavailable},
+		{"reverse DNS domain", Policy{ReverseDNS: true, ReverseDNSDomains: []string{"Example.com."}, Resolver: resolver}, tcpConn("192.0.2.1"), 0},
+		{"reverse DNS other domain", Policy{ReverseDNS: true, ReverseDNSDomains: []string{"example.com"}, Resolver: resolver}, tcpConn("192.0.2.3"), ldap.LDAPResultUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.OnNewConnection(tt.conn)
+			var re *ldap.ResultError
+			switch {
+			case tt.code == 0 && err != nil:
+				t.Errorf("rejected: %v", err)
+			case tt.code != 0 && (!errors.As(err, &re) || re.ResultCode != tt.code):
+				t.Errorf("got %v, expected result code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+// proxiedConn returns a connection accepted behind a trusted load balancer
+// sending a PROXY protocol v2 header from 192.0.2.1, with an SSL TLV when
+// ssl is set.
+func proxiedConn(t *testing.T, ssl bool) net.Conn {
+	t.Helper()
+	protocol := &ldap.ProxyProtocol{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln = protocol.Listener(ln)
+	t.Cleanup(func() { ln.Close() })
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	payload := []byte{192, 0, 2, 1, 127, 0, 0, 1, 0xc3, 0x50, 0x01, 0x85}
+	if ssl {
+		version := append([]byte{0x21, 0, 7}, "TLSv1.3"...)
+		tlv := append([]byte{0x01, 0, 0, 0, 0}, version...)
+		payload = append(append(payload, 0x20, 0, byte(len(tlv))), tlv...)
+	}
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11"), 0, byte(len(payload)))
+	if _, err := client.Write(append(header, payload...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestPolicy_RequireTLSBehindProxy(t *testing.T) {
+	p := &Policy{RequireTLS: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}
+	if err := p.OnNewConnection(proxiedConn(t, true)); err != nil {
+		t.Errorf("TLS terminated by the load balancer rejected: %v", err)
+	}
+	var re *ldap.ResultError
+	if err := p.OnNewConnection(proxiedConn(t, false)); !errors.As(err, &re) || re.ResultCode != ldap.LDAPResultStrongAuthRequired {
+		t.Errorf("got %v, expected strongAuthRequired", err)
+	}
+}
+
+// readNotice reads the next message of conn, expected to be a Notice of
+// Disconnection, and returns its result code and diagnostic message.
+func readNotice(t *testing.T, conn net.Conn) (int, string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := ber.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	op := p.Children[1]
+	if op.Tag != ber.Tag(ldap.ApplicationExtendedResponse) || len(op.Children) < 4 ||
+		string(op.Children[3].Data.Bytes()) != string(ldap.NoticeOfDisconnection) {
+		t.Fatalf("expected a Notice of Disconnection, got %v", op)
+	}
+	return int(op.Children[0].Value.(int64)), op.Children[2].Value.(string)
+}
+
+func TestE2E_MaxConnectionsPerIP(t *testing.T) {
+	server := ldap.NewServer()
+	routes := ldap.NewRouteMux()
+	routes.Bind(func(w ldap.ResponseWriter, m *ldap.Message) {
+		w.Write(ldap.NewBindResponse(ldap.LDAPResultSuccess))
+	})
+	server.Handle(routes)
+	p := &Policy{MaxConnectionsPerIP: 2, Server: server}
+	server.OnNewConnection = p.OnNewConnection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(ln)
+	defer server.Stop()
+
+	var conns []*goldap.Conn
+	for range 2 {
+		conn, err := goldap.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		if err := conn.Bind("cn=alice", "secret"); err != nil {
+			t.Fatalf("bind: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	rejected, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer rejected.Close()
+	if code, diag := readNotice(t, rejected); code != ldap.LDAPResultUnavailable || diag != "too many connections from 127.0.0.1" {
+		t.Errorf("notice %d %q", code, diag)
+	}
+	if _, err := ber.ReadPacket(rejected); err == nil {
+		t.Error("connection not closed after the notice")
+	}
+
+	conns[0].Close()
+	for range 100 {
+		if len(server.Connections()) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("cn=alice", "secret"); err != nil {
+		t.Errorf("bind after a connection closed: %v", err)
+	}
+}
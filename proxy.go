@@ -0,0 +1,558 @@
+package ldapserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// Proxy is a Handler forwarding requests to upstream LDAP servers:
+//
+//	server.Handle(ldap.NewProxy("ldap1.example.com:389", "ldaps://ldap2.example.com"))
+//
+// Each client connection gets its own upstream connection, opened on its
+// first request, so that upstream servers see the bind identity of each
+// client. Requests keep their controls, and responses are relayed as they
+// arrive, including search results and intermediate responses. Abandon
+// requests, Cancel requests and requests abandoned locally (the Done
+// channel of the Message) are propagated upstream.
+//
+// Upstreams are tried in order, starting from the last one that could be
+// reached. When an upstream connection breaks, the requests in progress
+// fail with unavailable (52) and the next request reconnects, to the next
+// upstream if needed, replaying the last successful simple bind of the
+// client. SASL binds cannot be replayed: the client becomes anonymous.
+//
+// StartTLS requests are not forwarded; route them to a local handler:
+//
+//	routes.Extended(handleStartTLS).RequestName(ldap.NoticeOfStartTLS)
+//	routes.NotFound(proxy.ServeLDAP)
+//
+// A RouteMux answers Cancel, Who am I? and Get Connection ID requests
+// itself before trying its NotFound route, so a Proxy behind a RouteMux
+// only sees them when they are routed to it:
+//
+//	routes.Extended(proxy.ServeLDAP).RequestName(ldap.NoticeOfCancel)
+//	routes.Extended(proxy.ServeLDAP).RequestName(ldap.NoticeOfWhoAmI)
+type Proxy struct {
+	// Upstreams are the addresses of the upstream servers, as host:port,
+	// ldap://host:port or ldaps://host:port.
+	Upstreams []string
+	// TLSConfig is the TLS configuration of ldaps:// upstreams.
+	TLSConfig *tls.Config
+	// DialTimeout is the timeout to connect to an upstream. The default is
+	// five seconds.
+	DialTimeout time.Duration
+
+	mutex    sync.Mutex
+	next     int // index of the upstream to try first
+	sessions map[*client]*proxySession
+}
+
+// NewProxy returns a Proxy to the upstreams.
+func NewProxy(upstreams ...string) *Proxy {
+	return &Proxy{Upstreams: upstreams}
+}
+
+func (p *Proxy) ServeLDAP(w ResponseWriter, m *Message) {
+	s := p.session(m.Client)
+	switch r := m.ProtocolOp().(type) {
+	case ldap.AbandonRequest:
+		s.abandon(int(r))
+		return
+	case ldap.ExtendedRequest:
+		switch r.RequestName() {
+		case NoticeOfStartTLS:
+			res := NewExtendedResponse(LDAPResultUnwillingToPerform)
+			res.SetDiagnosticMessage("StartTLS is not forwarded by the proxy")
+			w.Write(res)
+			return
+		case NoticeOfCancel:
+			s.cancel(w, m)
+			return
+		}
+	}
+	s.forward(w, m, m.LDAPMessage)
+}
+
+// session returns the state of the client c, created on its first request.
+func (p *Proxy) session(c *client) *proxySession {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if s, ok := p.sessions[c]; ok {
+		return s
+	}
+	if p.sessions == nil {
+		p.sessions = make(map[*client]*proxySession)
+	}
+	s := &proxySession{proxy: p, client: c, requests: make(map[int]int)}
+	p.sessions[c] = s
+	c.onClose(func() {
+		p.mutex.Lock()
+		delete(p.sessions, c)
+		p.mutex.Unlock()
+		s.close()
+	})
+	return s
+}
+
+// dial connects to the first reachable upstream, starting from the last
+// one reached.
+func (p *Proxy) dial() (*upstreamConn, error) {
+	p.mutex.Lock()
+	start := p.next
+	p.mutex.Unlock()
+	if len(p.Upstreams) == 0 {
+		return nil, errors.New("no upstream server")
+	}
+	var errs []error
+	for i := range p.Upstreams {
+		index := (start + i) % len(p.Upstreams)
+		conn, err := p.dialUpstream(p.Upstreams[index])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p.mutex.Lock()
+		p.next = index
+		p.mutex.Unlock()
+		return newUpstreamConn(conn), nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (p *Proxy) dialUpstream(upstream string) (net.Conn, error) {
+	timeout := p.DialTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if addr, ok := strings.CutPrefix(upstream, "ldaps://"); ok {
+		return tls.DialWithDialer(dialer, "tcp", addr, p.TLSConfig)
+	}
+	return dialer.Dial("tcp", strings.TrimPrefix(upstream, "ldap://"))
+}
+
+// proxySession is the state of a client connection of a Proxy.
+type proxySession struct {
+	proxy  *Proxy
+	client *client
+
+	mutex    sync.Mutex
+	upstream *upstreamConn
+	requests map[int]int // upstream message IDs of the requests in progress
+	// bind is the last successful simple BindRequest, replayed on new
+	// upstream connections.
+	bind *ldap.LDAPMessage
+	// saslBound is set while the client is bound with SASL.
+	saslBound bool
+}
+
+// connect returns the upstream connection of s, opening one if needed.
+func (s *proxySession) connect() (*upstreamConn, error) {
+	s.mutex.Lock()
+	if up := s.upstream; up != nil && !up.failed() {
+		s.mutex.Unlock()
+		return up, nil
+	}
+	if s.upstream != nil {
+		s.client.log.Info("upstream connection lost", "error", s.upstream.error())
+		s.upstream = nil
+	}
+	bind := s.bind
+	s.mutex.Unlock()
+
+	// Dial without holding the lock, not to block the Abandon and Cancel
+	// requests of the client on a slow upstream.
+	up, err := s.proxy.connect(bind)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	if current := s.upstream; current != nil && !current.failed() {
+		// Another request of the client connected first.
+		s.mutex.Unlock()
+		up.unbind()
+		return current, nil
+	}
+	if bind == nil && s.saslBound {
+		s.saslBound = false
+		s.client.SetAuthzID("")
+	}
+	s.upstream = up
+	s.mutex.Unlock()
+	return up, nil
+}
+
+// connect opens an upstream connection and replays bind on it, if not nil.
+func (p *Proxy) connect(bind *ldap.LDAPMessage) (*upstreamConn, error) {
+	for attempt := 0; attempt < len(p.Upstreams); attempt++ {
+		up, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+		if bind == nil {
+			return up, nil
+		}
+		// Restore the identity of the client.
+		if code, err := up.roundTrip(bind); err == nil && code == LDAPResultSuccess {
+			return up, nil
+		}
+		up.unbind()
+		p.mutex.Lock()
+		p.next++
+		p.mutex.Unlock()
+	}
+	if len(p.Upstreams) == 0 {
+		return nil, errors.New("no upstream server")
+	}
+	return nil, errors.New("cannot restore the bind identity on any upstream")
+}
+
+// forward sends msg, the request of m, upstream and relays the responses.
+func (s *proxySession) forward(w ResponseWriter, m *Message, msg *ldap.LDAPMessage) {
+	up, err := s.connect()
+	if err != nil {
+		s.client.log.Warn("upstream unavailable", "error", err)
+		if res := newErrorResponse(msg.ProtocolOp(), LDAPResultUnavailable, "upstream server unavailable"); res != nil {
+			w.Write(res)
+		}
+		return
+	}
+	id, req, err := up.send(msg)
+	if err != nil {
+		if res := newErrorResponse(msg.ProtocolOp(), LDAPResultUnavailable, "upstream server unavailable"); res != nil {
+			w.Write(res)
+		}
+		return
+	}
+	clientID := m.MessageID().Int()
+	s.mutex.Lock()
+	s.requests[clientID] = id
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		if s.requests[clientID] == id {
+			delete(s.requests, clientID)
+		}
+		s.mutex.Unlock()
+	}()
+
+	// relay writes a response to the client and reports whether it is the
+	// last one.
+	relay := func(res *ldap.LDAPMessage) bool {
+		if r, ok := msg.ProtocolOp().(ldap.BindRequest); ok {
+			s.bindResponded(msg, r, res.ProtocolOp())
+		}
+		var controls []ldap.Control
+		if c := res.Controls(); c != nil {
+			controls = *c
+		}
+		WriteWithControls(w, res.ProtocolOp(), controls...)
+		if isFinalResponse(res.ProtocolOp()) {
+			up.done(id)
+			return true
+		}
+		return false
+	}
+	for {
+		select {
+		case res := <-req.responses:
+			if relay(res) {
+				return
+			}
+		case <-m.Done:
+			up.abandon(id)
+			return
+		case <-req.abandoned:
+			return
+		case <-up.closed:
+			// Relay the responses received before the connection failed.
+			for {
+				select {
+				case res := <-req.responses:
+					if relay(res) {
+						return
+					}
+					continue
+				default:
+				}
+				break
+			}
+			if res := newErrorResponse(msg.ProtocolOp(), LDAPResultUnavailable, "upstream connection lost"); res != nil {
+				w.Write(res)
+			}
+			return
+		}
+	}
+}
+
+// bindResponded keeps track of the identity of the client.
+func (s *proxySession) bindResponded(msg *ldap.LDAPMessage, req ldap.BindRequest, res ldap.ProtocolOp) {
+	code, _ := responseResultCode(res)
+	if code == LDAPResultSaslBindInProgress {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bind, s.saslBound = nil, false
+	if code == LDAPResultSuccess {
+		if req.AuthenticationChoice() == "sasl" {
+			s.saslBound = true
+		} else {
+			s.bind = msg
+		}
+	}
+}
+
+// abandon abandons upstream the request of the client with message ID
+// clientID, if it is in progress.
+func (s *proxySession) abandon(clientID int) {
+	s.mutex.Lock()
+	id, ok := s.requests[clientID]
+	up := s.upstream
+	s.mutex.Unlock()
+	if ok && up != nil {
+		up.abandon(id)
+	}
+}
+
+// cancel forwards the Cancel request of m with the upstream message ID of
+// the request to cancel.
+func (s *proxySession) cancel(w ResponseWriter, m *Message) {
+	r := m.GetExtendedRequest()
+	clientID, err := parseCancelRequestValue(r.RequestValue())
+	if err != nil {
+		res := NewExtendedResponse(LDAPResultProtocolError)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+	s.mutex.Lock()
+	id, ok := s.requests[clientID]
+	s.mutex.Unlock()
+	if !ok {
+		w.Write(NewExtendedResponse(LDAPResultNoSuchOperation))
+		return
+	}
+	value, _ := asn1.Marshal(cancelRequestValue{CancelID: id})
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.TagExtendedRequest, nil, "Extended Request")
+	p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, string(NoticeOfCancel), "requestName"))
+	p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(value), "requestValue"))
+	po, err := decodeProtocolOp(p)
+	if err != nil {
+		w.Write(NewExtendedResponse(LDAPResultOther))
+		return
+	}
+	msg := ldap.NewLDAPMessageWithProtocolOp(po)
+	msg.SetControls(m.Controls())
+	s.forward(w, m, msg)
+}
+
+// close closes the upstream connection.
+func (s *proxySession) close() {
+	s.mutex.Lock()
+	up := s.upstream
+	s.upstream = nil
+	s.mutex.Unlock()
+	if up != nil {
+		up.unbind()
+	}
+}
+
+// isFinalResponse reports whether po ends the responses to a request.
+func isFinalResponse(po ldap.ProtocolOp) bool {
+	switch po.(type) {
+	case ldap.SearchResultEntry, ldap.SearchResultReference, ldap.IntermediateResponse:
+		return false
+	}
+	return true
+}
+
+// upstreamConn is a connection to an upstream server, multiplexing the
+// requests of a client connection.
+type upstreamConn struct {
+	conn   net.Conn
+	closed chan struct{} // closed once the connection failed
+
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	lastID     int
+	pending    map[int]*upstreamRequest
+	err        error
+}
+
+// upstreamRequest is a request in progress on an upstream connection.
+type upstreamRequest struct {
+	responses chan *ldap.LDAPMessage
+	abandoned chan struct{} // closed once the request is abandoned
+}
+
+func newUpstreamConn(conn net.Conn) *upstreamConn {
+	up := &upstreamConn{
+		conn:    conn,
+		closed:  make(chan struct{}),
+		pending: make(map[int]*upstreamRequest),
+	}
+	go up.read()
+	return up
+}
+
+// read dispatches the responses received to the pending requests until
+// the connection fails.
+func (up *upstreamConn) read() {
+	br := bufio.NewReader(up.conn)
+	for {
+		p, err := readMessagePacket(br)
+		if err != nil {
+			up.fail(err)
+			return
+		}
+		m, err := p.readMessage()
+		if err != nil {
+			up.fail(err)
+			return
+		}
+		id := m.MessageID().Int()
+		if id == 0 {
+			// Unsolicited notification, such as a Notice of Disconnection.
+			up.fail(fmt.Errorf("upstream notice: %s", m.ProtocolOpName()))
+			return
+		}
+		up.mutex.Lock()
+		req, ok := up.pending[id]
+		up.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case req.responses <- &m:
+		case <-req.abandoned:
+		case <-up.closed:
+			return
+		}
+	}
+}
+
+// fail closes the connection, ending the pending requests.
+func (up *upstreamConn) fail(err error) {
+	up.mutex.Lock()
+	defer up.mutex.Unlock()
+	if up.err != nil {
+		return
+	}
+	up.err = err
+	close(up.closed)
+	up.conn.Close()
+}
+
+func (up *upstreamConn) failed() bool {
+	return up.error() != nil
+}
+
+func (up *upstreamConn) error() error {
+	up.mutex.Lock()
+	defer up.mutex.Unlock()
+	return up.err
+}
+
+// send sends msg with a new message ID, and returns the ID and the state
+// of the request.
+func (up *upstreamConn) send(msg *ldap.LDAPMessage) (int, *upstreamRequest, error) {
+	up.mutex.Lock()
+	if up.err != nil {
+		up.mutex.Unlock()
+		return 0, nil, up.err
+	}
+	up.lastID++
+	id := up.lastID
+	req := &upstreamRequest{
+		responses: make(chan *ldap.LDAPMessage, 16),
+		abandoned: make(chan struct{}),
+	}
+	up.pending[id] = req
+	up.mutex.Unlock()
+
+	out := *msg
+	out.SetMessageID(id)
+	data, err := out.Write()
+	if err == nil {
+		err = up.write(data.Bytes())
+	}
+	if err != nil {
+		up.done(id)
+		return 0, nil, err
+	}
+	return id, req, nil
+}
+
+func (up *upstreamConn) write(data []byte) error {
+	up.writeMutex.Lock()
+	defer up.writeMutex.Unlock()
+	_, err := up.conn.Write(data)
+	if err != nil {
+		up.fail(err)
+	}
+	return err
+}
+
+// roundTrip sends msg and returns the result code of its response.
+func (up *upstreamConn) roundTrip(msg *ldap.LDAPMessage) (int, error) {
+	id, req, err := up.send(msg)
+	if err != nil {
+		return 0, err
+	}
+	defer up.done(id)
+	select {
+	case res := <-req.responses:
+		code, _ := responseResultCode(res.ProtocolOp())
+		return code, nil
+	case <-up.closed:
+		return 0, up.error()
+	}
+}
+
+// done forgets the request id.
+func (up *upstreamConn) done(id int) {
+	up.mutex.Lock()
+	delete(up.pending, id)
+	up.mutex.Unlock()
+}
+
+// abandon sends an AbandonRequest for the request id, if it is in
+// progress, and ends it.
+func (up *upstreamConn) abandon(id int) {
+	up.mutex.Lock()
+	req, ok := up.pending[id]
+	delete(up.pending, id)
+	up.lastID++
+	abandonID := up.lastID
+	up.mutex.Unlock()
+	if !ok {
+		return
+	}
+	close(req.abandoned)
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, abandonID, "messageID"))
+	envelope.AppendChild(ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, ldap.TagAbandonRequest, id, "Abandon Request"))
+	up.write(envelope.Bytes())
+}
+
+// unbind sends an UnbindRequest and closes the connection.
+func (up *upstreamConn) unbind() {
+	up.mutex.Lock()
+	up.lastID++
+	id := up.lastID
+	up.mutex.Unlock()
+	up.write(unbindPDU(id))
+	up.fail(net.ErrClosed)
+}
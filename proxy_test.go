@@ -0,0 +1,163 @@
+package ldapserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// startProxyBackend starts a backend server naming its entries after name.
+// Searches of dc=slow block until abandoned, which is signaled on
+// abandoned.
+func startProxyBackend(t *testing.T, name string, abandoned chan<- int) (addr string, stop func()) {
+	t.Helper()
+	routes := NewRouteMux()
+	routes.Bind(handleBindTest)
+	routes.Search(func(w ResponseWriter, m *Message) {
+		select {
+		case <-m.Done:
+			abandoned <- m.MessageID().Int()
+		case <-time.After(5 * time.Second):
+			w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+		}
+	}).BaseDn("dc=slow")
+	routes.Search(func(w ResponseWriter, m *Message) {
+		r := m.GetSearchRequest()
+		e := NewSearchResultEntry("cn=" + name + "," + string(r.BaseObject()))
+		e.AddAttribute("cn", ldap.AttributeValue(name))
+		w.Write(e)
+		var controls []ldap.Control
+		if c := m.Controls(); c != nil {
+			controls = *c
+		}
+		WriteWithControls(w, NewSearchResultDoneResponse(LDAPResultSuccess), controls...)
+	})
+	return serveTest(t, nil, routes)
+}
+
+func startProxy(t *testing.T, proxy *Proxy) (addr string, stop func()) {
+	t.Helper()
+	return serveTest(t, nil, proxy)
+}
+
+func TestE2E_Proxy(t *testing.T) {
+	abandoned := make(chan int, 1)
+	backend, stopBackend := startProxyBackend(t, "a", abandoned)
+	defer stopBackend()
+	addr, stop := startProxy(t, NewProxy("ldap://"+backend))
+	defer stop()
+
+	conn := dialAndBind(t, addr)
+	defer conn.Close()
+	res, err := conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, []goldap.Control{goldap.NewControlString("1.2.3.4", false, "value")}))
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].DN != "cn=a,dc=example" {
+		t.Fatalf("unexpected entries %v", res.Entries)
+	}
+	if len(res.Controls) != 1 || res.Controls[0].GetControlType() != "1.2.3.4" {
+		t.Fatalf("request control not forwarded: %v", res.Controls)
+	}
+
+	// The bind identity is kept per client connection.
+	if who, err := conn.WhoAmI(nil); err != nil || who.AuthzID != "dn:cn=test" {
+		t.Fatalf("bound whoami = %v, %v", who, err)
+	}
+	anonymous, err := goldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer anonymous.Close()
+	if who, err := anonymous.WhoAmI(nil); err != nil || who.AuthzID != "" {
+		t.Fatalf("anonymous whoami = %v, %v", who, err)
+	}
+	if err := anonymous.Bind("cn=test", "wrong"); !goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+}
+
+func TestE2E_ProxyAbandon(t *testing.T) {
+	abandoned := make(chan int, 1)
+	backend, stopBackend := startProxyBackend(t, "a", abandoned)
+	defer stopBackend()
+	addr, stop := startProxy(t, NewProxy(backend))
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	send := func(messageID int, op *ber.Packet) {
+		envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+		envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
+		envelope.AppendChild(op)
+		conn.Write(envelope.Bytes())
+	}
+	search := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 3, nil, "Search Request")
+	search.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "dc=slow", "baseObject"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "scope"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "derefAliases"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "sizeLimit"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "timeLimit"))
+	search.AppendChild(ber.NewLDAPBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "typesOnly"))
+	search.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, "objectClass", "present"))
+	search.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes"))
+	send(5, search)
+	time.Sleep(100 * time.Millisecond)
+	send(6, ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, 16, 5, "Abandon Request"))
+
+	select {
+	case <-abandoned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("abandon not propagated upstream")
+	}
+	// The abandoned search gets no response.
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if p, err := ber.ReadPacket(conn); err == nil {
+		t.Fatalf("unexpected response %v", p)
+	}
+}
+
+func TestE2E_ProxyFailover(t *testing.T) {
+	backendA, stopA := startProxyBackend(t, "a", nil)
+	defer stopA()
+	backendB, stopB := startProxyBackend(t, "b", nil)
+	defer stopB()
+	addr, stop := startProxy(t, NewProxy(backendA, backendB))
+	defer stop()
+
+	conn := dialAndBind(t, addr)
+	defer conn.Close()
+	search := func() (*goldap.SearchResult, error) {
+		return conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+			0, 0, false, "(objectClass=*)", nil, nil))
+	}
+	if res, err := search(); err != nil || res.Entries[0].DN != "cn=a,dc=example" {
+		t.Fatalf("search on a: %v, %v", res, err)
+	}
+
+	stopA()
+	// Requests in progress when the upstream is lost fail with unavailable,
+	// the next ones go to b.
+	var res *goldap.SearchResult
+	var err error
+	for i := 0; i < 20; i++ {
+		if res, err = search(); err == nil || !goldap.IsErrorWithCode(err, goldap.LDAPResultUnavailable) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil || res.Entries[0].DN != "cn=b,dc=example" {
+		t.Fatalf("search after failover: %v, %v", res, err)
+	}
+	if who, err := conn.WhoAmI(nil); err != nil || who.AuthzID != "dn:cn=test" {
+		t.Fatalf("bind identity not restored on b: %v, %v", who, err)
+	}
+}
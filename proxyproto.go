@@ -0,0 +1,396 @@
+package ldapserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol decodes the PROXY protocol headers (versions 1 and 2) sent
+// by load balancers such as HAProxy or AWS NLB at the start of the
+// connections they forward, so that Addr(), logs and OnNewConnection see
+// the address of the real client. Set Server.ProxyProtocol before serving:
+//
+//	server.ProxyProtocol = &ldap.ProxyProtocol{
+//		Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+//	}
+//
+// Connections from trusted sources must start with a header, and are
+// closed otherwise. The TLS information of version 2 headers is available
+// with m.Client.ProxyHeader().
+type ProxyProtocol struct {
+	// Trusted are the networks of the load balancers. Connections from
+	// other sources are served without a header, with their own address.
+	// When empty, every connection must start with a header.
+	Trusted []netip.Prefix
+	// HeaderTimeout is the time allowed to receive the header. The default
+	// is five seconds.
+	HeaderTimeout time.Duration
+}
+
+// ProxyHeader is a PROXY protocol header.
+type ProxyHeader struct {
+	Version int // 1 or 2
+	// Source and Destination are the addresses of the client and of the
+	// load balancer, as seen by the load balancer. They are nil for
+	// connections opened by the load balancer itself (health checks).
+	Source, Destination net.Addr
+	// Authority is the host name sent by the client (SNI), if any.
+	Authority string
+	// TLS is the TLS session of the client, when the load balancer
+	// terminated it and sent its details (version 2 only).
+	TLS *ProxyTLS
+}
+
+// ProxyTLS is a TLS session terminated by a load balancer.
+type ProxyTLS struct {
+	Version    string // such as "TLSv1.3"
+	Cipher     string
+	ClientCert bool   // the client presented a certificate
+	Verified   bool   // the client certificate was verified
+	CommonName string // common name of the client certificate subject
+}
+
+// Listener returns a listener decoding the headers of the connections
+// accepted by ln. Headers are decoded on the first Read or RemoteAddr.
+func (p *ProxyProtocol) Listener(ln net.Listener) net.Listener {
+	return &proxyListener{Listener: ln, protocol: p}
+}
+
+// proxyProtocolListener returns ln decoding PROXY protocol headers if the
+// server is configured to.
+func (s *Server) proxyProtocolListener(ln net.Listener) net.Listener {
+	if s.ProxyProtocol == nil {
+		return ln
+	}
+	return s.ProxyProtocol.Listener(ln)
+}
+
+type proxyListener struct {
+	net.Listener
+	protocol *ProxyProtocol
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, protocol: l.protocol}, nil
+}
+
+// trusted reports whether addr must send a header.
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	if len(p.Trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+	for _, prefix := range p.Trusted {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection starting with a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	protocol *ProxyProtocol
+
+	once   sync.Once
+	br     *bufio.Reader
+	header *ProxyHeader // nil for untrusted sources
+	err    error
+}
+
+// readHeader decodes the header of the connection, once.
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.br = bufio.NewReader(c.Conn)
+		if !c.protocol.trusted(c.Conn.RemoteAddr()) {
+			return
+		}
+		timeout := c.protocol.HeaderTimeout
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+		c.header, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// proxiedConn returns the proxyConn under conn, or nil.
+func proxiedConn(conn net.Conn) *proxyConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	pc, _ := conn.(*proxyConn)
+	return pc
+}
+
+// readProxyHeader decodes the PROXY protocol header of the connection, if
+// the listener expects one. Stopping the server interrupts it.
+func (c *client) readProxyHeader() error {
+	pc := proxiedConn(c.rwc)
+	if pc == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.srv.chDone:
+			pc.Conn.Close()
+		case <-done:
+		}
+	}()
+	return pc.readHeader()
+}
+
+// ProxyHeader returns the PROXY protocol header the connection started
+// with. ok is false if it had none.
+func (c *client) ProxyHeader() (header ProxyHeader, ok bool) {
+	return ConnProxyHeader(c.conn())
+}
+
+// ConnProxyHeader returns the PROXY protocol header conn, a connection
+// accepted by the server, started with. ok is false if it had none. It
+// lets Server.OnNewConnection see the TLS session terminated by a load
+// balancer.
+func ConnProxyHeader(conn net.Conn) (header ProxyHeader, ok bool) {
+	pc := proxiedConn(conn)
+	if pc == nil || pc.readHeader() != nil || pc.header == nil {
+		return ProxyHeader{}, false
+	}
+	return *pc.header, true
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a version 1 or version 2 header.
+func readProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	signature, err := br.Peek(len(proxyV2Signature))
+	if err != nil && len(signature) < 6 {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch {
+	case bytes.Equal(signature, proxyV2Signature):
+		br.Discard(len(proxyV2Signature))
+		return readProxyHeaderV2(br)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		return readProxyHeaderV1(br)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 389\r\n".
+func readProxyHeaderV1(br *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	fields := strings.Split(text, " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", text)
+	}
+	source, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	header.Source, header.Destination = source, destination
+	return header, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol address: %w", err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// Type-length-values of version 2 headers.
+const (
+	proxyTLVAuthority  = 0x02
+	proxyTLVSSL        = 0x20
+	proxyTLVSSLVersion = 0x21
+	proxyTLVSSLCN      = 0x22
+	proxyTLVSSLCipher  = 0x23
+
+	proxyClientSSL      = 0x01
+	proxyClientCertConn = 0x02
+	proxyClientCertSess = 0x04
+)
+
+// readProxyHeaderV2 reads a binary header after its signature.
+func readProxyHeaderV2(br *bufio.Reader) (*ProxyHeader, error) {
+	var fixed [4]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	if fixed[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", fixed[0]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[2:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	header := &ProxyHeader{Version: 2}
+	switch fixed[0] & 0x0F {
+	case 0:
+		// LOCAL command: the connection was opened by the load balancer.
+		return header, nil
+	case 1: // PROXY command
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", fixed[0]&0x0F)
+	}
+
+	var addrLen int
+	switch fixed[1] >> 4 {
+	case 1: // AF_INET
+		addrLen = 4
+	case 2: // AF_INET6
+		addrLen = 16
+	default: // AF_UNSPEC, AF_UNIX
+		return header, parseProxyTLVs(header, payload[min(len(payload), proxyV2AddressesLen(fixed[1])):])
+	}
+	if len(payload) < 2*addrLen+4 {
+		return nil, errors.New("invalid PROXY protocol v2 addresses")
+	}
+	source, _ := netip.AddrFromSlice(payload[:addrLen])
+	destination, _ := netip.AddrFromSlice(payload[addrLen : 2*addrLen])
+	header.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, binary.BigEndian.Uint16(payload[2*addrLen:])))
+	header.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(destination, binary.BigEndian.Uint16(payload[2*addrLen+2:])))
+	return header, parseProxyTLVs(header, payload[2*addrLen+4:])
+}
+
+// proxyV2AddressesLen returns the length of the addresses of the family
+// byte fam.
+func proxyV2AddressesLen(fam byte) int {
+	if fam>>4 == 3 { // AF_UNIX
+		return 216
+	}
+	return 0
+}
+
+// parseProxyTLVs parses the type-length-values following the addresses.
+func parseProxyTLVs(header *ProxyHeader, tlvs []byte) error {
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return errors.New("invalid PROXY protocol v2 TLV")
+		}
+		typ, length := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+length {
+			return errors.New("invalid PROXY protocol v2 TLV")
+		}
+		value := tlvs[3 : 3+length]
+		tlvs = tlvs[3+length:]
+		switch typ {
+		case proxyTLVAuthority:
+			header.Authority = string(value)
+		case proxyTLVSSL:
+			// client (1 byte), verify (4 bytes), sub-TLVs
+			if len(value) < 5 || value[0]&proxyClientSSL == 0 {
+				continue
+			}
+			info := &ProxyTLS{
+				ClientCert: value[0]&(proxyClientCertConn|proxyClientCertSess) != 0,
+			}
+			info.Verified = info.ClientCert && binary.BigEndian.Uint32(value[1:]) == 0
+			if err := parseProxySSLTLVs(info, value[5:]); err != nil {
+				return err
+			}
+			header.TLS = info
+		}
+	}
+	return nil
+}
+
+// parseProxySSLTLVs parses the sub-TLVs of a PP2_TYPE_SSL TLV.
+func parseProxySSLTLVs(info *ProxyTLS, tlvs []byte) error {
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return errors.New("invalid PROXY protocol v2 SSL TLV")
+		}
+		typ, length := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+length {
+			return errors.New("invalid PROXY protocol v2 SSL TLV")
+		}
+		value := string(tlvs[3 : 3+length])
+		tlvs = tlvs[3+length:]
+		switch typ {
+		case proxyTLVSSLVersion:
+			info.Version = value
+		case proxyTLVSSLCipher:
+			info.Cipher = value
+		case proxyTLVSSLCN:
+			info.CommonName = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package ldapserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// proxyV2Header returns a version 2 PROXY command header for TCP over
+// family fam (0x11 IPv4, 0x21 IPv6), followed by tlvs.
+func proxyV2Header(fam byte, addrs []byte, tlvs []byte) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x21)
+	b.WriteByte(fam)
+	binary.Write(&b, binary.BigEndian, uint16(len(addrs)+len(tlvs)))
+	b.Write(addrs)
+	b.Write(tlvs)
+	return b.Bytes()
+}
+
+func proxyTLV(typ byte, value []byte) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	addrs4 := append(append(net.IPv4(203, 0, 113, 7).To4(), net.IPv4(192, 0, 2, 1).To4()...), 0x15, 0xb3, 0x01, 0x85)
+	addrs6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...), 0x15, 0xb3, 0x02, 0x7c)
+	ssl := append([]byte{proxyClientSSL | proxyClientCertConn, 0, 0, 0, 0},
+		append(append(proxyTLV(proxyTLVSSLVersion, []byte("TLSv1.3")),
+			proxyTLV(proxyTLVSSLCipher, []byte("TLS_AES_128_GCM_SHA256"))...),
+			proxyTLV(proxyTLVSSLCN, []byte("alice"))...)...)
+
+	tests := []struct {
+		name         string
+		input        []byte
+		source, dest string
+		authority    string
+		tls          *ProxyTLS
+		wantErr      bool
+	}{
+		{name: "v1 TCP4", input: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 5555 389\r\n"),
+			source: "203.0.113.7:5555", dest: "192.0.2.1:389"},
+		{name: "v1 TCP6", input: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 5555 636\r\n"),
+			source: "[2001:db8::7]:5555", dest: "[2001:db8::1]:636"},
+		{name: "v1 UNKNOWN", input: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 invalid port", input: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 99999 389\r\n"), wantErr: true},
+		{name: "v1 missing CRLF", input: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 5555 389\n"), wantErr: true},
+		{name: "v2 TCP4", input: proxyV2Header(0x11, addrs4, proxyTLV(proxyTLVAuthority, []byte("ldap.example.com"))),
+			source: "203.0.113.7:5555", dest: "192.0.2.1:389", authority: "ldap.example.com"},
+		{name: "v2 TCP6 with TLS", input: proxyV2Header(0x21, addrs6, proxyTLV(proxyTLVSSL, ssl)),
+			source: "[2001:db8::7]:5555", dest: "[2001:db8::1]:636",
+			tls: &ProxyTLS{Version: "TLSv1.3", Cipher: "TLS_AES_128_GCM_SHA256", ClientCert: true, Verified: true, CommonName: "alice"}},
+		{name: "v2 LOCAL", input: append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)},
+		{name: "v2 unknown command", input: append(append([]byte{}, proxyV2Signature...), 0x22, 0x11, 0x00, 0x00), wantErr: true},
+		{name: "v2 truncated TLV", input: proxyV2Header(0x11, addrs4, []byte{proxyTLVAuthority, 0, 9, 'x'}), wantErr: true},
+		{name: "missing header", input: []byte("\x30\x0c\x02\x01\x01\x60\x07\x02\x01\x03\x04\x00\x80\x00"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(bytes.NewReader(append(tt.input, "next"...)))
+			header, err := readProxyHeader(br)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader: %v", err)
+			}
+			addr := func(a net.Addr) string {
+				if a == nil {
+					return ""
+				}
+				return a.String()
+			}
+			if addr(header.Source) != tt.source || addr(header.Destination) != tt.dest {
+				t.Errorf("addresses = %v -> %v", header.Source, header.Destination)
+			}
+			if header.Authority != tt.authority {
+				t.Errorf("authority = %q", header.Authority)
+			}
+			if (header.TLS == nil) != (tt.tls == nil) || (tt.tls != nil && *header.TLS != *tt.tls) {
+				t.Errorf("TLS = %+v, want %+v", header.TLS, tt.tls)
+			}
+			if rest, _ := br.ReadString(0); rest != "next" {
+				t.Errorf("header not fully consumed, %q left", rest)
+			}
+		})
+	}
+}
+
+func TestE2E_ProxyProtocol(t *testing.T) {
+	addrs := make(chan string, 1)
+	routes := NewRouteMux()
+	routes.Bind(func(w ResponseWriter, m *Message) {
+		addrs <- m.Client.Addr().String()
+		w.Write(NewBindResponse(LDAPResultSuccess))
+	})
+	var accessLog syncBuffer
+	server := NewServer()
+	server.AccessLog = &accessLog
+	server.ProxyProtocol = &ProxyProtocol{
+		Trusted:       []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		HeaderTimeout: time.Second,
+	}
+	server.Handle(routes)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(ln)
+	defer server.Stop()
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	raw.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 5555 389\r\n"))
+	conn := goldap.NewConn(raw, false)
+	conn.Start()
+	if err := conn.Bind("cn=test", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if addr := <-addrs; addr != "203.0.113.7:5555" {
+		t.Errorf("client address = %s", addr)
+	}
+	conn.Close()
+
+	// A trusted source without a header is disconnected.
+	conn, err = goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := conn.Bind("cn=test", "secret"); err == nil {
+		t.Error("expected a bind without PROXY header to fail")
+	}
+	conn.Close()
+
+	// Untrusted sources are served with their own address.
+	untrusted := NewServer()
+	untrusted.ProxyProtocol = &ProxyProtocol{Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	untrusted.Handle(routes)
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go untrusted.Serve(ln)
+	defer untrusted.Stop()
+	conn, err = goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.Bind("cn=test", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if addr := <-addrs; !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Errorf("untrusted client address = %s", addr)
+	}
+
+	if log := accessLog.String(); !strings.Contains(log, "connection from 203.0.113.7:5555") {
+		t.Errorf("unexpected access log:\n%s", log)
+	}
+}
@@ -2,12 +2,61 @@ package ldapserver
 
 import ldap "github.com/vjeantet/goldap/message"
 
+// ResultCode returns the result code of a response carrying an LDAPResult,
+// such as a BindResponse or a SearchResultDone. ok is false for any other
+// protocol operation.
+func ResultCode(po ldap.ProtocolOp) (code int, ok bool) {
+	return responseResultCode(po)
+}
+
+// newErrorResponse returns the response to the request po carrying
+// resultCode and diagnostic, or nil for requests without a response.
+func newErrorResponse(po ldap.ProtocolOp, resultCode int, diagnostic string) ldap.ProtocolOp {
+	res := ldap.LDAPResult{}
+	res.SetResultCode(resultCode)
+	res.SetDiagnosticMessage(diagnostic)
+	switch po.(type) {
+	case ldap.BindRequest:
+		return ldap.BindResponse{LDAPResult: res}
+	case ldap.SearchRequest:
+		return ldap.SearchResultDone(res)
+	case ldap.ModifyRequest:
+		return ldap.ModifyResponse(res)
+	case ldap.AddRequest:
+		return ldap.AddResponse(res)
+	case ldap.DelRequest:
+		return ldap.DelResponse(res)
+	case ldap.ModifyDNRequest:
+		return ldap.ModifyDNResponse(res)
+	case ldap.CompareRequest:
+		return ldap.CompareResponse(res)
+	case ldap.ExtendedRequest:
+		return ldap.ExtendedResponse{LDAPResult: res}
+	}
+	return nil
+}
+
 func NewBindResponse(resultCode int) ldap.BindResponse {
 	r := ldap.BindResponse{}
 	r.SetResultCode(resultCode)
 	return r
 }
 
+// NewSASLBindResponse creates a BindResponse carrying serverSaslCreds,
+// omitted when nil.
+func NewSASLBindResponse(resultCode int, serverSaslCreds []byte) ldap.BindResponse {
+	r := NewBindResponse(resultCode)
+	if serverSaslCreds == nil {
+		return r
+	}
+	po, err := withOctetString(r, ldap.TagBindResponseServerSaslCreds, serverSaslCreds)
+	if err != nil {
+		// Not reachable: r is always a valid BindResponse.
+		return r
+	}
+	return po.(ldap.BindResponse)
+}
+
 func NewResponse(resultCode int) ldap.LDAPResult {
 	r := ldap.LDAPResult{}
 	r.SetResultCode(resultCode)
@@ -20,6 +69,21 @@ func NewExtendedResponse(resultCode int) ldap.ExtendedResponse {
 	return r
 }
 
+// NewExtendedResponseWithValue creates an ExtendedResponse with the given
+// responseName, omitted when empty, and responseValue.
+func NewExtendedResponseWithValue(resultCode int, name ldap.LDAPOID, value []byte) ldap.ExtendedResponse {
+	r := NewExtendedResponse(resultCode)
+	if name != "" {
+		r.SetResponseName(name)
+	}
+	po, err := withOctetString(r, ldap.TagExtendedResponseValue, value)
+	if err != nil {
+		// Not reachable: r is always a valid ExtendedResponse.
+		return r
+	}
+	return po.(ldap.ExtendedResponse)
+}
+
 func NewCompareResponse(resultCode int) ldap.CompareResponse {
 	r := ldap.CompareResponse{}
 	r.SetResultCode(resultCode)
@@ -32,6 +96,12 @@ func NewModifyResponse(resultCode int) ldap.ModifyResponse {
 	return r
 }
 
+func NewModifyDNResponse(resultCode int) ldap.ModifyDNResponse {
+	r := ldap.LDAPResult{}
+	r.SetResultCode(resultCode)
+	return ldap.ModifyDNResponse(r)
+}
+
 func NewDeleteResponse(resultCode int) ldap.DelResponse {
 	r := ldap.DelResponse{}
 	r.SetResultCode(resultCode)
@@ -0,0 +1,442 @@
+package ldapserver
+
+import (
+	"net/url"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// DefaultDNAttributes are the attributes whose values a Rewriter maps as
+// DNs when Rewriter.DNAttributes is nil.
+var DefaultDNAttributes = []string{
+	"member", "uniqueMember", "memberOf", "owner", "manager", "secretary",
+	"seeAlso", "roleOccupant", "creatorsName", "modifiersName", "entryDN",
+}
+
+// Rewriter is a Handler wrapper presenting the entries of a backend Handler
+// under other DNs and attribute names, such as a virtual naming context
+// during a migration:
+//
+//	rewriter := ldap.NewRewriter(backend).
+//		Suffix("ou=people,dc=new,dc=com", "ou=users,o=legacy").
+//		Attribute("mail", "email")
+//	server.Handle(rewriter)
+//
+// DNs under a virtual suffix are mapped to the backend suffix in requests:
+// the base of searches, the entry of updates and compares, the name of
+// simple binds, the new superior of Modify DN requests, and the values of
+// DN attributes in entries, modifications, assertions and filters. DNs
+// under a backend suffix are mapped back in responses: the name and DN
+// attributes of search entries, the URLs of references and referrals, and
+// matched DNs. Attributes are renamed the same way in both directions,
+// including in filters and requested attribute lists.
+//
+// The longest matching suffix is used; DNs outside of every suffix are
+// left as is, and so is a response that cannot be rewritten. Configure a
+// Rewriter before serving requests.
+type Rewriter struct {
+	Handler Handler
+	// DNAttributes are the attributes holding DNs, by their virtual name.
+	// The default is DefaultDNAttributes.
+	DNAttributes []string
+
+	suffixes   []suffixMapping
+	attributes []attributeMapping
+}
+
+type suffixMapping struct {
+	virtual, backend         string
+	virtualRDNs, backendRDNs []string // normalized
+}
+
+type attributeMapping struct {
+	virtual, backend string
+}
+
+// NewRewriter returns a Rewriter of handler, without any rule.
+func NewRewriter(handler Handler) *Rewriter {
+	return &Rewriter{Handler: handler}
+}
+
+// Suffix maps the DNs under virtual, as seen by clients, to the DNs under
+// backend, as seen by the Handler.
+func (r *Rewriter) Suffix(virtual, backend string) *Rewriter {
+	r.suffixes = append(r.suffixes, suffixMapping{
+		virtual:     virtual,
+		backend:     backend,
+		virtualRDNs: normalizeRDNs(splitDN(virtual)),
+		backendRDNs: normalizeRDNs(splitDN(backend)),
+	})
+	return r
+}
+
+// Attribute renames the attribute virtual, as seen by clients, to backend,
+// as seen by the Handler.
+func (r *Rewriter) Attribute(virtual, backend string) *Rewriter {
+	r.attributes = append(r.attributes, attributeMapping{virtual: virtual, backend: backend})
+	return r
+}
+
+func (r *Rewriter) ServeLDAP(w ResponseWriter, m *Message) {
+	po, err := r.rewriteRequest(m.ProtocolOp())
+	if err != nil {
+		m.Client.log.Warn("cannot rewrite request", "msgid", m.MessageID().Int(), "error", err)
+		if res := newErrorResponse(m.ProtocolOp(), LDAPResultOther, "cannot rewrite request"); res != nil {
+			w.Write(res)
+		}
+		return
+	}
+	msg := ldap.NewLDAPMessageWithProtocolOp(po)
+	msg.SetMessageID(m.MessageID().Int())
+	msg.SetControls(m.Controls())
+	rewritten := *m
+	rewritten.LDAPMessage = msg
+	r.Handler.ServeLDAP(rewriteWriter{w: w, r: r}, &rewritten)
+}
+
+// rewriteWriter rewrites the responses of the Handler of a Rewriter.
+type rewriteWriter struct {
+	w ResponseWriter
+	r *Rewriter
+}
+
+func (rw rewriteWriter) Write(po ldap.ProtocolOp) {
+	rw.w.Write(rw.r.rewriteResponse(po))
+}
+
+func (rw rewriteWriter) WriteWithControls(po ldap.ProtocolOp, controls ldap.Controls) {
+	WriteWithControls(rw.w, rw.r.rewriteResponse(po), controls...)
+}
+
+// rewriteRequest maps the DNs and attributes of a request to the backend.
+func (r *Rewriter) rewriteRequest(po ldap.ProtocolOp) (ldap.ProtocolOp, error) {
+	switch po.(type) {
+	case ldap.BindRequest, ldap.SearchRequest, ldap.AddRequest, ldap.ModifyRequest,
+		ldap.DelRequest, ldap.ModifyDNRequest, ldap.CompareRequest:
+	default:
+		return po, nil
+	}
+	p, err := encodeProtocolOp(po)
+	if err != nil {
+		return nil, err
+	}
+	r.rewritePacket(p, true)
+	refreshPacket(p)
+	return decodeProtocolOp(p)
+}
+
+// rewriteResponse maps the DNs and attributes of a response to the virtual
+// naming context.
+func (r *Rewriter) rewriteResponse(po ldap.ProtocolOp) ldap.ProtocolOp {
+	switch po.(type) {
+	case ldap.SearchResultEntry, ldap.SearchResultReference:
+	default:
+		if _, ok := responseResultCode(po); !ok {
+			return po
+		}
+	}
+	p, err := encodeProtocolOp(po)
+	if err != nil {
+		return po
+	}
+	r.rewritePacket(p, false)
+	refreshPacket(p)
+	res, err := decodeProtocolOp(p)
+	if err != nil {
+		return po
+	}
+	return res
+}
+
+// rewritePacket rewrites the BER representation of a protocol operation,
+// toward the backend or toward the client.
+func (r *Rewriter) rewritePacket(p *ber.Packet, toBackend bool) {
+	dn := func(i int) {
+		if i < len(p.Children) {
+			setPacketString(p.Children[i], r.mapDN(p.Children[i].Data.String(), toBackend))
+		}
+	}
+	switch p.Tag {
+	case ldap.TagBindRequest:
+		dn(1)
+	case ldap.TagSearchRequest:
+		dn(0)
+		if len(p.Children) > 7 {
+			r.rewriteFilter(p.Children[6], toBackend)
+			for _, a := range p.Children[7].Children {
+				setPacketString(a, r.mapAttribute(a.Data.String(), toBackend))
+			}
+		}
+	case ldap.TagAddRequest, ldap.TagSearchResultEntry:
+		dn(0)
+		if len(p.Children) > 1 {
+			for _, a := range p.Children[1].Children {
+				r.rewriteAttribute(a, toBackend)
+			}
+		}
+	case ldap.TagModifyRequest:
+		dn(0)
+		if len(p.Children) > 1 {
+			for _, change := range p.Children[1].Children {
+				if len(change.Children) > 1 {
+					r.rewriteAttribute(change.Children[1], toBackend)
+				}
+			}
+		}
+	case ldap.TagDelRequest:
+		setPacketString(p, r.mapDN(p.Data.String(), toBackend))
+	case ldap.TagModifyDNRequest:
+		dn(0)
+		dn(3)
+	case ldap.TagCompareRequest:
+		dn(0)
+		if len(p.Children) > 1 {
+			r.rewriteAssertion(p.Children[1], toBackend)
+		}
+	case ldap.TagSearchResultReference:
+		for _, u := range p.Children {
+			setPacketString(u, r.mapURL(u.Data.String(), toBackend))
+		}
+	default:
+		// LDAPResult: resultCode, matchedDN, diagnosticMessage, referral [3]
+		dn(1)
+		for _, c := range p.Children {
+			if c.ClassType == ber.ClassContext && c.Tag == 3 {
+				for _, u := range c.Children {
+					setPacketString(u, r.mapURL(u.Data.String(), toBackend))
+				}
+			}
+		}
+	}
+}
+
+// rewriteAttribute rewrites an attribute and its values:
+//
+//	Attribute ::= SEQUENCE { type AttributeDescription, vals SET OF value }
+func (r *Rewriter) rewriteAttribute(p *ber.Packet, toBackend bool) {
+	if len(p.Children) > 1 {
+		r.rewriteValues(p.Children[0], p.Children[1].Children, toBackend)
+	}
+}
+
+// rewriteAssertion rewrites an AttributeValueAssertion:
+//
+//	AttributeValueAssertion ::= SEQUENCE {
+//	     attributeDesc   AttributeDescription,
+//	     assertionValue  AssertionValue }
+func (r *Rewriter) rewriteAssertion(p *ber.Packet, toBackend bool) {
+	if len(p.Children) > 1 {
+		r.rewriteValues(p.Children[0], p.Children[1:], toBackend)
+	}
+}
+
+// rewriteValues renames the attribute description attr and maps its values
+// if they are DNs.
+func (r *Rewriter) rewriteValues(attr *ber.Packet, values []*ber.Packet, toBackend bool) {
+	name := attr.Data.String()
+	if r.isDNAttribute(name, toBackend) {
+		for _, v := range values {
+			setPacketString(v, r.mapDN(v.Data.String(), toBackend))
+		}
+	}
+	setPacketString(attr, r.mapAttribute(name, toBackend))
+}
+
+// rewriteFilter rewrites the attributes and DN values of a search filter.
+func (r *Rewriter) rewriteFilter(p *ber.Packet, toBackend bool) {
+	switch p.Tag {
+	case ldap.TagFilterAnd, ldap.TagFilterOr, ldap.TagFilterNot:
+		for _, c := range p.Children {
+			r.rewriteFilter(c, toBackend)
+		}
+	case ldap.TagFilterEqualityMatch, ldap.TagFilterGreaterOrEqual, ldap.TagFilterLessOrEqual, ldap.TagFilterApproxMatch:
+		r.rewriteAssertion(p, toBackend)
+	case ldap.TagFilterSubstrings:
+		if len(p.Children) > 0 {
+			setPacketString(p.Children[0], r.mapAttribute(p.Children[0].Data.String(), toBackend))
+		}
+	case ldap.TagFilterPresent:
+		setPacketString(p, r.mapAttribute(p.Data.String(), toBackend))
+	case ldap.TagFilterExtensibleMatch:
+		// MatchingRuleAssertion ::= SEQUENCE {
+		//      matchingRule    [1] MatchingRuleId OPTIONAL,
+		//      type            [2] AttributeDescription OPTIONAL,
+		//      matchValue      [3] AssertionValue,
+		//      dnAttributes    [4] BOOLEAN DEFAULT FALSE }
+		var attr, value *ber.Packet
+		for _, c := range p.Children {
+			switch c.Tag {
+			case 2:
+				attr = c
+			case 3:
+				value = c
+			}
+		}
+		if attr != nil && value != nil {
+			r.rewriteValues(attr, []*ber.Packet{value}, toBackend)
+		}
+	}
+}
+
+// mapDN maps dn to the backend or to the virtual naming context.
+func (r *Rewriter) mapDN(dn string, toBackend bool) string {
+	rdns := splitDN(dn)
+	normalized := normalizeRDNs(rdns)
+	best, target := -1, ""
+	for _, s := range r.suffixes {
+		from, to := s.backendRDNs, s.virtual
+		if toBackend {
+			from, to = s.virtualRDNs, s.backend
+		}
+		if len(from) <= best || len(from) > len(normalized) {
+			continue
+		}
+		if equalRDNs(normalized[len(normalized)-len(from):], from) {
+			best, target = len(from), to
+		}
+	}
+	if best < 0 {
+		return dn
+	}
+	prefix := strings.Join(rdns[:len(rdns)-best], ",")
+	switch {
+	case prefix == "":
+		return target
+	case target == "":
+		return prefix
+	}
+	return prefix + "," + target
+}
+
+// mapAttribute renames the attribute description name, keeping its
+// options.
+func (r *Rewriter) mapAttribute(name string, toBackend bool) string {
+	attr, options, _ := strings.Cut(name, ";")
+	for _, a := range r.attributes {
+		from, to := a.backend, a.virtual
+		if toBackend {
+			from, to = a.virtual, a.backend
+		}
+		if strings.EqualFold(attr, from) {
+			if options != "" {
+				return to + ";" + options
+			}
+			return to
+		}
+	}
+	return name
+}
+
+// isDNAttribute reports whether the values of the attribute name, from the
+// naming context being mapped, are DNs.
+func (r *Rewriter) isDNAttribute(name string, toBackend bool) bool {
+	if !toBackend {
+		name = r.mapAttribute(name, false)
+	}
+	name, _, _ = strings.Cut(name, ";")
+	attributes := r.DNAttributes
+	if attributes == nil {
+		attributes = DefaultDNAttributes
+	}
+	for _, a := range attributes {
+		if strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapURL maps the DN of an LDAP URL (RFC 4516).
+func (r *Rewriter) mapURL(u string, toBackend bool) string {
+	scheme, rest, ok := strings.Cut(u, "://")
+	if !ok {
+		return u
+	}
+	hostport, rest, ok := strings.Cut(rest, "/")
+	if !ok {
+		return u
+	}
+	escaped, query, hasQuery := strings.Cut(rest, "?")
+	dn, err := url.PathUnescape(escaped)
+	if err != nil {
+		return u
+	}
+	mapped := scheme + "://" + hostport + "/" + dnURLEscaper.Replace(url.PathEscape(r.mapDN(dn, toBackend)))
+	if hasQuery {
+		mapped += "?" + query
+	}
+	return mapped
+}
+
+// dnURLEscaper unescapes the commas escaped by url.PathEscape, which are
+// allowed in the DN of LDAP URLs.
+var dnURLEscaper = strings.NewReplacer("%2C", ",")
+
+// splitDN splits dn into its RDNs, on the commas not escaped by a
+// backslash.
+func splitDN(dn string) []string {
+	if strings.TrimSpace(dn) == "" {
+		return nil
+	}
+	var rdns []string
+	start := 0
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			rdns = append(rdns, strings.TrimSpace(dn[start:i]))
+			start = i + 1
+		}
+	}
+	return append(rdns, strings.TrimSpace(dn[start:]))
+}
+
+// normalizeRDNs returns the RDNs in lower case, without spaces around the
+// equal signs.
+func normalizeRDNs(rdns []string) []string {
+	normalized := make([]string, len(rdns))
+	for i, rdn := range rdns {
+		var b strings.Builder
+		for _, ava := range strings.Split(rdn, "+") {
+			if b.Len() > 0 {
+				b.WriteByte('+')
+			}
+			attr, value, _ := strings.Cut(ava, "=")
+			b.WriteString(strings.ToLower(strings.TrimSpace(attr)) + "=" + strings.ToLower(strings.TrimSpace(value)))
+		}
+		normalized[i] = b.String()
+	}
+	return normalized
+}
+
+func equalRDNs(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// setPacketString replaces the value of the primitive packet p.
+func setPacketString(p *ber.Packet, value string) {
+	p.Data.Reset()
+	p.Data.WriteString(value)
+	p.Value = value
+}
+
+// refreshPacket re-encodes the data of the constructed packets of p from
+// their children, after they were edited.
+func refreshPacket(p *ber.Packet) {
+	if p.TagType != ber.TypeConstructed {
+		return
+	}
+	p.Data.Reset()
+	for _, c := range p.Children {
+		refreshPacket(c)
+		p.Data.Write(c.Bytes())
+	}
+}
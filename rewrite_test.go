@@ -0,0 +1,149 @@
+package ldapserver
+
+import (
+	"net"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+func TestRewriterMapping(t *testing.T) {
+	r := NewRewriter(nil).
+		Suffix("ou=people,dc=new,dc=com", "ou=users,o=legacy").
+		Suffix("dc=new,dc=com", "o=legacy")
+	tests := []struct {
+		dn, backend string
+	}{
+		{"uid=alice,ou=people,dc=new,dc=com", "uid=alice,ou=users,o=legacy"},
+		{"uid=alice, OU=People, DC=new,dc=com", "uid=alice,ou=users,o=legacy"},
+		{"ou=people,dc=new,dc=com", "ou=users,o=legacy"},
+		{"cn=admins,ou=groups,dc=new,dc=com", "cn=admins,ou=groups,o=legacy"},
+		{`cn=Smith\, John,ou=people,dc=new,dc=com`, `cn=Smith\, John,ou=users,o=legacy`},
+		{"uid=bob,dc=other,dc=com", "uid=bob,dc=other,dc=com"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := r.mapDN(tt.dn, true); got != tt.backend {
+			t.Errorf("mapDN(%q) = %q, want %q", tt.dn, got, tt.backend)
+		}
+	}
+	if got := r.mapDN("uid=alice,ou=users,o=legacy", false); got != "uid=alice,ou=people,dc=new,dc=com" {
+		t.Errorf("unexpected virtual DN %q", got)
+	}
+	if got := r.mapURL("ldap://ldap.example.com/ou=users,o=legacy??sub", false); got != "ldap://ldap.example.com/ou=people,dc=new,dc=com??sub" {
+		t.Errorf("unexpected URL %q", got)
+	}
+
+	// goldap has no setter for the matched DN of a result.
+	p, _ := encodeProtocolOp(NewSearchResultDoneResponse(LDAPResultNoSuchObject))
+	setPacketString(p.Children[1], "ou=users,o=legacy")
+	refreshPacket(p)
+	po, err := decodeProtocolOp(p)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	p, _ = encodeProtocolOp(r.rewriteResponse(po))
+	if matched := p.Children[1].Data.String(); matched != "ou=people,dc=new,dc=com" {
+		t.Errorf("unexpected matched DN %q", matched)
+	}
+}
+
+func TestE2E_Rewriter(t *testing.T) {
+	requests := make(chan *Message, 10)
+	routes := NewRouteMux()
+	routes.Bind(func(w ResponseWriter, m *Message) {
+		requests <- m
+		if r := m.GetBindRequest(); r.Name() == "uid=alice,ou=users,o=legacy" {
+			w.Write(NewBindResponse(LDAPResultSuccess))
+			return
+		}
+		w.Write(NewBindResponse(LDAPResultInvalidCredentials))
+	})
+	routes.Search(func(w ResponseWriter, m *Message) {
+		requests <- m
+		e := NewSearchResultEntry("uid=alice,ou=users,o=legacy")
+		e.AddAttribute("email", "alice@example.com")
+		e.AddAttribute("memberOf", "cn=admins,ou=groups,o=legacy")
+		w.Write(e)
+		w.Write(NewSearchResultReference("ldap://legacy.example.com/ou=archive,o=legacy"))
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	routes.Add(func(w ResponseWriter, m *Message) {
+		requests <- m
+		w.Write(NewAddResponse(LDAPResultSuccess))
+	})
+
+	rewriter := NewRewriter(routes).
+		Suffix("ou=people,dc=new,dc=com", "ou=users,o=legacy").
+		Suffix("dc=new,dc=com", "o=legacy").
+		Attribute("mail", "email")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := NewServer()
+	server.Handle(rewriter)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	conn, err := goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Bind("uid=alice,ou=people,dc=new,dc=com", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	<-requests
+	// The client sees its virtual identity.
+	if who, err := conn.WhoAmI(nil); err != nil || who.AuthzID != "dn:uid=alice,ou=people,dc=new,dc=com" {
+		t.Fatalf("whoami = %v, %v", who, err)
+	}
+
+	res, err := conn.Search(goldap.NewSearchRequest("ou=people,dc=new,dc=com", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(&(mail=alice@*)(memberOf=cn=admins,ou=groups,dc=new,dc=com))", []string{"mail", "memberOf"}, nil))
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	r := (<-requests).GetSearchRequest()
+	if r.BaseObject() != "ou=users,o=legacy" {
+		t.Errorf("backend base = %q", r.BaseObject())
+	}
+	if f := r.FilterString(); f != "(&(email=alice@*)(memberOf=cn=admins,ou=groups,o=legacy))" {
+		t.Errorf("backend filter = %s", f)
+	}
+	if attrs := r.Attributes(); len(attrs) != 2 || attrs[0] != "email" {
+		t.Errorf("backend attributes = %v", attrs)
+	}
+	if len(res.Entries) != 1 {
+		t.Fatalf("unexpected entries %v", res.Entries)
+	}
+	e := res.Entries[0]
+	if e.DN != "uid=alice,ou=people,dc=new,dc=com" || e.GetAttributeValue("mail") != "alice@example.com" ||
+		e.GetAttributeValue("memberOf") != "cn=admins,ou=groups,dc=new,dc=com" {
+		t.Errorf("unexpected entry %s %v", e.DN, e.Attributes)
+	}
+	if len(res.Referrals) != 1 || res.Referrals[0] != "ldap://legacy.example.com/ou=archive,dc=new,dc=com" {
+		t.Errorf("unexpected references %v", res.Referrals)
+	}
+
+	add := goldap.NewAddRequest("cn=staff,ou=groups,dc=new,dc=com", nil)
+	add.Attribute("member", []string{"uid=alice,ou=people,dc=new,dc=com"})
+	add.Attribute("mail", []string{"staff@example.com"})
+	if err := conn.Add(add); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	a := (<-requests).GetAddRequest()
+	if a.Entry() != "cn=staff,ou=groups,o=legacy" {
+		t.Errorf("backend entry = %q", a.Entry())
+	}
+	attrs := map[string]ldap.AttributeValue{}
+	for _, attr := range a.Attributes() {
+		attrs[string(attr.Type_())] = attr.Vals()[0]
+	}
+	if attrs["member"] != "uid=alice,ou=users,o=legacy" || attrs["email"] != "staff@example.com" {
+		t.Errorf("backend attributes = %v", attrs)
+	}
+}
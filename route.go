@@ -2,6 +2,7 @@ package ldapserver
 
 import (
 	"strings"
+	"sync/atomic"
 
 	ldap "github.com/vjeantet/goldap/message"
 )
@@ -13,6 +14,7 @@ const (
 	COMPARE  = "CompareRequest"
 	ADD      = "AddRequest"
 	MODIFY   = "ModifyRequest"
+	MODIFYDN = "ModifyDNRequest"
 	DELETE   = "DelRequest"
 	EXTENDED = "ExtendedRequest"
 	ABANDON  = "AbandonRequest"
@@ -37,12 +39,16 @@ type route struct {
 	exoName     string
 	sBasedn     string
 	uBasedn     bool
+	suffix      []string // normalized RDNs of the suffix of the search base
+	uSuffix     bool
 	sFilter     string
 	uFilter     bool
 	sScope      int
 	uScope      bool
 	sAuthChoice string
 	uAuthChoice bool
+	minSSF      int          // minimum security strength factor
+	hits        atomic.Int64 // number of requests served
 }
 
 // Match return true when the *Message matches the route
@@ -74,6 +80,10 @@ func (r *route) Match(m *Message) bool {
 			}
 		}
 
+		if r.uSuffix && !withinSuffix(normalizeRDNs(splitDN(string(v.BaseObject()))), r.suffix) {
+			return false
+		}
+
 		if r.uFilter == true {
 			if strings.ToLower(v.FilterString()) != r.sFilter {
 				return false
@@ -101,6 +111,27 @@ func (r *route) BaseDn(dn string) *route {
 	return r
 }
 
+// Suffix matches searches whose base is dn or an entry below it.
+func (r *route) Suffix(dn string) *route {
+	r.suffix = normalizeRDNs(splitDN(dn))
+	r.uSuffix = true
+	return r
+}
+
+// RequireSSF refuses the matching requests of connections with a security
+// strength factor lower than ssf, before calling the handler, as
+// SecurityRequirements do.
+func (r *route) RequireSSF(ssf int) *route {
+	r.minSSF = ssf
+	return r
+}
+
+// RequireTLS refuses the matching requests of connections without TLS,
+// before calling the handler. LDAPI connections are allowed.
+func (r *route) RequireTLS() *route {
+	return r.RequireSSF(1)
+}
+
 func (r *route) AuthenticationChoice(choice string) *route {
 	r.sAuthChoice = strings.ToLower(choice)
 	r.uAuthChoice = true
@@ -148,12 +179,18 @@ func (h *RouteMux) ServeLDAP(w ResponseWriter, r *Message) {
 		}
 
 		if route.label != "" {
-			Logger.Printf("")
-			Logger.Printf(" ROUTE MATCH ; %s", route.label)
-			Logger.Printf("")
-			// Logger.Printf(" ROUTE MATCH ; %s", runtime.FuncForPC(reflect.ValueOf(route.handler).Pointer()).Name())
+			r.Client.log.Debug("route matched", "msgid", r.MessageID().Int(), "route", route.label)
 		}
 
+		route.hits.Add(1)
+		if route.minSSF > 0 {
+			if code, diagnostic := securityResult(r.Client.SSF(), route.minSSF); code != LDAPResultSuccess {
+				if res := newErrorResponse(r.ProtocolOp(), code, diagnostic); res != nil {
+					w.Write(res)
+				}
+				return
+			}
+		}
 		route.handler(w, r)
 		return
 	}
@@ -166,13 +203,21 @@ func (h *RouteMux) ServeLDAP(w ResponseWriter, r *Message) {
 			requestToAbandon.Abandon()
 		}
 	case ldap.ExtendedRequest:
-		if v.RequestName() == NoticeOfCancel {
+		switch v.RequestName() {
+		case NoticeOfCancel:
 			handleCancel(w, r)
 			return
+		case NoticeOfWhoAmI:
+			handleWhoAmI(w, r)
+			return
+		case NoticeOfGetConnectionID:
+			handleGetConnectionID(w, r)
+			return
 		}
 	}
 
 	if h.notFoundRoute != nil {
+		h.notFoundRoute.hits.Add(1)
 		h.notFoundRoute.handler(w, r)
 	} else {
 		res := NewResponse(LDAPResultUnwillingToPerform)
@@ -181,6 +226,26 @@ func (h *RouteMux) ServeLDAP(w ResponseWriter, r *Message) {
 	}
 }
 
+// RouteStats is the number of requests served by a route of a RouteMux.
+type RouteStats struct {
+	Label     string
+	Operation string // such as "SearchRequest", or "NotFound"
+	Hits      int64
+}
+
+// Stats returns the number of requests served by each route, in the order
+// they were added, followed by the NotFound route if any.
+func (h *RouteMux) Stats() []RouteStats {
+	stats := make([]RouteStats, 0, len(h.routes)+1)
+	for _, r := range h.routes {
+		stats = append(stats, RouteStats{Label: r.label, Operation: r.operation, Hits: r.hits.Load()})
+	}
+	if r := h.notFoundRoute; r != nil {
+		stats = append(stats, RouteStats{Label: r.label, Operation: "NotFound", Hits: r.hits.Load()})
+	}
+	return stats
+}
+
 // Adds a new Route to the Handler
 func (h *RouteMux) addRoute(r *route) {
 	//and finally append to the list of Routes
@@ -235,6 +300,14 @@ func (h *RouteMux) Modify(handler HandlerFunc) *route {
 	return route
 }
 
+func (h *RouteMux) ModifyDN(handler HandlerFunc) *route {
+	route := &route{}
+	route.operation = MODIFYDN
+	route.handler = handler
+	h.addRoute(route)
+	return route
+}
+
 func (h *RouteMux) Compare(handler HandlerFunc) *route {
 	route := &route{}
 	route.operation = COMPARE
@@ -262,3 +335,10 @@ func (h *RouteMux) Abandon(handler HandlerFunc) *route {
 func (h *RouteMux) Cancel(handler HandlerFunc) *route {
 	return h.Extended(handler).RequestName(NoticeOfCancel)
 }
+
+// PasswordModify routes Password Modify Extended Requests (RFC 3062) to fn
+// through a PasswordModifyHandler.
+func (h *RouteMux) PasswordModify(fn PasswordModifyFunc) *route {
+	ph := &PasswordModifyHandler{Modify: fn}
+	return h.Extended(ph.ServeLDAP).RequestName(NoticeOfPasswordModify)
+}
@@ -0,0 +1,210 @@
+package ldapserver
+
+import (
+	"errors"
+	"strings"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// SASLMechanism is the server side of a SASL mechanism (RFC 4422).
+type SASLMechanism interface {
+	// Name returns the name of the mechanism, such as "PLAIN".
+	Name() string
+	// Start begins an authentication exchange for the connection m was
+	// received on.
+	Start(m *Message) (SASLSession, error)
+}
+
+// SASLSession holds the state of one SASL authentication exchange.
+type SASLSession interface {
+	// Next processes a client response, nil when the BindRequest carries no
+	// credentials, and returns the server challenge. done reports whether
+	// the exchange is complete and the client authenticated.
+	//
+	// Returning an error ends the exchange. A *ResultError selects the
+	// result code and diagnostic message sent to the client, other errors
+	// are logged and reported as LDAPResultInvalidCredentials.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// Identity returns, once the exchange is done, the identity the client
+	// authenticated as and the authorization identity it asked for, empty
+	// when none. Both are in the RFC 4513 authzId form.
+	Identity() (authenticated, requested string)
+}
+
+// SASLUser holds what the application stores about an authentication
+// identity.
+type SASLUser struct {
+	// AuthzID is the identity the connection is bound as once
+	// authenticated, such as "dn:uid=alice,ou=people,dc=example,dc=com".
+	// If empty, "u:" followed by the authentication identity is used.
+	AuthzID string
+	// Passwords are the stored userPassword values, see VerifyPassword.
+	Passwords []string
+}
+
+// SASLLookupFunc returns the stored user for the authentication identity
+// authcid, or nil when it is unknown.
+type SASLLookupFunc func(m *Message, authcid string) (*SASLUser, error)
+
+// SASLAuthorizeFunc reports whether a client authenticated as
+// authenticated may act as requested. Both are authzId strings.
+type SASLAuthorizeFunc func(m *Message, authenticated, requested string) bool
+
+// SASLServer serves SASL BindRequests with a set of mechanisms. It keeps
+// the state of multi-step exchanges on each connection, answering with
+// saslBindInProgress until the exchange completes, and sets the
+// authorization identity of the connection on success.
+//
+//	sasl := ldap.NewSASLServer(ldap.NewPlainMechanism(lookup), ldap.NewSCRAMSHA256Mechanism(lookup))
+//	routes.Bind(sasl.ServeLDAP).AuthenticationChoice("sasl")
+type SASLServer struct {
+	mechanisms []SASLMechanism
+
+	// Authorize, if non-nil, is called when a client asks for an
+	// authorization identity other than the one it authenticated as.
+	// When nil, such requests are denied.
+	Authorize SASLAuthorizeFunc
+}
+
+// NewSASLServer returns a SASLServer offering the given mechanisms.
+func NewSASLServer(mechanisms ...SASLMechanism) *SASLServer {
+	return &SASLServer{mechanisms: mechanisms}
+}
+
+// Mechanisms returns the names of the mechanisms offered by s, as listed
+// in the supportedSASLMechanisms attribute of the root DSE.
+func (s *SASLServer) Mechanisms() []string {
+	names := make([]string, 0, len(s.mechanisms))
+	for _, mech := range s.mechanisms {
+		names = append(names, mech.Name())
+	}
+	return names
+}
+
+func (s *SASLServer) mechanism(name string) (SASLMechanism, bool) {
+	for _, mech := range s.mechanisms {
+		if strings.EqualFold(mech.Name(), name) {
+			return mech, true
+		}
+	}
+	return nil, false
+}
+
+// saslExchange is a SASL exchange in progress on a connection.
+type saslExchange struct {
+	mechanism string
+	session   SASLSession
+}
+
+// ServeLDAP implements Handler for SASL BindRequests.
+func (s *SASLServer) ServeLDAP(w ResponseWriter, m *Message) {
+	r := m.GetBindRequest()
+	mechanism, credentials, err := SASLCredentials(r)
+	if err != nil {
+		res := NewBindResponse(LDAPResultProtocolError)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+
+	c := m.Client
+	ex := c.saslExchange()
+	if ex == nil || !strings.EqualFold(ex.mechanism, mechanism) {
+		// Binding with another mechanism aborts the exchange in progress
+		// (RFC 4513 section 5.2.1.2).
+		c.setSASLExchange(nil)
+		mech, ok := s.mechanism(mechanism)
+		if !ok {
+			res := NewBindResponse(LDAPResultAuthMethodNotSupported)
+			res.SetDiagnosticMessage("SASL mechanism not supported")
+			w.Write(res)
+			return
+		}
+		session, err := mech.Start(m)
+		if err != nil {
+			writeSASLError(w, m, err)
+			return
+		}
+		ex = &saslExchange{mechanism: mechanism, session: session}
+	}
+
+	challenge, done, err := ex.session.Next(credentials)
+	if err != nil {
+		c.setSASLExchange(nil)
+		writeSASLError(w, m, err)
+		return
+	}
+	if !done {
+		c.setSASLExchange(ex)
+		w.Write(NewSASLBindResponse(LDAPResultSaslBindInProgress, nonNil(challenge)))
+		return
+	}
+	c.setSASLExchange(nil)
+
+	authenticated, requested := ex.session.Identity()
+	authzID := authenticated
+	if requested != "" && requested != authenticated {
+		if s.Authorize == nil || !s.Authorize(m, authenticated, requested) {
+			res := NewBindResponse(LDAPResultInvalidCredentials)
+			res.SetDiagnosticMessage("authorization denied")
+			w.Write(res)
+			return
+		}
+		authzID = requested
+	}
+	c.SetAuthzID(authzID)
+	w.Write(NewSASLBindResponse(LDAPResultSuccess, challenge))
+}
+
+// writeSASLError answers a failed exchange.
+func writeSASLError(w ResponseWriter, m *Message, err error) {
+	m.Client.log.Info("SASL bind failed", "msgid", m.MessageID().Int(), "error", err)
+	code, msg := resultFromError(err, LDAPResultInvalidCredentials, "invalid credentials")
+	res := NewBindResponse(code)
+	res.SetDiagnosticMessage(msg)
+	w.Write(res)
+}
+
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+// SASLCredentials returns the mechanism and credentials of a SASL
+// BindRequest. credentials is nil when the request carries none.
+func SASLCredentials(r ldap.BindRequest) (mechanism string, credentials []byte, err error) {
+	if r.AuthenticationChoice() != "sasl" {
+		return "", nil, errors.New("not a SASL bind request")
+	}
+	p, err := encodeProtocolOp(r)
+	if err != nil || len(p.Children) < 3 || len(p.Children[2].Children) < 1 {
+		return "", nil, errors.New("malformed SASL credentials")
+	}
+	sasl := p.Children[2]
+	mechanism = sasl.Children[0].Data.String()
+	if len(sasl.Children) > 1 {
+		credentials = append([]byte{}, sasl.Children[1].Data.Bytes()...)
+	}
+	return mechanism, credentials, nil
+}
+
+// normalizeAuthzID returns id in the authzId form, treating a bare user
+// name as "u:" followed by the name.
+func normalizeAuthzID(id string) string {
+	if id == "" || strings.HasPrefix(id, "dn:") || strings.HasPrefix(id, "u:") {
+		return id
+	}
+	return "u:" + id
+}
+
+// lookupAuthzID returns the identity bound for the authentication identity
+// authcid with credentials creds.
+func lookupAuthzID(creds *SASLUser, authcid string) string {
+	if creds.AuthzID != "" {
+		return creds.AuthzID
+	}
+	return "u:" + authcid
+}
@@ -0,0 +1,73 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+)
+
+// ExternalMechanism implements the EXTERNAL SASL mechanism (RFC 4422
+// appendix A), which authenticates the client with credentials established
+// outside of LDAP: a verified TLS client certificate or, on Unix domain
+// sockets, the credentials of the peer process.
+type ExternalMechanism struct {
+	// Identify, if non-nil, returns the authzId of the client of m, or an
+	// error when it cannot be authenticated. When nil, DefaultExternalIdentity
+	// is used.
+	Identify func(m *Message) (string, error)
+}
+
+// NewExternalMechanism returns the EXTERNAL SASL mechanism using
+// DefaultExternalIdentity.
+func NewExternalMechanism() *ExternalMechanism {
+	return &ExternalMechanism{}
+}
+
+func (e *ExternalMechanism) Name() string { return "EXTERNAL" }
+
+func (e *ExternalMechanism) Start(m *Message) (SASLSession, error) {
+	identify := e.Identify
+	if identify == nil {
+		identify = DefaultExternalIdentity
+	}
+	return &externalSession{m: m, identify: identify}, nil
+}
+
+type externalSession struct {
+	m             *Message
+	identify      func(m *Message) (string, error)
+	authenticated string
+	requested     string
+}
+
+func (s *externalSession) Next(response []byte) ([]byte, bool, error) {
+	id, err := s.identify(s.m)
+	if err != nil {
+		return nil, false, err
+	}
+	s.authenticated = id
+	s.requested = normalizeAuthzID(string(response))
+	return nil, true, nil
+}
+
+func (s *externalSession) Identity() (string, string) {
+	return s.authenticated, s.requested
+}
+
+// DefaultExternalIdentity returns the identity established by the
+// transport of the connection m was received on:
+//
+//   - the identity of the verified TLS client certificate given by
+//     Server.CertificateMapper, "dn:" followed by its subject by default;
+//   - "dn:gidNumber=<gid>+uidNumber=<uid>,cn=peercred,cn=external,cn=auth"
+//     for Unix domain socket peers.
+//
+// It returns a *ResultError with LDAPResultInappropriateAuthentication when
+// the connection carries no such credentials.
+func DefaultExternalIdentity(m *Message) (string, error) {
+	if _, ok := m.Client.GetConn().(*tls.Conn); ok {
+		return m.Client.srv.certificateMapper().Identify(m)
+	}
+	if cred, ok := m.Client.PeerCredentials(); ok {
+		return "dn:" + cred.DN(), nil
+	}
+	return "", NewResultError(LDAPResultInappropriateAuthentication, "no external credentials")
+}
@@ -0,0 +1,68 @@
+package ldapserver
+
+import (
+	"bytes"
+	"errors"
+)
+
+// plainMechanism implements the PLAIN SASL mechanism (RFC 4616).
+type plainMechanism struct {
+	lookup SASLLookupFunc
+}
+
+// NewPlainMechanism returns the PLAIN SASL mechanism. The password sent by
+// the client is checked against the passwords returned by lookup with
+// VerifyPassword.
+//
+// PLAIN sends the password in the clear and should only be offered on
+// TLS protected connections.
+func NewPlainMechanism(lookup SASLLookupFunc) SASLMechanism {
+	return &plainMechanism{lookup: lookup}
+}
+
+func (p *plainMechanism) Name() string { return "PLAIN" }
+
+func (p *plainMechanism) Start(m *Message) (SASLSession, error) {
+	return &plainSession{mech: p, m: m}, nil
+}
+
+type plainSession struct {
+	mech          *plainMechanism
+	m             *Message
+	authenticated string
+	requested     string
+}
+
+func (s *plainSession) Next(response []byte) ([]byte, bool, error) {
+	// PLAIN has no server challenge: an empty initial response asks the
+	// client to send its credentials.
+	if response == nil {
+		return nil, false, nil
+	}
+
+	// message = [authzid] UTF8NUL authcid UTF8NUL passwd
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, false, NewResultError(LDAPResultProtocolError, "malformed PLAIN message")
+	}
+	authzid, authcid, password := string(parts[0]), string(parts[1]), parts[2]
+
+	creds, err := s.mech.lookup(s.m, authcid)
+	if err != nil {
+		return nil, false, err
+	}
+	if creds == nil || !verifyAnyPassword(password, creds.Passwords) {
+		return nil, false, errors.New("invalid credentials")
+	}
+
+	s.authenticated = lookupAuthzID(creds, authcid)
+	s.requested = normalizeAuthzID(authzid)
+	if s.requested == "u:"+authcid {
+		s.requested = ""
+	}
+	return nil, true, nil
+}
+
+func (s *plainSession) Identity() (string, string) {
+	return s.authenticated, s.requested
+}
@@ -0,0 +1,391 @@
+package ldapserver
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SCRAMMechanism implements the SCRAM-SHA-1 (RFC 5802) and SCRAM-SHA-256
+// (RFC 7677) SASL mechanisms, without channel binding.
+//
+// The stored passwords returned by the lookup function are used in order
+// of preference: values of the matching {SCRAM-SHA-1} or {SCRAM-SHA-256}
+// scheme, then cleartext values, from which the keys are derived for each
+// exchange. Other schemes cannot be used with SCRAM.
+//
+// Unknown users are answered with a made up salt and the same iteration
+// count as cleartext passwords, so that the server-first message does not
+// tell them from existing users.
+type SCRAMMechanism struct {
+	name    string
+	newHash func() hash.Hash
+	lookup  SASLLookupFunc
+
+	// Iterations is the iteration count used for cleartext passwords and
+	// unknown users. It defaults to 4096, the count HashPassword uses;
+	// stored values hashed with another count stand out from the others.
+	Iterations int
+
+	// Secret keys the salts derived for cleartext passwords and unknown
+	// users, which are the same on every exchange of a user. If nil, a
+	// random secret is used, and the salts change when the server
+	// restarts; servers sharing users should share a Secret.
+	Secret []byte
+
+	secretOnce sync.Once
+	secret     []byte
+}
+
+// NewSCRAMSHA1Mechanism returns the SCRAM-SHA-1 SASL mechanism.
+func NewSCRAMSHA1Mechanism(lookup SASLLookupFunc) *SCRAMMechanism {
+	return &SCRAMMechanism{name: "SCRAM-SHA-1", newHash: sha1.New, lookup: lookup}
+}
+
+// NewSCRAMSHA256Mechanism returns the SCRAM-SHA-256 SASL mechanism.
+func NewSCRAMSHA256Mechanism(lookup SASLLookupFunc) *SCRAMMechanism {
+	return &SCRAMMechanism{name: "SCRAM-SHA-256", newHash: sha256.New, lookup: lookup}
+}
+
+func (s *SCRAMMechanism) Name() string { return s.name }
+
+func (s *SCRAMMechanism) Start(m *Message) (SASLSession, error) {
+	return &scramSession{mech: s, m: m}, nil
+}
+
+func (s *SCRAMMechanism) iterations() int {
+	if s.Iterations <= 0 {
+		return 4096
+	}
+	return s.Iterations
+}
+
+// salt returns the salt derived for user from the secret of the mechanism.
+func (s *SCRAMMechanism) salt(user string) []byte {
+	secret := s.Secret
+	if secret == nil {
+		s.secretOnce.Do(func() {
+			s.secret = make([]byte, 32)
+			rand.Read(s.secret)
+		})
+		secret = s.secret
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s.name + "\x00" + user))
+	return mac.Sum(nil)[:16]
+}
+
+// scramKeys are the values a server needs to verify a SCRAM exchange.
+type scramKeys struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// deriveSCRAMKeys computes the SCRAM keys of password.
+func deriveSCRAMKeys(newHash func() hash.Hash, password []byte, salt []byte, iterations int) (scramKeys, error) {
+	salted, err := pbkdf2.Key(newHash, string(password), salt, iterations, newHash().Size())
+	if err != nil {
+		return scramKeys{}, err
+	}
+	clientKey := scramHMAC(newHash, salted, "Client Key")
+	h := newHash()
+	h.Write(clientKey)
+	return scramKeys{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  h.Sum(nil),
+		serverKey:  scramHMAC(newHash, salted, "Server Key"),
+	}, nil
+}
+
+func scramHMAC(newHash func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramScheme implements the {SCRAM-SHA-1} and {SCRAM-SHA-256} password
+// schemes, stored as "<iterations>:<b64 salt>$<b64 StoredKey>:<b64 ServerKey>"
+// like 389 Directory Server does.
+type scramScheme struct {
+	newHash func() hash.Hash
+}
+
+func (s scramScheme) Hash(password []byte) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	keys, err := deriveSCRAMKeys(s.newHash, password, salt, 4096)
+	if err != nil {
+		return "", err
+	}
+	return keys.String(), nil
+}
+
+func (s scramScheme) Verify(password []byte, encoded string) (bool, error) {
+	want, err := parseSCRAMKeys(encoded)
+	if err != nil {
+		return false, err
+	}
+	keys, err := deriveSCRAMKeys(s.newHash, password, want.salt, want.iterations)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(keys.storedKey, want.storedKey)&
+		subtle.ConstantTimeCompare(keys.serverKey, want.serverKey) == 1, nil
+}
+
+func (k scramKeys) String() string {
+	b64 := base64.StdEncoding
+	return strconv.Itoa(k.iterations) + ":" + b64.EncodeToString(k.salt) + "$" +
+		b64.EncodeToString(k.storedKey) + ":" + b64.EncodeToString(k.serverKey)
+}
+
+func parseSCRAMKeys(encoded string) (scramKeys, error) {
+	params, keys, ok := strings.Cut(encoded, "$")
+	iter, salt, ok1 := strings.Cut(params, ":")
+	stored, server, ok2 := strings.Cut(keys, ":")
+	if !ok || !ok1 || !ok2 {
+		return scramKeys{}, errors.New("invalid scram value")
+	}
+	var k scramKeys
+	var err error
+	if k.iterations, err = strconv.Atoi(iter); err != nil || k.iterations < 1 {
+		return scramKeys{}, errors.New("invalid scram iteration count")
+	}
+	b64 := base64.StdEncoding
+	if k.salt, err = b64.DecodeString(salt); err != nil {
+		return scramKeys{}, errors.New("invalid scram salt")
+	}
+	if k.storedKey, err = b64.DecodeString(stored); err != nil {
+		return scramKeys{}, errors.New("invalid scram stored key")
+	}
+	if k.serverKey, err = b64.DecodeString(server); err != nil {
+		return scramKeys{}, errors.New("invalid scram server key")
+	}
+	return k, nil
+}
+
+// scramSession is a SCRAM exchange:
+//
+//	C: n,[a=authzid],n=user,r=cnonce
+//	S: r=cnonce+snonce,s=salt,i=iterations
+//	C: c=biws,r=cnonce+snonce,p=proof
+//	S: v=signature
+type scramSession struct {
+	mech *SCRAMMechanism
+	m    *Message
+	step int
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	keys            scramKeys
+	known           bool // the user exists and has usable credentials
+
+	authenticated string
+	requested     string
+}
+
+var errSCRAMMalformed = NewResultError(LDAPResultProtocolError, "malformed SCRAM message")
+
+func (s *scramSession) Next(response []byte) ([]byte, bool, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		if response == nil {
+			// The client did not send an initial response.
+			s.step = 0
+			return nil, false, nil
+		}
+		return s.clientFirst(string(response))
+	case 2:
+		return s.clientFinal(string(response))
+	}
+	return nil, false, errSCRAMMalformed
+}
+
+func (s *scramSession) clientFirst(msg string) ([]byte, bool, error) {
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, errSCRAMMalformed
+	}
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, false, NewResultError(LDAPResultInappropriateAuthentication, "channel binding is not supported")
+	default:
+		return nil, false, errSCRAMMalformed
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, errSCRAMMalformed
+		}
+		authzid, err := scramUnescape(parts[1][2:])
+		if err != nil {
+			return nil, false, err
+		}
+		s.requested = normalizeAuthzID(authzid)
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attrs := strings.Split(s.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, false, errSCRAMMalformed
+	}
+	user, err := scramUnescape(attrs[0][2:])
+	if err != nil {
+		return nil, false, err
+	}
+
+	snonce, err := randomSalt(18)
+	if err != nil {
+		return nil, false, err
+	}
+	s.nonce = attrs[1][2:] + base64.RawStdEncoding.EncodeToString(snonce)
+
+	if err := s.loadKeys(user); err != nil {
+		return nil, false, err
+	}
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(s.keys.salt) +
+		",i=" + strconv.Itoa(s.keys.iterations)
+	return []byte(s.serverFirst), false, nil
+}
+
+// loadKeys looks up user and prepares the keys of the exchange. Unknown
+// users get made up keys so that the exchange fails at the last step,
+// like it does for a wrong password.
+func (s *scramSession) loadKeys(user string) error {
+	creds, err := s.mech.lookup(s.m, user)
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		if keys, ok := s.storedKeys(creds.Passwords); ok {
+			s.keys, s.known = keys, true
+		} else if password, ok := cleartextPassword(creds.Passwords); ok {
+			salt := s.mech.salt(user)
+			if s.keys, err = deriveSCRAMKeys(s.mech.newHash, password, salt, s.mech.iterations()); err != nil {
+				return err
+			}
+			s.known = true
+		}
+		s.authenticated = lookupAuthzID(creds, user)
+	}
+	if !s.known {
+		s.keys = scramKeys{iterations: s.mech.iterations(), salt: s.mech.salt(user)}
+	}
+	return nil
+}
+
+// storedKeys returns the first stored value of the scheme of the mechanism.
+func (s *scramSession) storedKeys(passwords []string) (scramKeys, bool) {
+	for _, v := range passwords {
+		scheme, encoded, ok := splitPasswordScheme(v)
+		if !ok || !strings.EqualFold(scheme, s.mech.name) {
+			continue
+		}
+		if keys, err := parseSCRAMKeys(encoded); err == nil {
+			return keys, true
+		}
+	}
+	return scramKeys{}, false
+}
+
+// cleartextPassword returns the first cleartext stored value.
+func cleartextPassword(passwords []string) ([]byte, bool) {
+	for _, v := range passwords {
+		scheme, encoded, ok := splitPasswordScheme(v)
+		if !ok {
+			return []byte(v), true
+		}
+		if strings.EqualFold(scheme, "CLEARTEXT") {
+			return []byte(encoded), true
+		}
+	}
+	return nil, false
+}
+
+func (s *scramSession) clientFinal(msg string) ([]byte, bool, error) {
+	withoutProof, proofAttr, ok := strings.Cut(msg, ",p=")
+	if !ok {
+		return nil, false, errSCRAMMalformed
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, false, errSCRAMMalformed
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil || string(cbind) != s.gs2Header {
+		return nil, false, errSCRAMMalformed
+	}
+	if attrs[1][2:] != s.nonce {
+		return nil, false, errors.New("nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(proofAttr)
+	if err != nil {
+		return nil, false, errSCRAMMalformed
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(s.mech.newHash, s.keys.storedKey, authMessage)
+	if !s.known || len(proof) != len(clientSignature) {
+		return nil, false, errors.New("invalid credentials")
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	h := s.mech.newHash()
+	h.Write(clientKey)
+	if subtle.ConstantTimeCompare(h.Sum(nil), s.keys.storedKey) != 1 {
+		return nil, false, errors.New("invalid credentials")
+	}
+
+	serverSignature := scramHMAC(s.mech.newHash, s.keys.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+func (s *scramSession) Identity() (string, string) {
+	return s.authenticated, s.requested
+}
+
+// scramUnescape decodes a saslname, in which "," and "=" are sent as "=2C"
+// and "=3D".
+func scramUnescape(name string) (string, error) {
+	if !strings.Contains(name, "=") {
+		return name, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", errSCRAMMalformed
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
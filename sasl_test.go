@@ -0,0 +1,391 @@
+package ldapserver
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func testSASLLookup(m *Message, authcid string) (*SASLUser, error) {
+	switch authcid {
+	case "alice":
+		return &SASLUser{AuthzID: "dn:uid=alice,dc=example", Passwords: []string{"secret"}}, nil
+	case "bob":
+		stored, err := HashPassword("SCRAM-SHA-256", []byte("hunter2"))
+		if err != nil {
+			return nil, err
+		}
+		return &SASLUser{Passwords: []string{stored}}, nil
+	}
+	return nil, nil
+}
+
+// startSASLServer starts a server serving SASL binds with sasl, simple
+// binds with handleBindTest, and returns its address.
+func startSASLServer(t *testing.T, network string, sasl *SASLServer) string {
+	t.Helper()
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "ldapi")
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	routes := NewRouteMux()
+	routes.Bind(sasl.ServeLDAP).AuthenticationChoice("sasl")
+	routes.Bind(handleBindTest)
+	addr, _ := serveTest(t, ln, routes)
+	return addr
+}
+
+// rawClient exchanges raw LDAP messages with a server.
+type rawClient struct {
+	t      *testing.T
+	conn   net.Conn
+	nextID int64
+}
+
+func dialRaw(t *testing.T, addr string) *rawClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{t: t, conn: conn}
+}
+
+// roundTrip sends the protocol operation op and returns the response.
+func (c *rawClient) roundTrip(op *ber.Packet) *ber.Packet {
+	c.t.Helper()
+	c.nextID++
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.nextID, "messageID"))
+	envelope.AppendChild(op)
+	if _, err := c.conn.Write(envelope.Bytes()); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+	res, err := ber.ReadPacket(c.conn)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return res.Children[1]
+}
+
+// saslBind sends a SASL BindRequest and returns the result code and
+// serverSaslCreds of the response.
+func (c *rawClient) saslBind(mechanism string, credentials []byte) (int, []byte) {
+	c.t.Helper()
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(ApplicationBindRequest), nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "name"))
+	auth := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "sasl")
+	auth.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, mechanism, "mechanism"))
+	if credentials != nil {
+		auth.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(credentials), "credentials"))
+	}
+	req.AppendChild(auth)
+
+	res := c.roundTrip(req)
+	code := int(res.Children[0].Value.(int64))
+	var creds []byte
+	for _, child := range res.Children[3:] {
+		if child.ClassType == ber.ClassContext && child.Tag == 7 {
+			creds = child.Data.Bytes()
+		}
+	}
+	return code, creds
+}
+
+// whoAmI returns the authzId of the connection.
+func (c *rawClient) whoAmI() string {
+	c.t.Helper()
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(ApplicationExtendedRequest), nil, "Extended Request")
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, string(NoticeOfWhoAmI), "requestName"))
+	res := c.roundTrip(req)
+	for _, child := range res.Children[3:] {
+		if child.ClassType == ber.ClassContext && child.Tag == 11 {
+			return child.Data.String()
+		}
+	}
+	return ""
+}
+
+func TestE2E_SASLPlain(t *testing.T) {
+	addr := startSASLServer(t, "tcp", NewSASLServer(NewPlainMechanism(testSASLLookup)))
+	c := dialRaw(t, addr)
+
+	if code, _ := c.saslBind("PLAIN", []byte("\x00alice\x00wrong")); code != LDAPResultInvalidCredentials {
+		t.Fatalf("expected InvalidCredentials, got %d", code)
+	}
+	if code, _ := c.saslBind("PLAIN", []byte("\x00alice\x00secret")); code != LDAPResultSuccess {
+		t.Fatalf("expected Success, got %d", code)
+	}
+	if id := c.whoAmI(); id != "dn:uid=alice,dc=example" {
+		t.Fatalf("expected authzId dn:uid=alice,dc=example, got %q", id)
+	}
+}
+
+func TestE2E_SASLPlainWithoutInitialResponse(t *testing.T) {
+	addr := startSASLServer(t, "tcp", NewSASLServer(NewPlainMechanism(testSASLLookup)))
+	c := dialRaw(t, addr)
+
+	code, creds := c.saslBind("PLAIN", nil)
+	if code != LDAPResultSaslBindInProgress || len(creds) != 0 {
+		t.Fatalf("expected SaslBindInProgress with an empty challenge, got %d %q", code, creds)
+	}
+	if code, _ := c.saslBind("PLAIN", []byte("\x00alice\x00secret")); code != LDAPResultSuccess {
+		t.Fatalf("expected Success, got %d", code)
+	}
+}
+
+func TestE2E_SASLAuthorize(t *testing.T) {
+	sasl := NewSASLServer(NewPlainMechanism(testSASLLookup))
+	addr := startSASLServer(t, "tcp", sasl)
+	c := dialRaw(t, addr)
+
+	if code, _ := c.saslBind("PLAIN", []byte("dn:cn=admin\x00alice\x00secret")); code != LDAPResultInvalidCredentials {
+		t.Fatalf("expected proxy authorization to be denied, got %d", code)
+	}
+	if id := c.whoAmI(); id != "" {
+		t.Fatalf("expected anonymous connection, got %q", id)
+	}
+
+	sasl.Authorize = func(m *Message, authenticated, requested string) bool {
+		return authenticated == "dn:uid=alice,dc=example" && requested == "dn:cn=admin"
+	}
+	if code, _ := c.saslBind("PLAIN", []byte("dn:cn=admin\x00alice\x00secret")); code != LDAPResultSuccess {
+		t.Fatalf("expected Success, got %d", code)
+	}
+	if id := c.whoAmI(); id != "dn:cn=admin" {
+		t.Fatalf("expected authzId dn:cn=admin, got %q", id)
+	}
+}
+
+func TestE2E_SASLUnknownMechanism(t *testing.T) {
+	addr := startSASLServer(t, "tcp", NewSASLServer(NewPlainMechanism(testSASLLookup)))
+	c := dialRaw(t, addr)
+
+	if code, _ := c.saslBind("CRAM-MD5", nil); code != LDAPResultAuthMethodNotSupported {
+		t.Fatalf("expected AuthMethodNotSupported, got %d", code)
+	}
+}
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange.
+type scramClient struct {
+	user, password  string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (s *scramClient) first() []byte {
+	s.clientFirstBare = "n=" + s.user + ",r=fyko+d2lbbFgONRv9qkxdawL"
+	return []byte("n,," + s.clientFirstBare)
+}
+
+func (s *scramClient) final(t *testing.T, serverFirst []byte) []byte {
+	t.Helper()
+	attrs := strings.Split(string(serverFirst), ",")
+	if len(attrs) != 3 || !strings.HasPrefix(attrs[0], "r=fyko+d2lbbFgONRv9qkxdawL") {
+		t.Fatalf("unexpected server-first-message %q", serverFirst)
+	}
+	salt, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[1], "s="))
+	if err != nil {
+		t.Fatalf("decode salt: %v", err)
+	}
+	iterations, err := strconv.Atoi(strings.TrimPrefix(attrs[2], "i="))
+	if err != nil {
+		t.Fatalf("decode iterations: %v", err)
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, s.password, salt, iterations, sha256.Size)
+	if err != nil {
+		t.Fatalf("pbkdf2: %v", err)
+	}
+	hmacSHA256 := func(key []byte, msg string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(msg))
+		return mac.Sum(nil)
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws," + attrs[0]
+	authMessage := s.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+}
+
+func TestE2E_SASLSCRAMSHA256(t *testing.T) {
+	tests := []struct {
+		user, password string
+		authzID        string
+	}{
+		{"alice", "secret", "dn:uid=alice,dc=example"}, // cleartext password
+		{"bob", "hunter2", "u:bob"},                    // {SCRAM-SHA-256} password
+	}
+	addr := startSASLServer(t, "tcp", NewSASLServer(NewSCRAMSHA256Mechanism(testSASLLookup)))
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			c := dialRaw(t, addr)
+			client := &scramClient{user: tt.user, password: tt.password}
+
+			code, serverFirst := c.saslBind("SCRAM-SHA-256", client.first())
+			if code != LDAPResultSaslBindInProgress {
+				t.Fatalf("expected SaslBindInProgress, got %d", code)
+			}
+			code, serverFinal := c.saslBind("SCRAM-SHA-256", client.final(t, serverFirst))
+			if code != LDAPResultSuccess {
+				t.Fatalf("expected Success, got %d", code)
+			}
+			if want := "v=" + base64.StdEncoding.EncodeToString(client.serverSignature); string(serverFinal) != want {
+				t.Fatalf("expected server-final-message %q, got %q", want, serverFinal)
+			}
+			if id := c.whoAmI(); id != tt.authzID {
+				t.Fatalf("expected authzId %s, got %q", tt.authzID, id)
+			}
+		})
+	}
+}
+
+func TestE2E_SASLSCRAMSHA256Failure(t *testing.T) {
+	addr := startSASLServer(t, "tcp", NewSASLServer(NewSCRAMSHA256Mechanism(testSASLLookup)))
+
+	for _, user := range []string{"alice", "nobody"} {
+		c := dialRaw(t, addr)
+		client := &scramClient{user: user, password: "wrong"}
+		code, serverFirst := c.saslBind("SCRAM-SHA-256", client.first())
+		if code != LDAPResultSaslBindInProgress {
+			t.Fatalf("%s: expected SaslBindInProgress, got %d", user, code)
+		}
+		if code, _ := c.saslBind("SCRAM-SHA-256", client.final(t, serverFirst)); code != LDAPResultInvalidCredentials {
+			t.Fatalf("%s: expected InvalidCredentials, got %d", user, code)
+		}
+	}
+}
+
+func TestE2E_SASLExchangeAbortedBySimpleBind(t *testing.T) {
+	addr := startSASLServer(t, "tcp", NewSASLServer(NewSCRAMSHA256Mechanism(testSASLLookup)))
+	c := dialRaw(t, addr)
+	client := &scramClient{user: "alice", password: "secret"}
+
+	code, serverFirst := c.saslBind("SCRAM-SHA-256", client.first())
+	if code != LDAPResultSaslBindInProgress {
+		t.Fatalf("expected SaslBindInProgress, got %d", code)
+	}
+
+	// A simple bind in the middle of the exchange discards it, so the
+	// final message is taken as the start of a new exchange.
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(ApplicationBindRequest), nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "name"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, "", "simple"))
+	c.roundTrip(req)
+
+	if code, _ := c.saslBind("SCRAM-SHA-256", client.final(t, serverFirst)); code != LDAPResultProtocolError {
+		t.Fatalf("expected ProtocolError, got %d", code)
+	}
+}
+
+func TestE2E_SASLExternalPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	addr := startSASLServer(t, "unix", NewSASLServer(NewExternalMechanism()))
+
+	netConn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn := goldap.NewConn(netConn, false)
+	conn.Start()
+	defer conn.Close()
+
+	if err := conn.ExternalBind(); err != nil {
+		t.Fatalf("external bind: %v", err)
+	}
+	res, err := conn.WhoAmI(nil)
+	if err != nil {
+		t.Fatalf("whoami: %v", err)
+	}
+	want := "dn:gidNumber=" + strconv.Itoa(os.Getgid()) + "+uidNumber=" + strconv.Itoa(os.Getuid()) +
+		",cn=peercred,cn=external,cn=auth"
+	if res.AuthzID != want {
+		t.Fatalf("expected authzId %s, got %q", want, res.AuthzID)
+	}
+}
+
+func TestE2E_SASLExternalWithoutCredentials(t *testing.T) {
+	addr := startSASLServer(t, "tcp", NewSASLServer(NewExternalMechanism()))
+
+	conn, err := goldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.ExternalBind(); !goldap.IsErrorWithCode(err, goldap.LDAPResultInappropriateAuthentication) {
+		t.Fatalf("expected InappropriateAuthentication, got: %v", err)
+	}
+}
+
+func TestSCRAMPasswordScheme(t *testing.T) {
+	stored, err := HashPassword("SCRAM-SHA-1", []byte("secret"))
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if !strings.HasPrefix(stored, "{SCRAM-SHA-1}4096:") {
+		t.Fatalf("unexpected stored value %q", stored)
+	}
+	if ok, err := VerifyPassword([]byte("secret"), stored); err != nil || !ok {
+		t.Fatalf("expected password to verify, got %v %v", ok, err)
+	}
+	if ok, _ := VerifyPassword([]byte("wrong"), stored); ok {
+		t.Fatal("expected wrong password to fail")
+	}
+}
+
+func TestSCRAMServerFirst_UnknownUser(t *testing.T) {
+	mech := NewSCRAMSHA256Mechanism(testSASLLookup)
+	serverFirst := func(user string) (salt, iterations string) {
+		s := &scramSession{mech: mech}
+		challenge, _, err := s.Next([]byte("n,,n=" + user + ",r=nonce"))
+		if err != nil {
+			t.Fatalf("%s: %v", user, err)
+		}
+		attrs := strings.Split(string(challenge), ",")
+		return attrs[1], attrs[2]
+	}
+	_, storedIterations := serverFirst("bob")
+	for _, user := range []string{"alice", "nobody"} {
+		salt, iterations := serverFirst(user)
+		if again, _ := serverFirst(user); again != salt {
+			t.Errorf("%s: salt changed from %s to %s", user, salt, again)
+		}
+		if iterations != storedIterations {
+			t.Errorf("%s: got %s, expected %s like stored keys", user, iterations, storedIterations)
+		}
+	}
+	nobody, _ := serverFirst("nobody")
+	if other, _ := serverFirst("nobody2"); other == nobody {
+		t.Error("expected users to get different salts")
+	}
+}
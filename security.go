@@ -0,0 +1,161 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// LocalSSF is the security strength factor of LDAPI connections, as in
+// OpenLDAP.
+const LocalSSF = 71
+
+// SecurityRequirements are the minimum security strength factors (SSF) of
+// requests, in the style of the OpenLDAP security directive. The SSF of a
+// connection is returned by its SSF method. Requests of a connection with
+// a lower SSF are refused before reaching the Handler, with:
+//   - confidentialityRequired (13) on connections without TLS,
+//   - strongAuthRequired (8) on TLS connections with a weaker cipher.
+//
+// Abandon and StartTLS requests are never refused. Zero values do not
+// require anything.
+type SecurityRequirements struct {
+	SSF             int // any request
+	PasswordBindSSF int // simple binds with a password and SASL PLAIN binds
+	UpdateSSF       int // Add, Delete, Modify and Modify DN requests
+
+	// Subtrees require an SSF for the requests whose entry, base or bind
+	// DN is at or below a DN.
+	Subtrees []SubtreeSecurity
+}
+
+// SubtreeSecurity is the minimum SSF of the requests within a subtree.
+type SubtreeSecurity struct {
+	DN  string
+	SSF int
+}
+
+// SSF returns the security strength factor of the connection: the key size
+// in bits of its TLS cipher, including TLS terminated by a load balancer
+// sending a PROXY protocol header, LocalSSF for LDAPI connections, or 0.
+func (c *client) SSF() int {
+	if state, ok := c.TLSConnectionState(); ok {
+		return cipherSSF(tls.CipherSuiteName(state.CipherSuite))
+	}
+	if header, ok := c.ProxyHeader(); ok && header.TLS != nil {
+		return cipherSSF(header.TLS.Cipher)
+	}
+	if c.conn().LocalAddr().Network() == "unix" {
+		return LocalSSF
+	}
+	return 0
+}
+
+// cipherSSF returns the key size of a TLS cipher suite, named as in Go or
+// OpenSSL, or 1 for an unknown cipher.
+func cipherSSF(name string) int {
+	name = strings.ToUpper(name)
+	switch {
+	case strings.Contains(name, "AES_256"), strings.Contains(name, "AES256"), strings.Contains(name, "CHACHA20"):
+		return 256
+	case strings.Contains(name, "AES_128"), strings.Contains(name, "AES128"), strings.Contains(name, "RC4"):
+		return 128
+	case strings.Contains(name, "3DES"), strings.Contains(name, "DES-CBC3"):
+		return 112
+	}
+	return 1
+}
+
+// requiredSSF returns the minimum SSF of a request. A Modify DN request
+// moving an entry must meet the requirements of both its entry and its
+// new superior.
+func (r *SecurityRequirements) requiredSSF(po ldap.ProtocolOp) int {
+	ssf := r.SSF
+	var dns []string
+	switch op := po.(type) {
+	case ldap.AbandonRequest:
+		return 0
+	case ldap.ExtendedRequest:
+		if op.RequestName() == NoticeOfStartTLS {
+			return 0
+		}
+	case ldap.BindRequest:
+		dns = append(dns, string(op.Name()))
+		if isPasswordBind(op) {
+			ssf = max(ssf, r.PasswordBindSSF)
+		}
+	case ldap.SearchRequest:
+		dns = append(dns, string(op.BaseObject()))
+	case ldap.CompareRequest:
+		dns = append(dns, string(op.Entry()))
+	case ldap.AddRequest:
+		dns = append(dns, string(op.Entry()))
+		ssf = max(ssf, r.UpdateSSF)
+	case ldap.DelRequest:
+		dns = append(dns, string(op))
+		ssf = max(ssf, r.UpdateSSF)
+	case ldap.ModifyRequest:
+		dns = append(dns, string(op.Object()))
+		ssf = max(ssf, r.UpdateSSF)
+	case ldap.ModifyDNRequest:
+		if req, err := parseModifyDNRequest(op); err == nil {
+			dns = append(dns, req.entry)
+			if req.hasNewSuperior {
+				dns = append(dns, req.newSuperior)
+			}
+		}
+		ssf = max(ssf, r.UpdateSSF)
+	}
+	for _, dn := range dns {
+		if dn == "" {
+			continue
+		}
+		rdns := normalizeRDNs(splitDN(dn))
+		for _, subtree := range r.Subtrees {
+			if withinSuffix(rdns, normalizeRDNs(splitDN(subtree.DN))) {
+				ssf = max(ssf, subtree.SSF)
+			}
+		}
+	}
+	return ssf
+}
+
+// isPasswordBind reports whether r sends a password.
+func isPasswordBind(r ldap.BindRequest) bool {
+	switch r.AuthenticationChoice() {
+	case "simple":
+		return len(r.AuthenticationSimple()) > 0
+	case "sasl":
+		mechanism, _, err := SASLCredentials(r)
+		return err == nil && strings.EqualFold(mechanism, "PLAIN")
+	}
+	return false
+}
+
+// securityResult returns the result code and diagnostic message refusing
+// a request requiring the SSF required on a connection of SSF ssf, or
+// LDAPResultSuccess.
+func securityResult(ssf, required int) (code int, diagnostic string) {
+	switch {
+	case ssf >= required:
+		return LDAPResultSuccess, ""
+	case ssf == 0:
+		return LDAPResultConfidentialityRequired, "TLS is required"
+	}
+	return LDAPResultStrongAuthRequired, fmt.Sprintf("a security strength factor of %d is required", required)
+}
+
+// checkSecurity returns the result code and diagnostic message refusing
+// the request message because of the TLS mode of the listener or the
+// SecurityRequirements of the server, or LDAPResultSuccess.
+func (c *client) checkSecurity(message *ldap.LDAPMessage) (code int, diagnostic string) {
+	if c.requiresTLS(message) {
+		return LDAPResultConfidentialityRequired, "TLS is required: use StartTLS"
+	}
+	if required := c.srv.Security.requiredSSF(message.ProtocolOp()); required > 0 {
+		return securityResult(c.SSF(), required)
+	}
+	return LDAPResultSuccess, ""
+}
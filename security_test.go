@@ -0,0 +1,181 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+func TestCipherSSF(t *testing.T) {
+	for name, ssf := range map[string]int{
+		"TLS_AES_128_GCM_SHA256":                  128,
+		"TLS_AES_256_GCM_SHA384":                  256,
+		"TLS_CHACHA20_POLY1305_SHA256":            256,
+		"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     112,
+		"ECDHE-RSA-AES256-GCM-SHA384":             256,
+		"ecdhe-ecdsa-aes128-gcm-sha256":           128,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": 128,
+		"": 1,
+	} {
+		if got := cipherSSF(name); got != ssf {
+			t.Errorf("cipherSSF(%q) = %d, expected %d", name, got, ssf)
+		}
+	}
+}
+
+// decodeModifyDNRequest decodes a ModifyDNRequest moving entry under
+// newSuperior, or renaming it in place when newSuperior is empty.
+func decodeModifyDNRequest(t *testing.T, entry, newSuperior string) ldap.ProtocolOp {
+	t.Helper()
+	env := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	env.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "messageID"))
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationModifyDNRequest, nil, "ModifyDNRequest")
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry, "entry"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn=moved", "newrdn"))
+	req.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "deleteoldrdn"))
+	if newSuperior != "" {
+		req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, newSuperior, "newSuperior"))
+	}
+	env.AppendChild(req)
+
+	m, err := decodeMessage(env.Bytes())
+	if err != nil {
+		t.Fatalf("decode modify DN request: %v", err)
+	}
+	return m.ProtocolOp()
+}
+
+func TestSecurityRequirements_ModifyDN(t *testing.T) {
+	r := SecurityRequirements{
+		UpdateSSF: 1,
+		Subtrees:  []SubtreeSecurity{{DN: "ou=secret,dc=example", SSF: 256}},
+	}
+	tests := []struct {
+		entry, newSuperior string
+		want               int
+	}{
+		{"cn=a,ou=people,dc=example", "", 1},
+		{"cn=a,ou=people,dc=example", "ou=groups,dc=example", 1},
+		{"cn=a,ou=secret,dc=example", "", 256},
+		{"cn=a,ou=secret,dc=example", "ou=people,dc=example", 256},
+		{"cn=a,ou=people,dc=example", "OU=Secret, DC=Example", 256},
+	}
+	for _, tt := range tests {
+		if got := r.requiredSSF(decodeModifyDNRequest(t, tt.entry, tt.newSuperior)); got != tt.want {
+			t.Errorf("requiredSSF(%q to %q) = %d, want %d", tt.entry, tt.newSuperior, got, tt.want)
+		}
+	}
+}
+
+func TestE2E_SecurityRequirements(t *testing.T) {
+	ca, serverCert, _ := testPKI(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	success := func(w ResponseWriter, m *Message) {
+		if res := newErrorResponse(m.ProtocolOp(), LDAPResultSuccess, ""); res != nil {
+			w.Write(res)
+		}
+	}
+	routes := NewRouteMux()
+	routes.Extended(NewStartTLSHandler(nil)).RequestName(NoticeOfStartTLS)
+	routes.Bind(success)
+	routes.Add(success)
+	routes.Compare(func(w ResponseWriter, m *Message) {
+		w.Write(NewCompareResponse(LDAPResultCompareTrue))
+	}).RequireTLS()
+	routes.Search(func(w ResponseWriter, m *Message) {
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	server := NewServer()
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.Security = SecurityRequirements{
+		PasswordBindSSF: LocalSSF, // LDAPI or TLS
+		UpdateSSF:       1,
+		Subtrees:        []SubtreeSecurity{{DN: "ou=secret,dc=example", SSF: 256}},
+	}
+	server.Handle(routes)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(ln)
+	defer server.Stop()
+
+	add := goldap.NewAddRequest("cn=new,dc=example", nil)
+	add.Attribute("objectClass", []string{"top"})
+	search := func(conn *goldap.Conn, base string) error {
+		_, err := conn.Search(goldap.NewSearchRequest(base, goldap.ScopeBaseObject, goldap.NeverDerefAliases,
+			0, 0, false, "(objectClass=*)", nil, nil))
+		return err
+	}
+
+	conn, err := goldap.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.UnauthenticatedBind(""); err != nil {
+		t.Errorf("anonymous bind without TLS: %v", err)
+	}
+	if err := search(conn, "dc=example"); err != nil {
+		t.Errorf("search without TLS: %v", err)
+	}
+	for name, err := range map[string]error{
+		"bind":           conn.Bind("cn=alice,dc=example", "secret"),
+		"add":            conn.Add(add),
+		"compare":        func() error { _, err := conn.Compare("cn=alice,dc=example", "cn", "alice"); return err }(),
+		"subtree search": search(conn, "cn=x,OU=Secret,dc=example"),
+	} {
+		if !goldap.IsErrorWithCode(err, LDAPResultConfidentialityRequired) {
+			t.Errorf("%s without TLS: expected confidentialityRequired, got %v", name, err)
+		}
+	}
+
+	// TLS with AES-128: enough for binds and updates, not for the subtree.
+	if err := conn.StartTLS(&tls.Config{
+		RootCAs:      pool,
+		ServerName:   "127.0.0.1",
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	if err := conn.Bind("cn=alice,dc=example", "secret"); err != nil {
+		t.Errorf("bind over TLS: %v", err)
+	}
+	if err := conn.Add(add); err != nil {
+		t.Errorf("add over TLS: %v", err)
+	}
+	if _, err := conn.Compare("cn=alice,dc=example", "cn", "alice"); err != nil {
+		t.Errorf("compare over TLS: %v", err)
+	}
+	if err := search(conn, "ou=secret,dc=example"); !goldap.IsErrorWithCode(err, LDAPResultStrongAuthRequired) {
+		t.Errorf("subtree search over AES-128: expected strongAuthRequired, got %v", err)
+	}
+
+	// LDAPI connections are local.
+	path := filepath.Join(t.TempDir(), "ldapi")
+	unix, err := ListenUnix(path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go server.ServeListener(unix, TLSNone)
+	local, err := goldap.DialURL("ldapi://" + path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer local.Close()
+	if err := local.Bind("cn=alice,dc=example", "secret"); err != nil {
+		t.Errorf("bind over LDAPI: %v", err)
+	}
+	if err := search(local, "ou=secret,dc=example"); !goldap.IsErrorWithCode(err, LDAPResultStrongAuthRequired) {
+		t.Errorf("subtree search over LDAPI: expected strongAuthRequired, got %v", err)
+	}
+}
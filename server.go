@@ -3,9 +3,14 @@ package ldapserver
 import (
 	"bufio"
 	"crypto/tls"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
 )
 
 type HandlerSource interface {
@@ -14,19 +19,94 @@ type HandlerSource interface {
 
 // Server is an LDAP server.
 type Server struct {
+	// Listener is the listener of Serve, ServeTLS, ListenAndServe and
+	// ListenAndServeUnix. ServeListener and ListenAndServeAll leave it
+	// unchanged.
 	Listener     net.Listener
 	ReadTimeout  time.Duration  // optional read timeout
-	WriteTimeout time.Duration  // optional write timeout
+	WriteTimeout time.Duration  // optional timeout to write each response
 	wg           sync.WaitGroup // group of goroutines (1 by client)
 	chDone       chan bool      // Channel Done, value => shutdown
 
+	// IdleTimeout, if non-zero, disconnects clients with a Notice of
+	// Disconnection when no request has been in progress for that long.
+	IdleTimeout time.Duration
+
+	// MaxConnectionLifetime, if non-zero, disconnects clients with a
+	// Notice of Disconnection once connected for that long, abandoning the
+	// requests in progress.
+	MaxConnectionLifetime time.Duration
+
+	listeners      []*serverListener // listeners served, closed by Stop
+	listenersMutex sync.Mutex
+	stopped        bool
+	accepting      sync.WaitGroup // accept loops of the listeners
+	connections    atomic.Int64   // number of connections accepted
+	clients        map[int]*client
+	clientsMutex   sync.Mutex
+	started        time.Time // when the first listener was served
+	operations     operationCounters
+
 	// TLSConfig optionally provides a TLS configuration for use by ServeTLS.
 	TLSConfig *tls.Config
 
+	// CertificateMapper, if non-nil, maps verified TLS client certificates
+	// to authorization identities, for the EXTERNAL SASL mechanism and
+	// implicit TLS authentication. When nil, the identity of a client
+	// certificate is "dn:" followed by its subject.
+	CertificateMapper *CertificateMapper
+
+	// Security requires minimum security strength factors for requests,
+	// such as TLS for binds with a password.
+	Security SecurityRequirements
+
+	// ImplicitTLSAuth binds connections presenting a verified TLS client
+	// certificate as its identity once the handshake is complete, without
+	// any Bind request. A Bind request replaces this identity.
+	ImplicitTLSAuth bool
+
 	// OnNewConnection, if non-nil, is called on new connections.
-	// If it returns non-nil, the connection is closed.
+	// If it returns non-nil, the client gets a Notice of Disconnection and
+	// the connection is closed. A *ResultError chooses the result code and
+	// diagnostic message of the notice, other errors are logged and
+	// reported as LDAPResultOther with a generic message. ConnProxyHeader
+	// returns the PROXY protocol header of the connection. Package policy
+	// provides reusable admission policies.
 	OnNewConnection func(c net.Conn) error
 
+	// Log receives the server logs. Each message carries structured
+	// attributes: conn (connection number), remote, msgid, op, result and
+	// duration. PDU hex dumps are logged at debug level. When nil, logs go
+	// to the deprecated package Logger, which discards them by default.
+	Log    *slog.Logger
+	legacy atomic.Pointer[slog.Logger] // package Logger, captured once
+
+	// AccessLog, if non-nil, receives an access log in the format of the
+	// 389 Directory Server: connections, TLS sessions, a summary of each
+	// request and its result, entry count and elapsed time.
+	AccessLog      io.Writer
+	accessLogMutex sync.Mutex
+
+	// Metrics, if non-nil, receives connection and operation events.
+	// See NewMetrics for a collector exposing them to Prometheus.
+	Metrics MetricsCollector
+
+	// Tracer, if non-nil, traces each request around its handler.
+	Tracer Tracer
+
+	// Audit, if non-nil, receives an LDIF change record of each Add,
+	// Modify, Delete and ModifyDN request answered with success.
+	Audit AuditSink
+
+	// SessionRecorder, if non-nil, records the messages exchanged with
+	// clients, to replay them with a Replayer.
+	SessionRecorder *SessionRecorder
+
+	// ProxyProtocol, if non-nil, decodes the PROXY protocol header sent by
+	// load balancers at the start of TCP connections. Set it before
+	// serving.
+	ProxyProtocol *ProxyProtocol
+
 	// Handler handles ldap message received from client
 	// it SHOULD "implement" RequestHandler interface
 	Handler          Handler
@@ -66,18 +146,19 @@ func (s *Server) Handle(h Handler) {
 	s.Handler = h
 }
 
-// Serve accepts incoming LDAP connections on the given listener.
-// The Server takes ownership of the listener and will close it when Stop is called.
+// Serve accepts incoming LDAP connections on the given listener, and sets
+// s.Listener. The Server takes ownership of the listener and will close it
+// when Stop is called.
 func (s *Server) Serve(listener net.Listener) error {
-	s.Listener = listener
-	return s.serve()
+	s.Listener = s.wrapListener(listener, TLSNone)
+	return s.serveListener(&serverListener{Listener: s.Listener, mode: TLSNone})
 }
 
 // ServeTLS wraps the given listener with TLS using s.TLSConfig
-// and accepts incoming LDAP connections.
+// and accepts incoming LDAP connections, and sets s.Listener.
 func (s *Server) ServeTLS(listener net.Listener) error {
-	s.Listener = tls.NewListener(listener, s.TLSConfig)
-	return s.serve()
+	s.Listener = s.wrapListener(listener, TLSImplicit)
+	return s.serveListener(&serverListener{Listener: s.Listener, mode: TLSImplicit})
 }
 
 // ListenAndServe listens on the TCP network address s.Addr and then
@@ -88,12 +169,12 @@ func (s *Server) ListenAndServe(addr string, options ...func(*Server)) error {
 		addr = ":389"
 	}
 
-	var e error
-	s.Listener, e = net.Listen("tcp", addr)
+	ln, e := net.Listen("tcp", addr)
 	if e != nil {
 		return e
 	}
-	Logger.Printf("Listening on %s\n", addr)
+	s.Listener = s.proxyProtocolListener(ln)
+	s.log().Info("listening", "addr", addr)
 
 	for _, option := range options {
 		option(s)
@@ -102,45 +183,53 @@ func (s *Server) ListenAndServe(addr string, options ...func(*Server)) error {
 	return s.serve()
 }
 
-// Handle requests messages on the ln listener
+// Handle requests messages on the s.Listener listener
 func (s *Server) serve() error {
+	return s.serveListener(&serverListener{Listener: s.Listener})
+}
+
+// serveListener accepts connections on ln until Stop is called.
+func (s *Server) serveListener(ln *serverListener) error {
+	legacyLog(&s.legacy) // read the package Logger before serving
 	if s.Handler == nil && !s.useHandlerSource {
-		Logger.Panicln("No LDAP Request Handler defined")
+		s.log().Error("no LDAP request handler defined")
+		panic("ldap: no LDAP request handler defined")
 	}
-
-	i := 0
+	if !s.addListener(ln) {
+		ln.Close()
+		return nil
+	}
+	defer s.accepting.Done()
 
 	for {
-		rw, err := s.Listener.Accept()
+		rw, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-s.chDone:
-				Logger.Print("Stopping server")
+				s.log().Info("stopping server")
 				return nil
 			default:
 			}
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 				continue
 			}
-			Logger.Println(err)
+			s.log().Error("accept failed", "error", err)
 			return err
 		}
 
 		if s.ReadTimeout != 0 {
 			rw.SetReadDeadline(time.Now().Add(s.ReadTimeout))
 		}
-		if s.WriteTimeout != 0 {
-			rw.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
-		}
 
 		cli, err := s.newClient(rw)
 		if err != nil {
 			continue
 		}
 
-		i = i + 1
-		cli.Numero = i
-		Logger.Printf("Connection client [%d] from %s accepted", cli.Numero, cli.rwc.RemoteAddr().String())
+		cli.Numero = int(s.connections.Add(1))
+		cli.tlsMode = ln.mode
+		cli.log = s.log().With("conn", cli.Numero)
+		s.metrics().ConnectionOpened()
 		s.wg.Add(1)
 		go cli.serve()
 	}
@@ -150,10 +239,12 @@ func (s *Server) serve() error {
 // client has a writer and reader buffer
 func (s *Server) newClient(rwc net.Conn) (c *client, err error) {
 	c = &client{
-		srv: s,
-		rwc: rwc,
-		br:  bufio.NewReader(rwc),
-		bw:  bufio.NewWriter(rwc),
+		srv:           s,
+		rwc:           rwc,
+		br:            bufio.NewReader(rwc),
+		bw:            bufio.NewWriter(rwc),
+		disconnecting: make(chan ldap.ExtendedResponse, 1),
+		start:         time.Now(),
 	}
 	if s.useHandlerSource {
 		c.handler = s.handlerSource.GetHandler()
@@ -173,8 +264,9 @@ func (s *Server) newClient(rwc net.Conn) (c *client, err error) {
 // In either case, when the LDAP session is terminated.
 func (s *Server) Stop() {
 	close(s.chDone)
-	s.Listener.Close()
-	Logger.Print("gracefully closing client connections...")
+	s.closeListeners()
+	s.accepting.Wait()
+	s.log().Debug("gracefully closing client connections")
 	s.wg.Wait()
-	Logger.Print("all clients connection closed")
+	s.log().Info("all client connections closed")
 }
@@ -71,3 +71,26 @@ func TestStopRefusesNewConnections(t *testing.T) {
 		t.Fatal("serve() did not return after Stop()")
 	}
 }
+
+func TestServeSetsListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	server.Handle(NewRouteMux())
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- server.Serve(ln)
+	}()
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	server.Stop()
+	<-serveDone
+	if server.Listener != ln {
+		t.Fatalf("Listener = %v, want the served listener", server.Listener)
+	}
+}
@@ -0,0 +1,281 @@
+package ldapserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// Directions of the messages of a session transcript.
+const (
+	SessionRequest  = "request"
+	SessionResponse = "response"
+)
+
+// SessionRecord is a line of a session transcript: an LDAP message
+// received from or sent to a client.
+type SessionRecord struct {
+	Time      time.Time `json:"time"`
+	Conn      int       `json:"conn"` // connection number
+	Direction string    `json:"dir"`  // SessionRequest or SessionResponse
+	MessageID int       `json:"msgid"`
+	Op        string    `json:"op"`  // protocol operation name, such as "SearchRequest"
+	PDU       []byte    `json:"pdu"` // BER encoding of the message, base64 in JSON
+}
+
+// SessionRecorder writes the messages exchanged by a Server with its
+// clients as a transcript in the JSON Lines format, one SessionRecord per
+// line:
+//
+//	f, _ := os.Create("sessions.jsonl")
+//	server.SessionRecorder = ldap.NewSessionRecorder(f)
+//
+// Transcripts contain the credentials sent by clients. They can be
+// replayed with a Replayer.
+type SessionRecorder struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+	err   error
+}
+
+// NewSessionRecorder returns a SessionRecorder writing to w.
+func NewSessionRecorder(w io.Writer) *SessionRecorder {
+	return &SessionRecorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error returned by the writer, after which nothing
+// is recorded anymore.
+func (r *SessionRecorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *SessionRecorder) record(rec SessionRecord) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(rec)
+	}
+}
+
+// recordSession records a message exchanged with c, if the server has a
+// SessionRecorder.
+func (c *client) recordSession(direction string, m *ldap.LDAPMessage, pdu []byte) {
+	if c.srv.SessionRecorder == nil {
+		return
+	}
+	c.srv.SessionRecorder.record(SessionRecord{
+		Time:      time.Now(),
+		Conn:      c.Numero,
+		Direction: direction,
+		MessageID: m.MessageID().Int(),
+		Op:        m.ProtocolOpName(),
+		PDU:       append([]byte(nil), pdu...),
+	})
+}
+
+// ReadSessionRecords reads a transcript written by a SessionRecorder.
+func ReadSessionRecords(r io.Reader) ([]SessionRecord, error) {
+	var records []SessionRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec SessionRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("record %d: %w", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// Mismatch is a difference between the responses of a transcript and the
+// responses of a replay.
+type Mismatch struct {
+	Conn      int    // connection number in the transcript
+	MessageID int    // message ID of the request
+	Op        string // protocol operation name of the request
+	Index     int    // index of the response among those of the request
+	Expected  []byte // recorded response, nil for an unexpected response
+	Got       []byte // replayed response, nil for a missing response
+}
+
+func (m Mismatch) String() string {
+	switch {
+	case m.Got == nil:
+		return fmt.Sprintf("conn=%d msgid=%d %s: missing response #%d %s", m.Conn, m.MessageID, m.Op, m.Index, describePDU(m.Expected))
+	case m.Expected == nil:
+		return fmt.Sprintf("conn=%d msgid=%d %s: unexpected response #%d %s", m.Conn, m.MessageID, m.Op, m.Index, describePDU(m.Got))
+	}
+	return fmt.Sprintf("conn=%d msgid=%d %s: response #%d is %s, want %s", m.Conn, m.MessageID, m.Op, m.Index, describePDU(m.Got), describePDU(m.Expected))
+}
+
+// describePDU returns the operation and hex dump of an LDAP message.
+func describePDU(pdu []byte) string {
+	m, err := decodeMessage(pdu)
+	if err != nil {
+		return fmt.Sprintf("%x", pdu)
+	}
+	return fmt.Sprintf("%s %x", m.ProtocolOpName(), pdu)
+}
+
+// Replayer replays transcripts against a Handler.
+//
+// Each connection of a transcript is replayed on its own connection to a
+// Server running the Handler on a loopback address: requests are sent in
+// the recorded order, waiting for the responses recorded for each of them,
+// and the responses are then compared byte for byte with the recorded
+// ones. Unsolicited notifications (message ID 0) are ignored. Sessions
+// upgraded with StartTLS cannot be replayed.
+type Replayer struct {
+	Handler Handler
+	// Timeout is the time to wait for the responses of a request. The
+	// default is one second.
+	Timeout time.Duration
+	// Configure, if non-nil, is called on the Server running Handler
+	// before it starts.
+	Configure func(*Server)
+}
+
+// Replay replays the transcript records and returns the responses that
+// differ.
+func (r *Replayer) Replay(records []SessionRecord) ([]Mismatch, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := NewServer()
+	server.Handle(r.Handler)
+	if r.Configure != nil {
+		r.Configure(server)
+	}
+	go server.Serve(ln)
+	defer server.Stop()
+
+	var conns []int
+	byConn := make(map[int][]SessionRecord)
+	for _, rec := range records {
+		if _, ok := byConn[rec.Conn]; !ok {
+			conns = append(conns, rec.Conn)
+		}
+		byConn[rec.Conn] = append(byConn[rec.Conn], rec)
+	}
+
+	var mismatches []Mismatch
+	for _, conn := range conns {
+		m, err := r.replayConn(ln.Addr().String(), conn, byConn[conn])
+		if err != nil {
+			return mismatches, fmt.Errorf("conn=%d: %w", conn, err)
+		}
+		mismatches = append(mismatches, m...)
+	}
+	return mismatches, nil
+}
+
+// replayConn replays the records of the connection conn of a transcript.
+func (r *Replayer) replayConn(addr string, conn int, records []SessionRecord) ([]Mismatch, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+
+	var requests []SessionRecord
+	expected := make(map[int][][]byte)
+	lastID := 0
+	for _, rec := range records {
+		switch rec.Direction {
+		case SessionRequest:
+			requests = append(requests, rec)
+			lastID = max(lastID, rec.MessageID)
+		case SessionResponse:
+			if rec.MessageID != 0 {
+				expected[rec.MessageID] = append(expected[rec.MessageID], rec.PDU)
+			}
+		}
+	}
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+	br := bufio.NewReader(nc)
+	got := make(map[int][][]byte)
+	// read reads a response, or returns false once the deadline is passed
+	// or the connection is closed.
+	read := func(deadline time.Time) bool {
+		nc.SetReadDeadline(deadline)
+		p, err := readMessagePacket(br)
+		if err != nil {
+			return false
+		}
+		m, err := p.readMessage()
+		if err == nil && m.MessageID().Int() != 0 {
+			got[m.MessageID().Int()] = append(got[m.MessageID().Int()], p.bytes)
+		}
+		return true
+	}
+
+	unbound := false
+	for _, req := range requests {
+		if _, err := nc.Write(req.PDU); err != nil {
+			return nil, err
+		}
+		if req.Op == "UnbindRequest" {
+			unbound = true
+			break
+		}
+		deadline := time.Now().Add(timeout)
+		for len(got[req.MessageID]) < len(expected[req.MessageID]) && read(deadline) {
+		}
+	}
+	if !unbound {
+		nc.Write(unbindPDU(lastID + 1))
+	}
+	// The server closes the connection once the pending requests are done.
+	deadline := time.Now().Add(timeout)
+	for read(deadline) {
+	}
+
+	var mismatches []Mismatch
+	compared := make(map[int]bool)
+	for _, req := range requests {
+		if compared[req.MessageID] {
+			continue
+		}
+		compared[req.MessageID] = true
+		want, have := expected[req.MessageID], got[req.MessageID]
+		for i := 0; i < max(len(want), len(have)); i++ {
+			m := Mismatch{Conn: conn, MessageID: req.MessageID, Op: req.Op, Index: i}
+			if i < len(want) {
+				m.Expected = want[i]
+			}
+			if i < len(have) {
+				m.Got = have[i]
+			}
+			if m.Expected == nil || m.Got == nil || !bytes.Equal(m.Expected, m.Got) {
+				mismatches = append(mismatches, m)
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// unbindPDU returns the BER encoding of an UnbindRequest.
+func unbindPDU(messageID int) []byte {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
+	envelope.AppendChild(ber.Encode(ber.ClassApplication, ber.TypePrimitive, ldap.TagUnbindRequest, nil, "Unbind Request"))
+	return envelope.Bytes()
+}
@@ -0,0 +1,81 @@
+package ldapserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func TestE2E_SessionRecordAndReplay(t *testing.T) {
+	var transcript syncBuffer
+	addr, stop := startLoggingServer(t, func(s *Server) {
+		s.SessionRecorder = NewSessionRecorder(&transcript)
+	})
+	conn := dialAndBind(t, addr)
+	if _, err := conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, nil)); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	conn.Unbind()
+	conn.Close()
+	waitUntil(t, "the unbind request is recorded", func() bool {
+		return strings.Contains(transcript.String(), `"UnbindRequest"`)
+	})
+	stop()
+
+	records, err := ReadSessionRecords(strings.NewReader(transcript.String()))
+	if err != nil {
+		t.Fatalf("read transcript: %v", err)
+	}
+	var ops []string
+	for _, rec := range records {
+		if rec.MessageID == 0 {
+			// Notice of Disconnection if the server stopped first.
+			continue
+		}
+		ops = append(ops, rec.Direction+" "+rec.Op)
+		if len(rec.PDU) == 0 || rec.Time.IsZero() {
+			t.Fatalf("incomplete record %+v", rec)
+		}
+	}
+	want := "request BindRequest,response BindResponse,request SearchRequest," +
+		"response SearchResultEntry,response SearchResultEntry,response SearchResultDone,request UnbindRequest"
+	if got := strings.Join(ops, ","); got != want {
+		t.Fatalf("recorded %s, want %s", got, want)
+	}
+
+	routes := NewRouteMux()
+	routes.Bind(handleBindTest)
+	routes.Search(handleSearchTest)
+	replayer := &Replayer{Handler: routes}
+	mismatches, err := replayer.Replay(records)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches %v", mismatches)
+	}
+
+	// A handler returning no entries.
+	routes = NewRouteMux()
+	routes.Bind(handleBindTest)
+	routes.Search(func(w ResponseWriter, m *Message) {
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	replayer = &Replayer{Handler: routes, Timeout: 100 * time.Millisecond}
+	mismatches, err = replayer.Replay(records)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(mismatches) != 3 {
+		t.Fatalf("expected 3 mismatches, got %v", mismatches)
+	}
+	if m := mismatches[0]; m.MessageID != 2 || m.Index != 0 || !strings.Contains(m.String(), "response #0 is SearchResultDone") {
+		t.Fatalf("unexpected mismatch %s", m)
+	}
+	if m := mismatches[2]; m.Got != nil || !strings.Contains(m.String(), "missing response #2 SearchResultDone") {
+		t.Fatalf("unexpected mismatch %s", m)
+	}
+}
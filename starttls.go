@@ -0,0 +1,47 @@
+package ldapserver
+
+import (
+	"crypto/tls"
+)
+
+// NewStartTLSHandler returns a handler of StartTLS extended requests (RFC
+// 4511 section 4.14) upgrading the connection to TLS with config, or with
+// Server.TLSConfig when config is nil:
+//
+//	routes.Extended(ldap.NewStartTLSHandler(nil)).RequestName(ldap.NoticeOfStartTLS)
+//
+// It answers protocolError (2) when no configuration is available, and
+// operationsError (1) when TLS is already established. The connection is
+// closed if the handshake fails.
+func NewStartTLSHandler(config *tls.Config) HandlerFunc {
+	return func(w ResponseWriter, m *Message) {
+		tlsConfig := config
+		if tlsConfig == nil {
+			tlsConfig = m.Client.srv.TLSConfig
+		}
+		_, isTLS := m.Client.GetConn().(*tls.Conn)
+		res := NewExtendedResponse(LDAPResultSuccess)
+		res.SetResponseName(NoticeOfStartTLS)
+		switch {
+		case tlsConfig == nil:
+			res.SetResultCode(LDAPResultProtocolError)
+			res.SetDiagnosticMessage("StartTLS is not supported")
+			w.Write(res)
+			return
+		case isTLS:
+			res.SetResultCode(LDAPResultOperationsError)
+			res.SetDiagnosticMessage("TLS is already established")
+			w.Write(res)
+			return
+		}
+		w.Write(res)
+
+		tlsConn := tls.Server(m.Client.GetConn(), tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			m.Client.log.Warn("StartTLS handshake failed", "error", err)
+			m.Client.GetConn().Close()
+			return
+		}
+		m.Client.SetConn(tlsConn)
+	}
+}
@@ -0,0 +1,74 @@
+package ldapserver
+
+import (
+	"time"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// newNoticeOfDisconnection returns an unsolicited Notice of Disconnection
+// (RFC 4511 section 4.4.1).
+func newNoticeOfDisconnection(resultCode int, diagnostic string) ldap.ExtendedResponse {
+	r := NewExtendedResponse(resultCode)
+	r.SetDiagnosticMessage(diagnostic)
+	r.SetResponseName(NoticeOfDisconnection)
+	return r
+}
+
+// disconnect sends a Notice of Disconnection to the client and closes the
+// connection, abandoning the requests in progress.
+func (c *client) disconnect(resultCode int, diagnostic string) {
+	select {
+	case c.disconnecting <- newNoticeOfDisconnection(resultCode, diagnostic):
+	default: // already disconnecting
+	}
+}
+
+// startTimers starts the idle and lifetime timers of the connection.
+func (c *client) startTimers() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if d := c.srv.IdleTimeout; d > 0 {
+		c.idleTimer = time.AfterFunc(d, func() {
+			c.log.Info("idle timeout", "timeout", d)
+			c.disconnect(LDAPResultUnavailable, "idle timeout")
+		})
+	}
+	if d := c.srv.MaxConnectionLifetime; d > 0 {
+		c.lifetimeTimer = time.AfterFunc(d, func() {
+			c.log.Info("connection lifetime exceeded", "lifetime", d)
+			c.disconnect(LDAPResultUnavailable, "connection lifetime exceeded")
+		})
+	}
+}
+
+// stopTimers stops the timers of the connection, once it is closing.
+func (c *client) stopTimers() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, t := range []*time.Timer{c.idleTimer, c.lifetimeTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// operationStarted suspends the idle timer while a request is in progress.
+func (c *client) operationStarted() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.inProgress++
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+}
+
+// operationEnded restarts the idle timer once no request is in progress.
+func (c *client) operationEnded() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.inProgress--
+	if c.inProgress == 0 && c.idleTimer != nil {
+		c.idleTimer.Reset(c.srv.IdleTimeout)
+	}
+}
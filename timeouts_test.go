@@ -0,0 +1,186 @@
+package ldapserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// sendSearchRequest writes a base object search request for base.
+func sendSearchRequest(conn net.Conn, messageID int, base string) {
+	search := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 3, nil, "Search Request")
+	search.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, base, "baseObject"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "scope"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "derefAliases"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "sizeLimit"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "timeLimit"))
+	search.AppendChild(ber.NewLDAPBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "typesOnly"))
+	search.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, "objectClass", "present"))
+	search.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes"))
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
+	envelope.AppendChild(search)
+	conn.Write(envelope.Bytes())
+}
+
+// readNoticeOfDisconnection reads the next message of conn, expected to be
+// a Notice of Disconnection, and returns its diagnostic message.
+func readNoticeOfDisconnection(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	p, err := ber.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	op := p.Children[1]
+	if id := p.Children[0].Value.(int64); id != 0 || op.Tag != ber.Tag(ApplicationExtendedResponse) ||
+		len(op.Children) < 4 || string(op.Children[3].Data.Bytes()) != string(NoticeOfDisconnection) {
+		t.Fatalf("expected a Notice of Disconnection, got message %d: %s", id, hexDump(p.Bytes()).LogValue())
+	}
+	return op.Children[2].Value.(string)
+}
+
+// startTimeoutServer starts a server configured by configure, and returns
+// its address, the server and a function releasing the searches of other
+// bases, which wait for it.
+func startTimeoutServer(t *testing.T, configure func(*Server)) (string, *Server, func()) {
+	t.Helper()
+	release := make(chan struct{})
+	var once sync.Once
+	routes := NewRouteMux()
+	routes.Search(func(w ResponseWriter, m *Message) {
+		// Entries of 64 KiB, every 20ms.
+		for range 10 {
+			e := NewSearchResultEntry("cn=big")
+			e.AddAttribute("description", ldap.AttributeValue(strings.Repeat("x", 64<<10)))
+			w.Write(e)
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	}).BaseDn("cn=big")
+	routes.Search(func(w ResponseWriter, m *Message) {
+		// 64 MiB of entries, more than socket buffers hold.
+		for range 1024 {
+			e := NewSearchResultEntry("cn=huge")
+			e.AddAttribute("description", ldap.AttributeValue(strings.Repeat("x", 64<<10)))
+			w.Write(e)
+		}
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	}).BaseDn("cn=huge")
+	routes.Search(func(w ResponseWriter, m *Message) {
+		select {
+		case <-release:
+		case <-m.Done:
+			return
+		}
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	var server *Server
+	addr, _ := serveTest(t, nil, routes, func(s *Server) {
+		server = s
+		configure(s)
+	})
+	return addr, server, func() { once.Do(func() { close(release) }) }
+}
+
+func TestE2E_IdleTimeout(t *testing.T) {
+	addr, _, release := startTimeoutServer(t, func(s *Server) {
+		s.IdleTimeout = 100 * time.Millisecond
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// A request in progress for longer than the idle timeout is answered.
+	sendSearchRequest(conn, 1, "dc=slow")
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if p, err := ber.ReadPacket(conn); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected nothing while the search is in progress, got %v, %v", p, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	release()
+	p, err := ber.ReadPacket(conn)
+	if err != nil || p.Children[1].Tag != ber.Tag(ApplicationSearchResultDone) {
+		t.Fatalf("expected the search result, got %v, %v", p, err)
+	}
+	answered := time.Now()
+	if diag := readNoticeOfDisconnection(t, conn); diag != "idle timeout" {
+		t.Errorf("diagnostic = %q", diag)
+	}
+	if elapsed := time.Since(answered); elapsed < 100*time.Millisecond {
+		t.Errorf("disconnected %v after the search, before being idle for the timeout", elapsed)
+	}
+	if _, err := ber.ReadPacket(conn); err == nil {
+		t.Error("connection not closed after the notice")
+	}
+}
+
+func TestE2E_MaxConnectionLifetime(t *testing.T) {
+	addr, _, _ := startTimeoutServer(t, func(s *Server) {
+		s.MaxConnectionLifetime = 100 * time.Millisecond
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	sendSearchRequest(conn, 1, "dc=slow")
+	if diag := readNoticeOfDisconnection(t, conn); diag != "connection lifetime exceeded" {
+		t.Errorf("diagnostic = %q", diag)
+	}
+}
+
+func TestE2E_WriteTimeout(t *testing.T) {
+	addr, server, _ := startTimeoutServer(t, func(s *Server) {
+		s.WriteTimeout = 100 * time.Millisecond
+	})
+
+	// A search writing for longer than the timeout, to a client reading
+	// its responses, succeeds.
+	conn, err := goldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	res, err := conn.Search(goldap.NewSearchRequest("cn=big", goldap.ScopeBaseObject, goldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, nil))
+	if err != nil || len(res.Entries) != 10 {
+		t.Fatalf("search: %v", err)
+	}
+
+	// A client not reading its responses is disconnected.
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer raw.Close()
+	sendSearchRequest(raw, 1, "cn=huge")
+	connected := func() bool {
+		for _, c := range server.Connections() {
+			if c.RemoteAddr.String() == raw.LocalAddr().String() {
+				return true
+			}
+		}
+		return false
+	}
+	waitUntil(t, "the client is connected", connected)
+	waitUntil(t, "the client is disconnected", func() bool { return !connected() })
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.Copy(io.Discard, raw)
+	if err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+	if n >= 1024*64<<10 {
+		t.Errorf("all %d bytes of the responses were written", n)
+	}
+}
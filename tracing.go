@@ -0,0 +1,96 @@
+package ldapserver
+
+import (
+	"context"
+
+	ldap "github.com/vjeantet/goldap/message"
+)
+
+// Tracer traces the processing of requests. Set Server.Tracer to an
+// implementation, such as the OpenTelemetry adapter of the otelldap
+// package.
+//
+// Methods are called concurrently from the goroutines serving connections.
+type Tracer interface {
+	// StartOperation is called before the handler of a request. The
+	// returned context is available to the handler from Message.Context.
+	StartOperation(ctx context.Context, info OperationInfo) (context.Context, OperationSpan)
+}
+
+// OperationSpan is a request traced by a Tracer.
+type OperationSpan interface {
+	// End is called once the handler has returned.
+	End(result OperationResult)
+}
+
+// OperationInfo describes a request.
+type OperationInfo struct {
+	Op           string // operation name, see OperationName
+	MessageID    int
+	ConnectionID int
+	// BaseDN is the base of a search or the DN targeted by the request:
+	// the name of a bind, the entry of an add, delete, modify, modify DN
+	// or compare request. It is empty for other requests.
+	BaseDN string
+	// Scope and Filter are set for searches only. Scope is -1 otherwise.
+	Scope  int
+	Filter string
+}
+
+// OperationResult is the outcome of a request.
+type OperationResult struct {
+	ResultCode int  // result code sent, when HasResult is true
+	HasResult  bool // false when the handler sent no result
+	Entries    int  // number of search result entries sent
+}
+
+// newOperationInfo describes the request of m.
+func newOperationInfo(m *Message) OperationInfo {
+	info := OperationInfo{
+		Op:           OperationName(m.ProtocolOp()),
+		MessageID:    m.MessageID().Int(),
+		ConnectionID: m.Client.Numero,
+		Scope:        -1,
+	}
+	switch r := m.ProtocolOp().(type) {
+	case ldap.BindRequest:
+		info.BaseDN = string(r.Name())
+	case ldap.SearchRequest:
+		info.BaseDN = string(r.BaseObject())
+		info.Scope = int(r.Scope())
+		info.Filter = r.FilterString()
+	case ldap.AddRequest:
+		info.BaseDN = string(r.Entry())
+	case ldap.DelRequest:
+		info.BaseDN = string(r)
+	case ldap.ModifyRequest:
+		info.BaseDN = string(r.Object())
+	case ldap.ModifyDNRequest:
+		if req, err := parseModifyDNRequest(r); err == nil {
+			info.BaseDN = req.entry
+		}
+	case ldap.CompareRequest:
+		info.BaseDN = string(r.Entry())
+	}
+	return info
+}
+
+// startTrace starts tracing the request of m, when s has a Tracer, and sets
+// the context of m.
+func (s *Server) startTrace(m *Message) OperationSpan {
+	if s.Tracer == nil {
+		return nil
+	}
+	ctx, span := s.Tracer.StartOperation(m.Context(), newOperationInfo(m))
+	if ctx != nil {
+		m.ctx = ctx
+	}
+	return span
+}
+
+// outcome returns the result of the operation.
+func (o *operation) outcome() OperationResult {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return OperationResult{ResultCode: o.resultCode, HasResult: o.hasResult, Entries: o.entries}
+}
@@ -0,0 +1,151 @@
+package ldapserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+type tracingKey struct{}
+
+// recordingTracer records the operations it traces.
+type recordingTracer struct {
+	mutex   sync.Mutex
+	infos   []OperationInfo
+	results []OperationResult
+}
+
+func (t *recordingTracer) StartOperation(ctx context.Context, info OperationInfo) (context.Context, OperationSpan) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.infos = append(t.infos, info)
+	return context.WithValue(ctx, tracingKey{}, info.MessageID), recordingSpan{t}
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+}
+
+func (s recordingSpan) End(result OperationResult) {
+	s.t.mutex.Lock()
+	s.t.results = append(s.t.results, result)
+	s.t.mutex.Unlock()
+}
+
+func TestE2E_Tracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	server.Tracer = tracer
+	var handlerContext any
+	routes := NewRouteMux()
+	routes.Bind(handleBindTest)
+	routes.Search(func(w ResponseWriter, m *Message) {
+		handlerContext = m.Context().Value(tracingKey{})
+		handleSearchTest(w, m)
+	})
+	server.Handle(routes)
+	go server.Serve(ln)
+	var once sync.Once
+	stop := func() { once.Do(server.Stop) }
+	t.Cleanup(stop)
+
+	conn := dialAndBind(t, ln.Addr().String())
+	if _, err := conn.Search(goldap.NewSearchRequest("dc=example", goldap.ScopeSingleLevel, goldap.NeverDerefAliases,
+		0, 0, false, "(uid=alice)", nil, nil)); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	conn.Close()
+	stop()
+
+	if handlerContext != 2 {
+		t.Fatalf("handler context carries %v, want the message ID of the search", handlerContext)
+	}
+	if len(tracer.infos) != 2 || len(tracer.results) != 2 {
+		t.Fatalf("expected 2 traced operations, got %v %v", tracer.infos, tracer.results)
+	}
+	want := OperationInfo{Op: "bind", MessageID: 1, ConnectionID: tracer.infos[0].ConnectionID, BaseDN: "cn=test", Scope: -1}
+	if tracer.infos[0] != want {
+		t.Errorf("bind info = %+v, want %+v", tracer.infos[0], want)
+	}
+	want = OperationInfo{Op: "search", MessageID: 2, ConnectionID: want.ConnectionID, BaseDN: "dc=example", Scope: 1, Filter: "(uid=alice)"}
+	if tracer.infos[1] != want {
+		t.Errorf("search info = %+v, want %+v", tracer.infos[1], want)
+	}
+	if r := tracer.results[1]; !r.HasResult || r.ResultCode != LDAPResultSuccess || r.Entries != 2 {
+		t.Errorf("unexpected search result %+v", r)
+	}
+}
+
+func TestE2E_MessageContextCancelled(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cancelled := make(chan error, 1)
+	routes := NewRouteMux()
+	routes.Search(func(w ResponseWriter, m *Message) {
+		started <- struct{}{}
+		<-m.Context().Done()
+		cancelled <- m.Context().Err()
+	})
+	server := NewServer()
+	server.Handle(routes)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	send := func(c *rawClient, id int64, op *ber.Packet) {
+		envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+		envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "messageID"))
+		envelope.AppendChild(op)
+		if _, err := c.conn.Write(envelope.Bytes()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	startSearch := func(c *rawClient) {
+		req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(ApplicationSearchRequest), nil, "Search Request")
+		req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "dc=example", "baseObject"))
+		req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "scope"))
+		req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "derefAliases"))
+		req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "sizeLimit"))
+		req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "timeLimit"))
+		req.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "typesOnly"))
+		req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, "objectClass", "present"))
+		req.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes"))
+		send(c, 1, req)
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the search did not start")
+		}
+	}
+	expectCancelled := func(name string) {
+		select {
+		case err := <-cancelled:
+			if err != context.Canceled {
+				t.Errorf("%s: context error %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: the context was not cancelled", name)
+		}
+	}
+
+	c := dialRaw(t, ln.Addr().String())
+	startSearch(c)
+	send(c, 2, ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, ApplicationAbandonRequest, 1, "Abandon Request"))
+	expectCancelled("abandon")
+
+	c = dialRaw(t, ln.Addr().String())
+	startSearch(c)
+	c.conn.Close()
+	expectCancelled("connection close")
+}
@@ -0,0 +1,145 @@
+package ldapserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PeerCredentials are the credentials of the process at the other end of a
+// Unix domain socket, as reported by the kernel (SO_PEERCRED).
+type PeerCredentials struct {
+	UID, GID, PID int
+}
+
+// DN returns the DN identifying the peer, in the form used by OpenLDAP:
+// "gidNumber=<gid>+uidNumber=<uid>,cn=peercred,cn=external,cn=auth".
+func (p PeerCredentials) DN() string {
+	return fmt.Sprintf("gidNumber=%d+uidNumber=%d,cn=peercred,cn=external,cn=auth", p.GID, p.UID)
+}
+
+// PeerCredentials returns the credentials of the peer of a Unix domain
+// socket connection. ok is false for other connections, and on platforms
+// other than Linux.
+func (c *client) PeerCredentials() (cred PeerCredentials, ok bool) {
+	conn, isUnix := c.conn().(*net.UnixConn)
+	if !isUnix {
+		return PeerCredentials{}, false
+	}
+	uid, gid, pid, err := unixPeerCredentials(conn)
+	if err != nil {
+		return PeerCredentials{}, false
+	}
+	return PeerCredentials{UID: uid, GID: gid, PID: pid}, true
+}
+
+// UnixSocket is the configuration of the socket created by ListenUnix.
+type UnixSocket struct {
+	Mode os.FileMode // permissions of the socket file, 0666 by default
+	UID  int         // owner of the socket file, -1 to keep the process one
+	GID  int         // group of the socket file, -1 to keep the process one
+}
+
+// UnixSocketMode sets the permissions of the socket file.
+func UnixSocketMode(mode os.FileMode) func(*UnixSocket) {
+	return func(s *UnixSocket) {
+		s.Mode = mode
+	}
+}
+
+// UnixSocketOwner sets the owner and group of the socket file. Use -1 to
+// keep either of them.
+func UnixSocketOwner(uid, gid int) func(*UnixSocket) {
+	return func(s *UnixSocket) {
+		s.UID, s.GID = uid, gid
+	}
+}
+
+// ListenUnix listens on the Unix domain socket path, replacing a stale
+// socket file left by a previous process. It fails if path exists and is
+// not a socket, such as a regular file or a symbolic link. The file is
+// removed when the listener is closed.
+//
+// The socket is created in a private directory next to path, given its
+// permissions and owner, and then renamed to path, so that it is never
+// reachable with other permissions.
+func ListenUnix(path string, options ...func(*UnixSocket)) (net.Listener, error) {
+	socket := UnixSocket{Mode: 0666, UID: -1, GID: -1}
+	for _, option := range options {
+		option(&socket)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("listen unix %s: file exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: socket in use", path)
+		}
+		os.Remove(path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ldapi")
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("listen unix %s", path), err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, socket.Mode)
+	if err == nil && (socket.UID != -1 || socket.GID != -1) {
+		err = os.Chown(tmp, socket.UID, socket.GID)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, errors.Join(fmt.Errorf("listen unix %s", path), err)
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener is a listener on a socket renamed to path.
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close closes the listener and removes the socket file.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// ListenAndServeUnix listens on the Unix domain socket path, for ldapi://
+// clients, and then calls Serve to handle requests on incoming
+// connections. The options configure the socket file, see ListenUnix:
+//
+//	server.ListenAndServeUnix("/run/ldapi", ldap.UnixSocketMode(0660), ldap.UnixSocketOwner(-1, ldapGID))
+//
+// Handlers get the credentials of the client process with
+// m.Client.PeerCredentials(), and the EXTERNAL SASL mechanism binds it as
+// PeerCredentials.DN.
+func (s *Server) ListenAndServeUnix(path string, options ...func(*UnixSocket)) error {
+	ln, err := ListenUnix(path, options...)
+	if err != nil {
+		return err
+	}
+	s.Listener = ln
+	s.log().Info("listening", "addr", path)
+	return s.serve()
+}
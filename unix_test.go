@@ -0,0 +1,109 @@
+package ldapserver
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+func TestE2E_ListenUnix(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ldapi")
+	// A socket file left by a previous process is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := ListenUnix(path, UnixSocketMode(0600))
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode %v, %v", info, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Fatalf("unexpected files %v, %v", entries, err)
+	}
+	if _, err := ListenUnix(path); err == nil {
+		t.Fatal("expected an error for a socket in use")
+	}
+
+	creds := make(chan PeerCredentials, 1)
+	routes := NewRouteMux()
+	routes.Bind(NewSASLServer(NewExternalMechanism()).ServeLDAP).AuthenticationChoice("sasl")
+	routes.Search(func(w ResponseWriter, m *Message) {
+		cred, _ := m.Client.PeerCredentials()
+		creds <- cred
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	var accessLog syncBuffer
+	server := NewServer()
+	server.AccessLog = &accessLog
+	server.Handle(routes)
+	go server.Serve(ln)
+
+	conn, err := goldap.DialURL("ldapi://" + path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := conn.ExternalBind(); err != nil {
+		t.Fatalf("external bind: %v", err)
+	}
+	who, err := conn.WhoAmI(nil)
+	want := PeerCredentials{UID: os.Getuid(), GID: os.Getgid(), PID: os.Getpid()}
+	if err != nil || who.AuthzID != "dn:"+want.DN() {
+		t.Fatalf("whoami = %v, %v", who, err)
+	}
+	if _, err := conn.Search(goldap.NewSearchRequest("", goldap.ScopeBaseObject, goldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, nil)); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if cred := <-creds; cred != want {
+		t.Fatalf("peer credentials = %+v, want %+v", cred, want)
+	}
+	conn.Close()
+	server.Stop()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed: %v", err)
+	}
+	if log := accessLog.String(); !strings.Contains(log, "connection from local uid=") {
+		t.Errorf("unexpected access log:\n%s", log)
+	}
+}
+
+func TestListenUnix_RefusesOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "target"), link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	for _, path := range []string{file, link} {
+		if ln, err := ListenUnix(path); err == nil {
+			ln.Close()
+			t.Fatalf("expected an error listening on %s", path)
+		}
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "data" {
+		t.Errorf("regular file changed: %q, %v", data, err)
+	}
+	if target, err := os.Readlink(link); err != nil || target != filepath.Join(dir, "target") {
+		t.Errorf("symbolic link changed: %q, %v", target, err)
+	}
+}
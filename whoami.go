@@ -0,0 +1,9 @@
+package ldapserver
+
+// handleWhoAmI is the built-in handler for the "Who am I?" Extended
+// Operation (RFC 4532, OID 1.3.6.1.4.1.4203.1.11.3). It responds with the
+// authorization identity of the connection, empty when anonymous.
+func handleWhoAmI(w ResponseWriter, r *Message) {
+	res := NewExtendedResponseWithValue(LDAPResultSuccess, "", []byte(r.Client.AuthzID()))
+	w.Write(res)
+}
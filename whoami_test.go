@@ -0,0 +1,88 @@
+package ldapserver
+
+import (
+	"encoding/asn1"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// startBuiltinExtendedServer starts a server which only routes Bind
+// requests, leaving extended operations to the built-in handlers.
+func startBuiltinExtendedServer(t *testing.T) string {
+	t.Helper()
+	routes := NewRouteMux()
+	routes.Bind(handleBindTest)
+	addr, _ := serveTest(t, nil, routes)
+	return addr
+}
+
+func TestE2E_BuiltinWhoAmI(t *testing.T) {
+	addr := startBuiltinExtendedServer(t)
+
+	conn, err := goldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	res, err := conn.WhoAmI(nil)
+	if err != nil {
+		t.Fatalf("anonymous whoami: %v", err)
+	}
+	if res.AuthzID != "" {
+		t.Fatalf("expected empty authzId before bind, got %q", res.AuthzID)
+	}
+
+	if err := conn.Bind("cn=test", "secret"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	res, err = conn.WhoAmI(nil)
+	if err != nil {
+		t.Fatalf("whoami: %v", err)
+	}
+	if res.AuthzID != "dn:cn=test" {
+		t.Fatalf("expected authzId dn:cn=test, got %q", res.AuthzID)
+	}
+
+	// A failed bind leaves the connection anonymous.
+	if err := conn.Bind("cn=test", "wrong"); err == nil {
+		t.Fatal("expected bind failure")
+	}
+	res, err = conn.WhoAmI(nil)
+	if err != nil {
+		t.Fatalf("whoami after failed bind: %v", err)
+	}
+	if res.AuthzID != "" {
+		t.Fatalf("expected empty authzId after failed bind, got %q", res.AuthzID)
+	}
+}
+
+func TestE2E_BuiltinGetConnectionID(t *testing.T) {
+	addr := startBuiltinExtendedServer(t)
+
+	ids := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		conn := dialAndBind(t, addr)
+		defer conn.Close()
+
+		res, err := conn.Extended(goldap.NewExtendedRequest(string(NoticeOfGetConnectionID), nil))
+		if err != nil {
+			t.Fatalf("get connection id: %v", err)
+		}
+		if res.Name != string(NoticeOfGetConnectionID) {
+			t.Fatalf("expected responseName %s, got %q", NoticeOfGetConnectionID, res.Name)
+		}
+		if res.Value == nil {
+			t.Fatal("expected a responseValue")
+		}
+		var id int
+		if _, err := asn1.Unmarshal(res.Value.Data.Bytes(), &id); err != nil {
+			t.Fatalf("decode connection id: %v", err)
+		}
+		if id < 1 || ids[id] {
+			t.Fatalf("expected a new positive connection id, got %d", id)
+		}
+		ids[id] = true
+	}
+}